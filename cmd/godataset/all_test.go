@@ -0,0 +1,924 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dodgebc/go-game-utils/sgfgrab"
+)
+
+// exprGame is the game filter expressions are tested on, parsed so that KM is recorded
+var exprGame = func() sgfgrab.GameData {
+	games, err := sgfgrab.Grab("(;SZ[19]KM[6.5]DT[2015-05-06]RE[W+R]BR[5d]WR[3d];B[pd])")
+	if err != nil {
+		panic(err)
+	}
+	g := games[0]
+	g.Length = 120
+	g.Source = "kgs"
+	g.Extra = map[string]interface{}{"TC": "300", "GID": []interface{}{"a", "b"}}
+	return g
+}()
+
+func TestFilterExpression(t *testing.T) {
+	testTable := []struct {
+		expression string
+		result     bool
+		explain    string // when false
+	}{
+		{`Komi == 6.5`, true, ""},
+		{`Size == "19x19" && Year >= 2010`, true, ""},
+		{`Size == "9x9"`, false, `failed Size == "9x9" (Size is "19x19")`},
+		{`Year > 2015`, false, `failed Year > 2015 (Year is 2015)`},
+
+		// && binds tighter than ||, and ! tighter than both
+		{`Komi == 0 && Year == 2015 || Length == 120`, true, ""},
+		{`Komi == 0 && (Year == 2015 || Length == 120)`, false, `failed Komi == 0 (Komi is 6.5)`},
+		{`!Komi == 0 && Year == 2015`, true, ""},
+		{`not (Komi == 6.5 or Year == 2000) and Length > 100`, false, `failed not (Komi == 6.5 or Year == 2000)`},
+		{`Komi == 0 || Year == 2000`, false, `failed Komi == 0 || Year == 2000`},
+		{`Length > 100 && Komi < 6 && Year == 2015`, false, `failed Komi < 6 (Komi is 6.5)`},
+
+		// Lists
+		{`Source in ["ogs", "kgs"]`, true, ""},
+		{`Source in ["ogs", "tygem"]`, false, `failed Source in ["ogs", "tygem"] (Source is "kgs")`},
+		{`Year in [2014, 2015]`, true, ""},
+		{`BlackRank in [4d, 5d]`, true, ""},
+
+		// Ranks, with text literals read as ranks, and unknown ranks never matching
+		{`BlackRank >= 5d && WhiteRank < "4d"`, true, ""},
+		{`BlackRank > WhiteRank`, true, ""},
+		{`WhiteRank >= 5d`, false, `failed WhiteRank >= 5d (WhiteRank is 3d)`},
+		{`BlackRank > 1p`, false, `failed BlackRank > 1p (BlackRank is 5d)`},
+		{`Extra.TC >= 300 && Extra.TC == "300" && Extra.GID == "a,b"`, true, ""},
+		{`Extra.TC < 100`, false, `failed Extra.TC < 100 (Extra.TC is "300")`},
+		{`Extra.GID > 1`, false, `failed Extra.GID > 1 (Extra.GID is "a,b")`},
+
+		// Dates, from their first day
+		{`Date < 2016-03-01 && Date >= 2015-05 && Date > "2015"`, true, ""},
+		{`Date == 2015-05-06 && Date in [2014, 2015-05-06]`, true, ""},
+		{`Date < 2015`, false, `failed Date < 2015 (Date is 2015-05-06)`},
+		{`Date != 2015-05-06`, false, `failed Date != 2015-05-06 (Date is 2015-05-06)`},
+	}
+	for _, test := range testTable {
+		expr, err := compileFilter(test.expression)
+		if err != nil {
+			t.Errorf("%s: %s", test.expression, err)
+			continue
+		}
+		if result := expr.eval(&exprGame); result != test.result {
+			t.Errorf("%s: got %v, want %v", test.expression, result, test.result)
+			continue
+		}
+		if explain := expr.explain(&exprGame); !test.result && (explain != test.explain) {
+			t.Errorf("%s: explained as %q, want %q", test.expression, explain, test.explain)
+		}
+	}
+
+	// Unknown values fail every comparison, even !=, but zero can still be known
+	unknown := sgfgrab.GameData{BlackRankValue: &sgfgrab.Rank{Unranked: true}, Score: 2, End: "Resign"}
+	for _, expression := range []string{
+		`BlackRank >= 1d`, `BlackRank < 1d`, `BlackRank != 1d`, `WhiteRank == 1d`, `BlackRank in [1d]`,
+		`Year < 2000`, `Year != 2000`, `Komi < 1`, `Time < 60`, `Score > 1`, `Date < 2000-01-01`, `Date != 2000`,
+	} {
+		expr, err := compileFilter(expression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expr.eval(&unknown) {
+			t.Errorf("%s: true for an unknown value", expression)
+		}
+		if explain := expr.explain(&unknown); !strings.Contains(explain, "unknown") {
+			t.Errorf("%s: explained as %q", expression, explain)
+		}
+	}
+	games, err := sgfgrab.Grab("(;KM[0])")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expr, err := compileFilter(`Komi == 0 && Handicap == 0 && Length == 0`); (err != nil) || !expr.eval(&games[0]) {
+		t.Errorf("known zeros not matched: %v", err)
+	}
+}
+
+func TestFilterExpressionErrors(t *testing.T) {
+	testTable := []struct {
+		expression string
+		err        string
+	}{
+		{`Komi ==`, `expected field or value but found "end" at position 7`},
+		{`Komi = 6.5`, `unexpected "=" at position 5`},
+		{`Kom == 6.5`, `unknown field "Kom" at position 0`},
+		{`Source < "kgs"`, `cannot compare Source with "kgs" using < (only == and != for text)`},
+		{`Komi == "6.5"`, `cannot compare Komi with "6.5"`},
+		{`BlackRank >= "strong"`, `invalid rank "strong"`},
+		{`BlackRank >= 5x`, `invalid rank "5x" at position 13`},
+		{`BlackRank >= 5dxyz`, `invalid rank "5dxyz" at position 13`},
+		{`BlackRank >= "5d?"`, `invalid rank "5d?"`},
+		{`Date < 2016-13-01`, `invalid date "2016-13-01" at position 7`},
+		{`Date < 2016-3-1`, `invalid date "2016-3-1" at position 7`},
+		{`Date < "March 2016"`, `invalid date "March 2016"`},
+		{`Date < Year`, `cannot compare Date with Year`},
+		{`Extra.TC < 2016-03-01`, `cannot compare Extra.TC with 2016-03-01`},
+		{`Source in ["kgs", 3]`, `cannot compare Source with 3`},
+		{`Source in "kgs"`, `expected "[" but found "\"kgs\"" at position 10`},
+		{`(Komi == 6.5`, `expected ")" but found "end" at position 12`},
+		{`Komi == 6.5 Year == 2015`, `unexpected "Year" at position 12`},
+		{`Source == "kgs`, `unterminated string at position 10`},
+		{`Komi == 6.5 # comment`, `unexpected '#' at position 12`},
+	}
+	for _, test := range testTable {
+		if _, err := compileFilter(test.expression); (err == nil) || (err.Error() != test.err) {
+			t.Errorf("%s: got error %v, want %s", test.expression, err, test.err)
+		}
+	}
+}
+
+func TestParseSplits(t *testing.T) {
+	splits, err := parseSplits("train=0.9, val=0.05,test = 0.05")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []split{{"train", 0.9}, {"val", 0.05}, {"test", 0.05}}
+	if !reflect.DeepEqual(splits, expected) {
+		t.Errorf("got %v, want %v", splits, expected)
+	}
+	for _, s := range []string{"", "train", "train=1,val=0", "train=0.5,train=0.5", "train=0.5,val=0.4", "a.b=1", "train=x"} {
+		if _, err := parseSplits(s); err == nil {
+			t.Errorf("no error parsing splits %q", s)
+		}
+	}
+
+	// Splits follow their fractions and do not depend on the shard
+	files, err := newOutputFiles("games.jsonl.gz", "jsonl.gz", 4, splits, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		name := files.name(packet{hash: r.Uint64()})
+		counts[strings.SplitN(name, "-", 2)[0]]++
+	}
+	if (counts["games.train"] < 8800) || (counts["games.val"] < 400) || (counts["games.test"] < 400) || (len(counts) != 3) {
+		t.Errorf("unexpected split counts %v", counts)
+	}
+}
+
+func TestOutputFilesExisting(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"games.jsonl.gz", "games-00000-of-00004.jsonl.gz", "games-00005-of-00004.jsonl.gz",
+		"games.train.jsonl.gz", "games.train-00001-of-00002.jsonl.gz", "games.val.kgs.jsonl.gz",
+		"games.rejects.jsonl.gz", "games.backup.jsonl.gz", "games.notes.txt", "other.jsonl.gz",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testTable := []struct {
+		splits   []split
+		stratify string
+		existing []string
+	}{
+		{nil, "", []string{"games-00000-of-00004.jsonl.gz", "games.jsonl.gz"}},
+		{[]split{{"train", 0.5}, {"val", 0.5}}, "", []string{"games-00000-of-00004.jsonl.gz", "games.jsonl.gz", "games.train-00001-of-00002.jsonl.gz", "games.train.jsonl.gz"}},
+		{[]split{{"val", 1}}, "Source", []string{"games-00000-of-00004.jsonl.gz", "games.jsonl.gz", "games.val.kgs.jsonl.gz"}},
+	}
+	for _, test := range testTable {
+		files, err := newOutputFiles(filepath.Join(dir, "games.jsonl.gz"), "jsonl.gz", 2, test.splits, test.stratify)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expected []string
+		for _, name := range test.existing {
+			expected = append(expected, filepath.Join(dir, name))
+		}
+		if existing := files.existing(); !reflect.DeepEqual(existing, expected) {
+			t.Errorf("splits %v, stratify %q: got %v, want %v", test.splits, test.stratify, existing, expected)
+		}
+	}
+
+	// A manifest is replaced first, along with the files it lists whatever their names
+	if err := os.WriteFile(filepath.Join(dir, "games.gameids-00003.bin"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := &manifest{Version: manifestVersion, Files: map[string]manifestFile{filepath.Join(dir, "games.backup.jsonl.gz"): {}}}
+	if err := m.save(filepath.Join(dir, "games.manifest.json")); err != nil {
+		t.Fatal(err)
+	}
+	files, err := newOutputFiles(filepath.Join(dir, "games.jsonl.gz"), "jsonl.gz", 1, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []string
+	for _, name := range []string{"games.manifest.json", "games-00000-of-00004.jsonl.gz", "games.backup.jsonl.gz", "games.gameids-00003.bin", "games.jsonl.gz"} {
+		expected = append(expected, filepath.Join(dir, name))
+	}
+	if existing := files.existing(); !reflect.DeepEqual(existing, expected) {
+		t.Errorf("with manifest: got %v, want %v", existing, expected)
+	}
+}
+
+func TestHashSet(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	hashes := make([]uint64, 20000)
+	for i := range hashes {
+		hashes[i] = r.Uint64()
+	}
+
+	// Spilling to runs and merging them loses nothing
+	s := newHashSet(1024)
+	defer s.close()
+	for _, h := range hashes {
+		if added, err := s.add(h); !added || (err != nil) {
+			t.Fatalf("adding new hash %x: %v, %v", h, added, err)
+		}
+	}
+	if (s.dir == "") || (len(s.stripes[0].runs) == 0) {
+		t.Fatal("hashes not spilled")
+	}
+	for _, h := range hashes {
+		if added, err := s.add(h); added || (err != nil) {
+			t.Fatalf("adding hash %x again: %v, %v", h, added, err)
+		}
+	}
+	if found, err := s.has(r.Uint64()); found || (err != nil) {
+		t.Errorf("unknown hash found: %v", err)
+	}
+
+	// Saved in order, and loaded back with everything on disk
+	path := filepath.Join(t.TempDir(), "hashes.bin")
+	if err := s.save(path); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sorted := append([]uint64(nil), hashes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	if len(b) != 8*len(sorted) {
+		t.Fatalf("saved %d bytes for %d hashes", len(b), len(sorted))
+	}
+	for i, h := range sorted {
+		if binary.BigEndian.Uint64(b[8*i:]) != h {
+			t.Fatalf("hash %d saved out of order", i)
+		}
+	}
+	loaded, err := loadHashSet(path, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.close()
+	for _, h := range hashes[:1000] {
+		if found, err := loaded.has(h); !found || (err != nil) {
+			t.Fatalf("loaded hash %x not found: %v", h, err)
+		}
+	}
+	if added, err := loaded.add(r.Uint64()); !added || (err != nil) {
+		t.Errorf("new hash not added to loaded set: %v", err)
+	}
+
+	// Files which are not sorted are refused
+	binary.BigEndian.PutUint64(b, sorted[1])
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadHashSet(path, 0); err == nil {
+		t.Error("no error loading unsorted hashes")
+	}
+}
+
+func TestReorderBuffer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out := make(chan packet)
+	order := newReorderBuffer(ctx, out)
+
+	// Record files of 3, 0 (malformed), 1, and 2 games, done out of order from several
+	// goroutines, with every other game rejected
+	var packets []packet
+	for seq, count := range []int{3, 0, 1, 2} {
+		if count == 0 {
+			packets = append(packets, packet{seq: seq})
+		}
+		for i := 0; i < count; i++ {
+			packets = append(packets, packet{seq: seq, index: i, count: count, member: string(rune('a' + len(packets)))})
+		}
+	}
+	rand.New(rand.NewSource(1)).Shuffle(len(packets), func(i, j int) { packets[i], packets[j] = packets[j], packets[i] })
+	var wg sync.WaitGroup
+	for i, p := range packets {
+		wg.Add(1)
+		go func(p packet, accepted bool) {
+			defer wg.Done()
+			order.done(p, accepted)
+		}(p, (p.member == "") || (i%2 == 0))
+	}
+	go func() {
+		wg.Wait()
+		order.close()
+	}()
+
+	var got []packet
+	for p := range out {
+		got = append(got, p)
+	}
+	var want []packet
+	for i, p := range packets {
+		if (p.count > 0) && (i%2 == 0) {
+			want = append(want, p)
+		}
+	}
+	sort.Slice(want, func(i, j int) bool {
+		return (want[i].seq < want[j].seq) || ((want[i].seq == want[j].seq) && (want[i].index < want[j].index))
+	})
+	if len(got) != len(want) {
+		t.Fatalf("released %d games, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if (got[i].member != want[i].member) || (got[i].position != i) {
+			t.Errorf("released %q at position %d, want %q at %d", got[i].member, got[i].position, want[i].member, i)
+		}
+	}
+}
+
+func TestManifestRestore(t *testing.T) {
+	dir := t.TempDir()
+	path := func(name string) string { return filepath.Join(dir, name) }
+	write := func(name, data string) {
+		if err := os.WriteFile(path(name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("games-00000-of-00002.jsonl.gz", "committed")
+	tail, err := tailChecksum(path("games-00000-of-00002.jsonl.gz"), 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("games-00000-of-00002.jsonl.gz", "committed+partial")
+	write("games-00001-of-00002.jsonl.gz", "partial")
+	write("games.backup.jsonl.gz", "not ours")
+	write("games.duplicates-00002.bin", "new")
+	write("games.duplicates-00001.bin", "current")
+	m := &manifest{
+		Files:      map[string]manifestFile{path("games-00000-of-00002.jsonl.gz"): {9, tail}},
+		Pending:    []string{path("games-00001-of-00002.jsonl.gz"), path("games.duplicates-00002.bin"), path("games.duplicates-00001.bin"), path("games.missing.jsonl.gz")},
+		Duplicates: path("games.duplicates-00001.bin"),
+	}
+	if err := m.restore(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(path("games-00000-of-00002.jsonl.gz")); (err != nil) || (string(b) != "committed") {
+		t.Errorf("committed output restored to %q: %v", b, err)
+	}
+	for name, kept := range map[string]bool{
+		"games-00001-of-00002.jsonl.gz": false,
+		"games.duplicates-00002.bin":    false,
+		"games.duplicates-00001.bin":    true,
+		"games.backup.jsonl.gz":         true,
+	} {
+		if _, err := os.Stat(path(name)); (err == nil) != kept {
+			t.Errorf("%s kept is %v, want %v", name, err == nil, kept)
+		}
+	}
+	if len(m.Pending) != 0 {
+		t.Errorf("pending files left: %v", m.Pending)
+	}
+
+	// Committed output must still be there in full, unchanged
+	m.Files[path("games-00000-of-00002.jsonl.gz")] = manifestFile{20, tail}
+	if err := m.restore(); err == nil {
+		t.Error("no error restoring output shorter than committed")
+	}
+	write("games-00000-of-00002.jsonl.gz", "rewritten+longer")
+	m.Files[path("games-00000-of-00002.jsonl.gz")] = manifestFile{9, tail}
+	if err := m.restore(); err == nil {
+		t.Error("no error restoring output which was replaced")
+	}
+	if b, _ := os.ReadFile(path("games-00000-of-00002.jsonl.gz")); string(b) != "rewritten+longer" {
+		t.Errorf("replaced output cut to %q", b)
+	}
+	m.Files = map[string]manifestFile{path("games.gone.jsonl.gz"): {1, tail}}
+	if err := m.restore(); err == nil {
+		t.Error("no error restoring missing output")
+	}
+}
+
+func TestReadRecords(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sgf := []byte("(;B[aa])")
+
+	// A zip of records, nested in a gzipped tar
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	for _, name := range []string{"z1.sgf", "notes.txt", "sub/z2.ugf"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(sgf)
+	}
+	zw.Close()
+	var tgz bytes.Buffer
+	gw := gzip.NewWriter(&tgz)
+	tw := tar.NewWriter(gw)
+	for name, data := range map[string][]byte{"t1.gib": sgf, "inner.zip": zipped.Bytes()} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg})
+		tw.Write(data)
+	}
+	tw.Close()
+	gw.Close()
+
+	write("a.sgf", sgf)
+	write("b/c.tgz", tgz.Bytes())
+	write("b/readme.md", []byte("not a record"))
+	write("b/fake.zip", []byte("not a zip")) // Skipped in a directory
+	records, errc := readRecords(context.Background(), dir)
+	var members []string
+	for f := range records {
+		if !bytes.Equal(f.data, sgf) {
+			t.Errorf("%s: read %q", f.member, f.data)
+		}
+		members = append(members, f.member)
+	}
+	if err := <-errc; err != nil {
+		t.Error(err)
+	}
+	sort.Strings(members)
+	expected := []string{"a.sgf", "b/c.tgz/inner.zip/sub/z2.ugf", "b/c.tgz/inner.zip/z1.sgf", "b/c.tgz/t1.gib"}
+	if !reflect.DeepEqual(members, expected) {
+		t.Errorf("read %v, want %v", members, expected)
+	}
+
+	// A broken archive given directly is an error, after the records before it
+	write("broken.tgz", tgz.Bytes()[:tgz.Len()/2])
+	records, errc = readRecords(context.Background(), filepath.Join(dir, "broken.tgz"))
+	for range records {
+	}
+	if err := <-errc; err == nil {
+		t.Error("no error reading a truncated archive")
+	}
+	records, errc = readRecords(context.Background(), filepath.Join(dir, "b/fake.zip"))
+	for range records {
+	}
+	if err := <-errc; !errors.Is(err, errNotInput) {
+		t.Errorf("unexpected error reading a file which is not an archive: %v", err)
+	}
+}
+
+// testArguments parses command line arguments on fresh flags, restored after the test
+func testArguments(t *testing.T, args ...string) *arguments {
+	commandLine, osArgs := flag.CommandLine, os.Args
+	t.Cleanup(func() {
+		flag.CommandLine, os.Args = commandLine, osArgs
+	})
+	flag.CommandLine = flag.NewFlagSet("godataset", flag.ContinueOnError)
+	flag.CommandLine.SetOutput(io.Discard)
+	os.Args = append([]string{"godataset"}, args...)
+	var a arguments
+	a.parse()
+	return &a
+}
+
+func TestLoadConfig(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(config, []byte(`{
+		"inputs": ["x.tgz", "y/"],
+		"pipeline": [
+			{"sources": {"x.tgz": "kgs"}},
+			{"minlength": 20},
+			{"checklegal": true, "ruleset": "NZ"},
+			{"minrank": "1d"}
+		],
+		"shards": 4,
+		"out": "games.jsonl",
+		"format": "jsonl"
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flags on the command line take precedence, and its inputs replace those of the config
+	a := testArguments(t, "-config", config, "-minlength", "30", "-shards", "2")
+	stages, err := a.loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"sources", "minlength", "checklegal", "rank"}; !reflect.DeepEqual(stages, expected) {
+		t.Errorf("stages %v, want %v", stages, expected)
+	}
+	if (a.minLength != 30) || (a.shards != 2) || !a.checkLegal || (a.ruleset != "NZ") || (a.minRank != "1d") || (a.outFile != "games.jsonl") || (a.format != "jsonl") {
+		t.Errorf("flags not set from config: %+v", a)
+	}
+	if !reflect.DeepEqual(a.inputs, []string{"x.tgz", "y/"}) || (a.sourceNames["x.tgz"] != "kgs") {
+		t.Errorf("inputs %v and sources %v not set from config", a.inputs, a.sourceNames)
+	}
+	a = testArguments(t, "-config", config, "z.sgf")
+	if _, err := a.loadConfig(); (err != nil) || !reflect.DeepEqual(a.inputs, []string{"z.sgf"}) {
+		t.Errorf("inputs %v not replaced by the command line: %v", a.inputs, err)
+	}
+
+	// Stages run in the order of the pipeline, then in the default order
+	a.deduplicate = true
+	a.orderStages(stages)
+	if expected := []string{"sources", "minlength", "checklegal", "rank", "deduplicate"}; !reflect.DeepEqual(a.stages, expected) {
+		t.Errorf("stages %v, want %v", a.stages, expected)
+	}
+	a.metaOnly = true
+	a.orderStages([]string{"metaonly", "deduplicate"})
+	if expected := []string{"deduplicate", "sources", "rank", "minlength", "checklegal", "metaonly"}; !reflect.DeepEqual(a.stages, expected) {
+		t.Errorf("stages %v, want %v with metaonly last", a.stages, expected)
+	}
+
+	for _, bad := range []string{
+		`{"config": "other.json"}`,
+		`{"nosuchflag": 1}`,
+		`{"pipeline": [{"minlength": 20, "minrank": "1d"}]}`,
+		`{"pipeline": [{"out": "x.jsonl.gz"}]}`,
+		`{"shards": "many"}`,
+		`[1, 2]`,
+		`{"pipeline": [{"filter": "Length >= 0"}, {"minlength": 1}, {"filter": "Year > 0"}]}`,
+		`{"pipeline": [{}]}`,
+	} {
+		if err := os.WriteFile(config, []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := testArguments(t, "-config", config).loadConfig(); err == nil {
+			t.Errorf("no error loading config %s", bad)
+		}
+	}
+}
+
+func TestCheckIncrementalGameID(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out.jsonl.gz")
+	if err := testArguments(t, "-incremental", "-gameid", "-out", out, "games.tgz").check(); err == nil {
+		t.Error("no error for -incremental -gameid without -deduplicate")
+	}
+	if err := testArguments(t, "-incremental", "-gameid", "-deduplicate", "-out", out, "games.tgz").check(); err != nil {
+		t.Errorf("error for -incremental -gameid -deduplicate: %s", err)
+	}
+}
+
+// TestMain runs godataset itself when started as a subprocess by runGodataset
+func TestMain(m *testing.M) {
+	if args := os.Getenv("GODATASET_ARGS"); args != "" {
+		os.Args = []string{"godataset"}
+		var given []string
+		if err := json.Unmarshal([]byte(args), &given); err != nil {
+			panic(err)
+		}
+		os.Args = append(os.Args, given...)
+		flag.CommandLine = flag.NewFlagSet("godataset", flag.ExitOnError) // Without test flags
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runGodataset runs godataset in a directory, returning its output and an error if it failed
+func runGodataset(t *testing.T, dir string, args ...string) (string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(executable)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GODATASET_ARGS="+string(b))
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// writeTgz writes records to a .tar.gz archive, in order of their names
+func writeTgz(t *testing.T, path string, records map[string]string) {
+	var names []string
+	for name := range records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b bytes.Buffer
+	gw := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gw)
+	for _, name := range names {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(records[name])), Typeflag: tar.TypeReg})
+		tw.Write([]byte(records[name]))
+	}
+	tw.Close()
+	gw.Close()
+	if err := os.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readGames reads the games in a .jsonl.gz or .jsonl output file
+func readGames(t *testing.T, path string) []sgfgrab.GameData {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		if r, err = gzip.NewReader(f); err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+	}
+	var games []sgfgrab.GameData
+	dec := json.NewDecoder(r)
+	for {
+		var g sgfgrab.GameData
+		if err := dec.Decode(&g); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		games = append(games, g)
+	}
+	return games
+}
+
+func TestMetaOnlyFixedHandicap(t *testing.T) {
+	dir := t.TempDir()
+	writeTgz(t, filepath.Join(dir, "games.tgz"), map[string]string{
+		"fixed.sgf": "(;SZ[19]HA[2]AB[pd][dp];W[qq];B[cc])",
+		"free.sgf":  "(;SZ[19]HA[2]AB[aa][bb];W[qq];B[cc])",
+	})
+	if out, err := runGodataset(t, dir, "-metaonly", "-fixedhandicap", "-out", "out.jsonl.gz", "games.tgz"); err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+	games := readGames(t, filepath.Join(dir, "out.jsonl.gz"))
+	if len(games) != 1 {
+		t.Fatalf("got %d games, want the one with a fixed handicap", len(games))
+	}
+	if (games[0].Handicap != 2) || (len(games[0].Setup) != 0) || (len(games[0].Moves) != 0) {
+		t.Errorf("got handicap %d, setup %v, and moves %v, want handicap 2 and no stones", games[0].Handicap, games[0].Setup, games[0].Moves)
+	}
+}
+
+func TestOutputFormat(t *testing.T) {
+	dir := t.TempDir()
+	writeTgz(t, filepath.Join(dir, "games.tgz"), map[string]string{
+		"a.sgf": "(;SZ[19];B[pd];W[dp])",
+		"b.sgf": "(;SZ[19];B[dd];W[pp])",
+		"c.sgf": "(;SZ[9];B[ee])",
+	})
+	if out, err := runGodataset(t, dir, "-format", "jsonl", "-shards", "2", "-out", "out.jsonl", "games.tgz"); err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+	games := 0
+	for _, name := range []string{"out-00000-of-00002.jsonl", "out-00001-of-00002.jsonl"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			games += len(readGames(t, filepath.Join(dir, name)))
+		}
+	}
+	if games != 3 {
+		t.Errorf("got %d games in plain jsonl shards, want 3", games)
+	}
+	for _, args := range [][]string{{"-out", "out.jsonl.gz", "-format", "jsonl"}, {"-out", "out.jsonl", "-format", "csv"}} {
+		if _, err := runGodataset(t, dir, append(args, "games.tgz")...); err == nil {
+			t.Errorf("no error running with %v", args)
+		}
+	}
+}
+
+func TestOrderedDeduplicate(t *testing.T) {
+	dir := t.TempDir()
+	records := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		move := fmt.Sprintf("%c%c", 'a'+(i/2)%19, 'a'+(i/2)/19)
+		comment := "" // Slowing down each first copy, so the next one can overtake it
+		if i%2 == 0 {
+			comment = strings.Repeat(";C[slow]", 5000)
+		}
+		records[fmt.Sprintf("%03d.sgf", i)] = fmt.Sprintf("(;SZ[19]PB[%03d];B[%s]%s;W[ss])", i, move, comment)
+	}
+	writeTgz(t, filepath.Join(dir, "games.tgz"), records)
+	if out, err := runGodataset(t, dir, "-ordered", "-deduplicate", "-parfactor", "8", "-out", "out.jsonl.gz", "games.tgz"); err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+	games := readGames(t, filepath.Join(dir, "out.jsonl.gz"))
+	if len(games) != 50 {
+		t.Fatalf("got %d games, want 50", len(games))
+	}
+	for i, g := range games {
+		if want := fmt.Sprintf("%03d", 2*i); g.BlackPlayer != want {
+			t.Errorf("got game %d from %s, want the first copy from %s", i, g.BlackPlayer, want)
+		}
+	}
+}
+
+func TestReportRejects(t *testing.T) {
+	dir := t.TempDir()
+	writeTgz(t, filepath.Join(dir, "games.tgz"), map[string]string{
+		"a.sgf":      "(;SZ[19];B[pd];W[dp];B[pp])(;SZ[19];B[dd])(;SZ[19];B[cc])",
+		"broken.sgf": "(;SZ[9];B[pd])",
+	})
+	if out, err := runGodataset(t, dir, "-minlength", "2", "-report", "report.json", "-rejects", "rejects.jsonl", "-out", "out.jsonl.gz", "games.tgz"); err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "report.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report runReport
+	if err := json.Unmarshal(b, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Status != "ok" || len(report.Archives) != 1 {
+		t.Fatalf("got status %q with %d archives, want ok with 1", report.Status, len(report.Archives))
+	}
+	a := report.Archives[0]
+	if want := map[string]int{"malformed": 1, "short": 2, "accepted": 1}; !reflect.DeepEqual(a.Counts, want) {
+		t.Errorf("got counts %v, want %v", a.Counts, want)
+	}
+	if a.Records != 2 {
+		t.Errorf("got %d records, want 2", a.Records)
+	}
+	if n := a.Errors["short"]["game length N too short"]; n != 2 {
+		t.Errorf("got errors %v, want 2 short games grouped", a.Errors)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "rejects.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var rejections []rejection
+	dec := json.NewDecoder(f)
+	for {
+		var r rejection
+		if err := dec.Decode(&r); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		r.Reason = ""
+		rejections = append(rejections, r)
+	}
+	sort.Slice(rejections, func(i, j int) bool {
+		return (rejections[i].Member < rejections[j].Member) || ((rejections[i].Member == rejections[j].Member) && (rejections[i].Index < rejections[j].Index))
+	})
+	want := []rejection{
+		{"games.tgz", "a.sgf", 1, "short", ""},
+		{"games.tgz", "a.sgf", 2, "short", ""},
+		{"games.tgz", "broken.sgf", 0, "malformed", ""},
+	}
+	if !reflect.DeepEqual(rejections, want) {
+		t.Errorf("got rejections %v, want %v", rejections, want)
+	}
+}
+
+// playerGames writes a .tar.gz archive with a game for each black player, with moves
+// decided by the player so that games of the same player are duplicates
+func playerGames(t *testing.T, path string, players ...string) {
+	records := make(map[string]string)
+	for i, player := range players {
+		move := fmt.Sprintf("%c%c", 'a'+player[0]%19, 'a'+player[len(player)-1]%19)
+		records[fmt.Sprintf("%03d.sgf", i)] = fmt.Sprintf("(;SZ[19]PB[%s];B[%s];W[ss])", player, move)
+	}
+	writeTgz(t, path, records)
+}
+
+// truncateFile cuts a file to half its size
+func truncateFile(t *testing.T, path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()/2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// players lists the black players of games, sorted
+func players(games []sgfgrab.GameData) []string {
+	var names []string
+	for _, g := range games {
+		names = append(names, g.BlackPlayer)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestOnError(t *testing.T) {
+	dir := t.TempDir()
+	playerGames(t, filepath.Join(dir, "a.tgz"), "a1", "a2")
+	playerGames(t, filepath.Join(dir, "b.tgz"), "b1", "b2")
+	var many []string
+	for i := 0; i < 500; i++ {
+		many = append(many, fmt.Sprintf("t%d", i))
+	}
+	playerGames(t, filepath.Join(dir, "trunc.tgz"), many...)
+	truncateFile(t, filepath.Join(dir, "trunc.tgz"))
+
+	if out, err := runGodataset(t, dir, "-onerror", "skip", "-out", "out.jsonl.gz", "a.tgz", "trunc.tgz", "b.tgz"); err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+	var kept []string
+	for _, player := range players(readGames(t, filepath.Join(dir, "out.jsonl.gz"))) {
+		if !strings.HasPrefix(player, "t") {
+			kept = append(kept, player)
+		}
+	}
+	if want := []string{"a1", "a2", "b1", "b2"}; !reflect.DeepEqual(kept, want) {
+		t.Errorf("got games %v with -onerror skip, want %v", kept, want)
+	}
+
+	// The output of the earlier run is only replaced by a run which succeeds
+	before, err := os.ReadFile(filepath.Join(dir, "out.jsonl.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := runGodataset(t, dir, "-onerror", "abort", "-force", "-out", "out.jsonl.gz", "b.tgz", "trunc.tgz"); err == nil {
+		t.Errorf("no error with -onerror abort: %s", out)
+	}
+	after, err := os.ReadFile(filepath.Join(dir, "out.jsonl.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("output changed by a run which was aborted")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".tgz") && (e.Name() != "out.jsonl.gz") {
+			t.Errorf("got %s after -onerror abort, want no partial output", e.Name())
+		}
+	}
+}
+
+func TestIncrementalResume(t *testing.T) {
+	dir := t.TempDir()
+	playerGames(t, filepath.Join(dir, "a.tgz"), "a1", "a2")
+	playerGames(t, filepath.Join(dir, "b.tgz"), "b1", "a1", "b2")
+	playerGames(t, filepath.Join(dir, "c.tgz"), "c1", "b1")
+	playerGames(t, filepath.Join(dir, "trunc.tgz"), "t1", "t2", "t3", "t4")
+	truncateFile(t, filepath.Join(dir, "trunc.tgz"))
+	args := []string{"-incremental", "-deduplicate", "-out", "out.jsonl.gz"}
+
+	if out, err := runGodataset(t, dir, append(args, "a.tgz")...); err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+	if out, err := runGodataset(t, dir, append(args, "a.tgz", "b.tgz", "trunc.tgz")...); err == nil {
+		t.Fatalf("no error on a truncated input: %s", out)
+	}
+
+	// Bytes written after the last commit are cut when resuming
+	f, err := os.OpenFile(filepath.Join(dir, "out.jsonl.gz"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("partial gzip member")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	out, err := runGodataset(t, dir, append(args, "a.tgz", "b.tgz", "c.tgz")...)
+	if err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+	for _, input := range []string{"a.tgz", "b.tgz"} {
+		if !strings.Contains(out, input+": already in dataset") {
+			t.Errorf("%s not skipped as committed: %s", input, out)
+		}
+	}
+	got := players(readGames(t, filepath.Join(dir, "out.jsonl.gz")))
+	if want := []string{"a1", "a2", "b1", "b2", "c1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got games %v, want %v deduplicated across runs", got, want)
+	}
+}
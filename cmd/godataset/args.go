@@ -6,73 +6,228 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+
+	"github.com/dodgebc/go-game-utils/sgfgrab"
 )
 
 type arguments struct {
 
 	// Input/output
-	outFile    string
-	sourceFile string
-	tgzFiles   []string
+	configFile  string
+	force       bool
+	outFile     string
+	sourceFile  string
+	reportFile  string
+	rejectsFile string
+	sourceNames map[string]string // from sourceFile
+	inputs      []string          // records, directories, or archives
+	incremental bool
+	manifest    *manifest // from outFile if incremental, or nil for a new dataset
+
+	// Parsing
+	keepText bool
+	lenient  string
+	repair   sgfgrab.Repair // from lenient
+	extra    string
+	extras   []string // from extra
 
 	// Filters
-	gameid      bool
-	metaOnly    bool
-	minLength   int
-	deduplicate bool
-	checkLegal  bool
-	ruleset     string
+	gameid        bool
+	metaOnly      bool
+	minLength     int
+	deduplicate   bool
+	dedupMemory   int
+	checkLegal    bool
+	fixedHandicap bool
+	ruleset       string
+	gameRules     bool
+	normRanks     bool
+	minRank       string
+	maxRank       string
+	filter        string
+	filterExpr    exprNode // from filter
+	stages        []string // filters and transforms in order
+
+	// Output
+	format   string
+	shards   int
+	splits   string
+	stratify string
+	files    outputFiles // from outFile, format, shards, splits, and stratify
+	replaced []string    // existing output files to remove, confirmed or with force
 
 	// Execution
 	workers int
+	ordered bool
+	onError string
 	verbose bool
 }
 
 func (a *arguments) parse() {
 
 	// Assign variables
-	flag.StringVar(&a.outFile, "out", "", "output filepath for .jsonl.gz dataset")
+	flag.StringVar(&a.configFile, "config", "", "JSON file setting flags by name, \"inputs\", and the \"pipeline\" of filters and transforms in order (see config.go), overridden by the command line")
+	flag.BoolVar(&a.force, "force", false, "overwrite existing output files without asking, also removing those left by other -shards, and any -incremental manifest with the files it lists")
+	flag.StringVar(&a.outFile, "out", "", "output filepath for the dataset, like out.jsonl.gz")
+	flag.BoolVar(&a.incremental, "incremental", false, "keep a manifest beside the output to add only new inputs on later runs (deduplicating against games already written), and resume after a crash (with -gameid, only with -deduplicate)")
+	flag.StringVar(&a.reportFile, "report", "", "write a JSON report of the run: counts and grouped errors for each archive, timing, and flags")
+	flag.StringVar(&a.rejectsFile, "rejects", "", "write each rejected game as a JSON line with archive, member, index, kind, and reason (compressed if .gz)")
 	flag.StringVar(&a.sourceFile, "sources", "", "csv file mapping archive names to sources names, otherwise use archive name")
-	flag.BoolVar(&a.gameid, "gameid", false, "add a unique ID to each game")
+	flag.BoolVar(&a.keepText, "keeptext", false, "keep comments, descriptive game fields, and full-length values")
+	flag.StringVar(&a.lenient, "lenient", "", "comma separated repairs for malformed SGF: \"dropnode\", \"truncate\", \"closeparens\", \"duplicates\", or \"all\"")
+	flag.StringVar(&a.extra, "extra", "", "comma separated SGF properties to keep as text in the Extra field (cut short without -keeptext), e.g. \"OGSID,TC\"")
+	flag.BoolVar(&a.gameid, "gameid", false, "add a stable ID to each game, hashed from its source, moves, and key metadata")
 	flag.BoolVar(&a.metaOnly, "metaonly", false, "strip move data")
 	flag.IntVar(&a.minLength, "minlength", 0, "minimum number of moves per game")
 	flag.BoolVar(&a.deduplicate, "deduplicate", false, "remove games with duplicate move sequences")
+	flag.IntVar(&a.dedupMemory, "dedupmemory", 0, "hashes kept in memory by -deduplicate and -gameid before spilling sorted runs to temporary files, or 0 for no limit")
 	flag.BoolVar(&a.checkLegal, "checklegal", false, "check if games are legal under provided ruleset")
-	flag.StringVar(&a.ruleset, "ruleset", "", "ruleset to use for legality checking: \"NZ\", \"AGA\", \"TT\", or \"\"")
+	flag.BoolVar(&a.fixedHandicap, "fixedhandicap", false, "remove handicap games whose setup is not the standard fixed handicap for HA (catches HA not matching AB)")
+	flag.StringVar(&a.ruleset, "ruleset", "", "ruleset to use for legality checking: \"NZ\", \"AGA\", \"TT\", \"JPN\", \"KOR\", \"CHN\", \"ING\", or \"\"")
+	flag.BoolVar(&a.gameRules, "gamerules", false, "check legality under each game's own RU ruleset, using -ruleset if it has none")
+	flag.BoolVar(&a.normRanks, "normranks", false, "adjust amateur ranks onto a common scale by -sources name")
+	flag.StringVar(&a.minRank, "minrank", "", "minimum rank of both players, e.g. \"5d\" (after -normranks)")
+	flag.StringVar(&a.maxRank, "maxrank", "", "maximum rank of both players, e.g. \"9p\" (after -normranks)")
+	flag.StringVar(&a.filter, "filter", "", "keep games matching an expression over game fields (see expression.go), e.g. 'Size == \"19x19\" && Year >= 2010 && BlackRank >= 5d && Source in [\"kgs\", \"ogs\"]'")
+	flag.StringVar(&a.format, "format", "jsonl.gz", "output format: \"jsonl.gz\" for gzipped JSON lines, or \"jsonl\" for plain JSON lines")
+	flag.IntVar(&a.shards, "shards", 1, "number of output shards per split, like out-00000-of-00004.jsonl.gz, chosen by game content")
+	flag.StringVar(&a.splits, "splits", "", "comma separated named fractions for splits chosen by game content, like out.train.jsonl.gz, e.g. \"train=0.9,val=0.05,test=0.05\"")
+	flag.StringVar(&a.stratify, "stratify", "", "write each \"Source\" or \"Year\" to files of its own, like out.train.kgs.jsonl.gz")
 	flag.IntVar(&a.workers, "parfactor", 1, "parallel processing factor")
+	flag.BoolVar(&a.ordered, "ordered", false, "write games in input order: archive, member, then game within file, whatever -parfactor (with -deduplicate keeping the first copy)")
+	flag.StringVar(&a.onError, "onerror", "abort", "when an archive cannot be read: \"abort\" the run, or \"skip\" the rest of the archive (keeping games read before the error)")
 	flag.BoolVar(&a.verbose, "verbose", false, "explain all skipped games to stderr")
 
 	// Usage and parse
 	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "Usage: gofilter [options] [-out outfile] [tgzfile1 tgzfile2 ... tgzfileN]\n\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: gofilter [options] [-out outfile] [input1 input2 ... inputN]\n\n")
 		fmt.Fprintf(flag.CommandLine.Output(), "Options:\n")
 		flag.PrintDefaults()
 	}
 	flag.Parse()
-	a.tgzFiles = flag.Args()
+	a.inputs = flag.Args()
 }
 
 func (a *arguments) check() error {
+	var pipeline []string
+	if a.configFile != "" {
+		var err error
+		if pipeline, err = a.loadConfig(); err != nil {
+			return err
+		}
+	}
 	if a.minLength < 0 {
 		return errors.New("minlength must be non-negative")
 	}
+	if a.dedupMemory < 0 {
+		return errors.New("dedupmemory must be non-negative")
+	}
+	for _, name := range strings.Split(a.lenient, ",") {
+		switch strings.TrimSpace(name) {
+		case "dropnode":
+			a.repair |= sgfgrab.RepairDropNode
+		case "truncate":
+			a.repair |= sgfgrab.RepairTruncate
+		case "closeparens":
+			a.repair |= sgfgrab.RepairCloseParens
+		case "duplicates":
+			a.repair |= sgfgrab.RepairDuplicates
+		case "all":
+			a.repair |= sgfgrab.RepairAll
+		case "":
+		default:
+			return fmt.Errorf("repair %q not supported", name)
+		}
+	}
+	for _, identifier := range strings.Split(a.extra, ",") {
+		identifier = strings.TrimSpace(identifier)
+		if identifier == "" {
+			continue
+		}
+		if strings.Trim(identifier, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+			return fmt.Errorf("property %q not an SGF identifier", identifier)
+		}
+		if sgfgrab.IsBuiltinProperty(identifier) {
+			return fmt.Errorf("property %q already has a GameData field", identifier)
+		}
+		a.extras = append(a.extras, identifier)
+	}
 	switch a.ruleset {
-	case "NZ", "TT", "AGA", "":
+	case "NZ", "TT", "AGA", "JPN", "KOR", "CHN", "ING", "":
 	default:
 		return fmt.Errorf("ruleset %q not supported", a.ruleset)
 	}
+	for _, rank := range []string{a.minRank, a.maxRank} {
+		if r, err := sgfgrab.ParseRankValue("B", rank); (rank != "") && ((err != nil) || r.Unranked) {
+			return fmt.Errorf("rank %q not recognized", rank)
+		}
+	}
+	if a.filter != "" {
+		expr, err := compileFilter(a.filter)
+		if err != nil {
+			return fmt.Errorf("filter: %w", err)
+		}
+		a.filterExpr = expr
+	}
+	if a.sourceFile != "" {
+		names, err := loadSourceNames(a.sourceFile)
+		if err != nil {
+			return err
+		}
+		a.sourceNames = names
+	}
+	a.orderStages(pipeline)
+	switch a.onError {
+	case "abort", "skip":
+	default:
+		return fmt.Errorf("onerror %q not supported", a.onError)
+	}
 	if a.workers < 1 {
 		return errors.New("parfactor must be at least 1")
 	}
-	if len(a.tgzFiles) == 0 {
-		return errors.New("no tgz archives provided")
+	if a.incremental && a.gameid && !a.deduplicate {
+		return errors.New("incremental with gameid needs deduplicate, since games already in the dataset are skipped")
+	}
+	if len(a.inputs) == 0 {
+		return errors.New("no inputs provided")
 	}
 	if a.outFile == "" {
 		return errors.New("no output file provided")
 	}
-	if _, err := os.Stat(a.outFile); (err == nil) || os.IsExist(err) {
-		fmt.Print("output file already exists, overwrite? (y/n) ")
+	var splits []split
+	if a.splits != "" {
+		var err error
+		if splits, err = parseSplits(a.splits); err != nil {
+			return err
+		}
+	}
+	files, err := newOutputFiles(a.outFile, a.format, a.shards, splits, a.stratify)
+	if err != nil {
+		return err
+	}
+	a.files = files
+	if a.incremental {
+		m, err := loadManifest(a.files.manifest())
+		if err != nil {
+			return err
+		}
+		if m != nil {
+			if err := m.checkOptions(buildOptions(a.stages)); err != nil {
+				return err
+			}
+			a.manifest = m
+			return nil // Add to the dataset
+		}
+	}
+	for _, name := range a.files.existing() {
+		if (name != filepath.Clean(a.reportFile)) && (name != filepath.Clean(a.rejectsFile)) {
+			a.replaced = append(a.replaced, name)
+		}
+	}
+	if !a.force && (len(a.replaced) > 0) {
+		fmt.Printf("files of an earlier run will be removed:\n  %s\noverwrite? (y/n) ", strings.Join(a.replaced, "\n  "))
 		r := bufio.NewReader(os.Stdin)
 		overwrite, _ := r.ReadString('\n')
 		if strings.TrimSpace(overwrite) != "y" {
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// A -config file is a JSON object which can set any flag by name, with "inputs" listing
+// the inputs, "sources" either a csv file or an object mapping archive names to source
+// names, and "pipeline" listing the filters and transforms in the order they run (except
+// "metaonly", always last), as objects of the flags of each stage, which can only be one
+// step. Flags given on the command line take precedence, and inputs given on the command
+// line replace those of the config. For example:
+//
+//	{
+//		"inputs": ["kgs-2019.tgz", "ogs/"],
+//		"pipeline": [
+//			{"sources": {"kgs-2019.tgz": "kgs", "ogs": "ogs"}},
+//			{"normranks": true},
+//			{"minrank": "1d"},
+//			{"deduplicate": true, "dedupmemory": 10000000},
+//			{"checklegal": true, "ruleset": "NZ"}
+//		],
+//		"out": "games.jsonl.gz",
+//		"format": "jsonl.gz",
+//		"shards": 16,
+//		"splits": "train=0.98,val=0.01,test=0.01",
+//		"force": true
+//	}
+
+// stageFlags are the flags of each filter or transform
+var stageFlags = map[string][]string{
+	"sources":       {"sources"},
+	"gameid":        {"gameid"},
+	"metaonly":      {"metaonly"},
+	"normranks":     {"normranks"},
+	"rank":          {"minrank", "maxrank"},
+	"filter":        {"filter"},
+	"minlength":     {"minlength"},
+	"deduplicate":   {"deduplicate", "dedupmemory"},
+	"fixedhandicap": {"fixedhandicap"},
+	"checklegal":    {"checklegal", "ruleset", "gamerules"},
+}
+
+// defaultStages is the order of stages not listed in a config pipeline, with "metaonly"
+// after every stage which reads the setup or moves
+var defaultStages = []string{"sources", "gameid", "normranks", "rank", "filter", "minlength", "deduplicate", "fixedhandicap", "checklegal", "metaonly"}
+
+// stageOf finds the stage a flag belongs to, or "" for none
+func stageOf(name string) string {
+	for stage, names := range stageFlags {
+		for _, n := range names {
+			if n == name {
+				return stage
+			}
+		}
+	}
+	return ""
+}
+
+// loadConfig sets the flags not given on the command line from a config file, and
+// returns the stages in the order of its pipeline
+func (a *arguments) loadConfig() ([]string, error) {
+	b, err := os.ReadFile(a.configFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, fmt.Errorf("failed to read config: %s: %w", a.configFile, err)
+	}
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	// Set each flag unless it was given
+	set := func(name string, value json.RawMessage) error {
+		if name == "config" {
+			return errors.New("config cannot set another config")
+		}
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("no flag named %q", name)
+		}
+		if given[name] {
+			return nil
+		}
+		if (name == "sources") && bytes.HasPrefix(bytes.TrimSpace(value), []byte("{")) {
+			return json.Unmarshal(value, &a.sourceNames)
+		}
+		s := string(value)
+		if strings.HasPrefix(strings.TrimSpace(s), `"`) {
+			if err := json.Unmarshal(value, &s); err != nil {
+				return err
+			}
+		}
+		return flag.Set(name, s)
+	}
+	var stages []string
+	for key, value := range fields {
+		switch key {
+		case "inputs":
+			var inputs []string
+			if err := json.Unmarshal(value, &inputs); err != nil {
+				return nil, fmt.Errorf("config inputs: %w", err)
+			}
+			if len(a.inputs) == 0 {
+				a.inputs = inputs
+			}
+		case "pipeline":
+			var pipeline []map[string]json.RawMessage
+			if err := json.Unmarshal(value, &pipeline); err != nil {
+				return nil, fmt.Errorf("config pipeline: %w", err)
+			}
+			steps := make(map[string]int) // step number of each stage
+			for i, step := range pipeline {
+				stage := ""
+				for name, v := range step {
+					switch s := stageOf(name); {
+					case s == "":
+						return nil, fmt.Errorf("config pipeline step %d: %q is not a filter or transform", i+1, name)
+					case (stage != "") && (s != stage):
+						return nil, fmt.Errorf("config pipeline step %d: %q and %q are different stages", i+1, stage, s)
+					default:
+						stage = s
+					}
+					if err := set(name, v); err != nil {
+						return nil, fmt.Errorf("config pipeline step %d: %s: %w", i+1, name, err)
+					}
+				}
+				if stage == "" {
+					return nil, fmt.Errorf("config pipeline step %d: no filter or transform", i+1)
+				}
+				if first, ok := steps[stage]; ok {
+					return nil, fmt.Errorf("config pipeline step %d: %q is already step %d", i+1, stage, first)
+				}
+				steps[stage] = i + 1
+				stages = append(stages, stage)
+			}
+		default:
+			if err := set(key, value); err != nil {
+				return nil, fmt.Errorf("config %s: %w", key, err)
+			}
+		}
+	}
+	return stages, nil
+}
+
+// stageEnabled checks if a filter or transform runs
+func (a *arguments) stageEnabled(stage string) bool {
+	switch stage {
+	case "sources":
+		return a.sourceNames != nil
+	case "gameid":
+		return a.gameid
+	case "metaonly":
+		return a.metaOnly
+	case "normranks":
+		return a.normRanks
+	case "rank":
+		return (a.minRank != "") || (a.maxRank != "")
+	case "filter":
+		return a.filterExpr != nil
+	case "minlength":
+		return a.minLength != 0
+	case "deduplicate":
+		return a.deduplicate
+	case "fixedhandicap":
+		return a.fixedHandicap
+	case "checklegal":
+		return a.checkLegal
+	}
+	return false
+}
+
+// orderStages lists the stages which run, those of a config pipeline first, except that
+// "metaonly" always runs last so the other stages still see the moves
+func (a *arguments) orderStages(pipeline []string) {
+	a.stages = nil
+	seen := map[string]bool{"metaonly": true}
+	for _, stage := range append(pipeline, defaultStages...) {
+		if !seen[stage] && a.stageEnabled(stage) {
+			a.stages = append(a.stages, stage)
+		}
+		seen[stage] = true
+	}
+	if a.stageEnabled("metaonly") {
+		a.stages = append(a.stages, "metaonly")
+	}
+}
+
+// effectiveConfig is a config which repeats the run, for the run report
+func (a *arguments) effectiveConfig() map[string]interface{} {
+	config := make(map[string]interface{})
+	flag.VisitAll(func(f *flag.Flag) {
+		if (f.Name != "config") && (stageOf(f.Name) == "") {
+			config[f.Name] = f.Value.(flag.Getter).Get()
+		}
+	})
+	pipeline := make([]map[string]interface{}, 0, len(a.stages))
+	for _, stage := range a.stages {
+		step := make(map[string]interface{})
+		for _, name := range stageFlags[stage] {
+			step[name] = flag.Lookup(name).Value.(flag.Getter).Get()
+		}
+		if (stage == "sources") && (a.sourceFile == "") {
+			step["sources"] = a.sourceNames
+		}
+		pipeline = append(pipeline, step)
+	}
+	config["pipeline"] = pipeline
+	config["inputs"] = a.inputs
+	return config
+}
@@ -1,68 +1,30 @@
 package main
 
 import (
-	"archive/tar"
-	"compress/gzip"
+	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
+	"io/fs"
 	"os"
-	"strings"
+	"path/filepath"
+	"sort"
 	"sync"
 
 	"github.com/dodgebc/go-game-utils/sgfgrab"
 	"golang.org/x/build/pargzip"
 )
 
-func readTgzSgf(tgzFile string) <-chan []byte {
-	out := make(chan []byte)
-
-	go func() {
-		defer close(out)
-
-		// Open .tar.gz input file stream
-		fin, err := os.Open(tgzFile)
-		if err != nil {
-			log.Fatalf("failed to open tgz archive: %s", err)
-		}
-		defer fin.Close()
-
-		// Decompress input file stream
-		gzipReader, err := gzip.NewReader(fin)
-		if err != nil {
-			log.Fatalf("failed to decompress tgz archive: %s", err)
-		}
-		defer gzipReader.Close()
-
-		// Read from archive and send data for processing
-		tarReader := tar.NewReader(gzipReader)
-		for {
-			header, err := tarReader.Next()
-			if err == io.EOF {
-				break // End of archive
-			}
-			if err != nil {
-				log.Fatalf("tar archive read error: %s", err)
-			}
-
-			if header.Typeflag == tar.TypeReg {
-				// Is it an SGF file?
-				hName := header.Name
-				if (len(hName) >= 4) && (strings.ToLower(hName[len(hName)-4:]) == ".sgf") {
-					sgfBytes, err := ioutil.ReadAll(tarReader) // Read whole file
-					if err != nil {
-						log.Fatalf("tar archive file read error: %s", err)
-					}
-					out <- sgfBytes // Send for processing
-				}
-			}
-		}
-	}()
-	return out
+// recordFile is a game record read from an archive, along with its path there
+type recordFile struct {
+	member string
+	data   []byte
+	seq    int // record file number across all archives
 }
 
-func parseGame(in <-chan []byte, tgzName string, workers int) <-chan packet {
+func parseGame(ctx context.Context, in <-chan recordFile, tgzName string, opts sgfgrab.Options, workers int) <-chan packet {
 	out := make(chan packet)
 
 	go func() {
@@ -75,11 +37,25 @@ func parseGame(in <-chan []byte, tgzName string, workers int) <-chan packet {
 			go func() {
 				defer wg.Done()
 
-				// Parse SGF
-				for sgfBytes := range in {
-					games, err := sgfgrab.Grab(string(sgfBytes))
-					for _, g := range games {
-						out <- packet{game: g, err: err, tgzName: tgzName}
+				// Parse game records
+				for f := range in {
+					var ps []packet
+					games, err := sgfgrab.GrabFile(f.member, f.data, opts)
+					switch {
+					case err != nil:
+						ps = append(ps, packet{err: err, tgzName: tgzName, member: f.member, seq: f.seq})
+					case len(games) == 0:
+						ps = append(ps, packet{tgzName: tgzName, member: f.member, seq: f.seq}) // Still counts for -ordered
+					}
+					for i, g := range games {
+						ps = append(ps, packet{game: g, tgzName: tgzName, member: f.member, hash: contentHash(&g), seq: f.seq, index: i, count: len(games)})
+					}
+					for _, p := range ps {
+						select {
+						case out <- p:
+						case <-ctx.Done():
+							return
+						}
 					}
 				}
 			}()
@@ -88,8 +64,15 @@ func parseGame(in <-chan []byte, tgzName string, workers int) <-chan packet {
 	return out
 }
 
-func marshalGame(in <-chan packet, workers int) <-chan []byte {
-	out := make(chan []byte)
+// outputLine is a marshalled game and the file it goes in
+type outputLine struct {
+	file     string
+	data     []byte
+	position int // for -ordered
+}
+
+func marshalGame(ctx context.Context, in <-chan packet, files outputFiles, stop *failure, workers int) <-chan outputLine {
+	out := make(chan outputLine)
 
 	go func() {
 		defer close(out)
@@ -104,9 +87,14 @@ func marshalGame(in <-chan packet, workers int) <-chan []byte {
 				for p := range in {
 					b, err := json.Marshal(p.game)
 					if err != nil {
-						log.Fatalf("failed to marshal json: %s", err)
+						stop.fail(fmt.Errorf("%s: %s: failed to marshal json: %w", p.tgzName, p.member, err))
+						return
+					}
+					select {
+					case out <- outputLine{files.name(p), b, p.position}:
+					case <-ctx.Done():
+						return
 					}
-					out <- b
 				}
 			}()
 		}
@@ -114,34 +102,186 @@ func marshalGame(in <-chan packet, workers int) <-chan []byte {
 	return out
 }
 
-func writeGzipLines(in <-chan []byte, outFile string) <-chan struct{} {
+// commit asks writeGzipLines to finish the first lines written into the output files
+type commit struct {
+	lines   int                            // lines accepted so far
+	prepare func(names []string) error     // records the files about to be appended to
+	files   chan<- map[string]manifestFile // committed output files, or nil after a failure
+}
+
+// writeGzipLines writes lines to their files, each compressed by its own writer (unless the
+// format is plain jsonl). Files are written under temporary names and renamed when all are
+// complete, or removed if the context is canceled. With commits, lines are instead
+// appended to the output files on each commit, and lines after the last commit are removed
+// at the end. The replaced files (left by an earlier run) are removed before the first
+// output file is finished.
+func writeGzipLines(ctx context.Context, in <-chan outputLine, files outputFiles, replaced []string, commits <-chan commit, stop *failure) <-chan struct{} {
 	done := make(chan struct{})
 
 	go func() {
 		defer close(done)
+		var wg sync.WaitGroup
+		writers := make(map[string]chan<- []byte)
+		temps := make(map[string]string) // by final name
+
+		// Start a writer for a file
+		open := func(name string) chan<- []byte {
+			f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*.tmp")
+			if err != nil {
+				stop.fail(fmt.Errorf("failed to create output file: %w", err))
+				return nil
+			}
+			f.Chmod(0644) // Not the private mode of a temporary file
+			c := make(chan []byte, 64)
+			writers[name], temps[name] = c, f.Name()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := writeLinesFile(c, f, files.format == "jsonl.gz")
+				if closeErr := f.Close(); err == nil {
+					err = closeErr
+				}
+				if err != nil {
+					stop.fail(fmt.Errorf("output file write error: %s: %w", name, err))
+				}
+			}()
+			return c
+		}
+		finish := func() {
+			for _, c := range writers {
+				close(c)
+			}
+			wg.Wait()
+			writers = make(map[string]chan<- []byte)
+		}
 
-		// Open output file
-		f, err := os.Create(outFile)
-		if err != nil {
-			log.Fatalf("failed to create output file: %s", err)
+		// Remove the files of an earlier run, once
+		removeReplaced := func() bool {
+			for _, name := range replaced {
+				if err := os.Remove(name); (err != nil) && !errors.Is(err, fs.ErrNotExist) {
+					stop.fail(fmt.Errorf("failed to remove old output file: %w", err))
+					return false
+				}
+			}
+			replaced = nil
+			return true
 		}
-		defer f.Close()
 
-		// Compress output file
-		gzipWriter := pargzip.NewWriter(f)
-		defer gzipWriter.Close()
+		// Append finished files to the output files
+		appendAll := func(prepare func([]string) error) map[string]manifestFile {
+			if files.single() && (writers[files.path] == nil) {
+				if _, err := os.Stat(files.path); errors.Is(err, fs.ErrNotExist) {
+					open(files.path) // Even with no games
+				}
+			}
+			finish()
+			if !removeReplaced() {
+				return nil
+			}
+			names := make([]string, 0, len(temps))
+			for name := range temps {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			if err := prepare(names); err != nil {
+				stop.fail(err)
+				return nil
+			}
+			committed := make(map[string]manifestFile)
+			for name, temp := range temps {
+				f, err := appendFile(name, temp)
+				if err != nil {
+					stop.fail(fmt.Errorf("failed to append output file: %w", err))
+					return nil
+				}
+				committed[name] = f
+				delete(temps, name)
+			}
+			if ctx.Err() != nil { // Failed writing
+				return nil
+			}
+			return committed
+		}
+		if files.single() && (commits == nil) {
+			open(files.path) // Even with no games
+		}
 
-		// Write lines
-		for b := range in {
-			_, err := gzipWriter.Write(b)
-			if err != nil {
-				log.Fatalf("output file write error: %s", err)
+		// Send lines to writers
+		written := 0
+		var pending *commit
+	lines:
+		for {
+			if (pending != nil) && (written >= pending.lines) {
+				pending.files <- appendAll(pending.prepare)
+				pending = nil
 			}
-			_, err = gzipWriter.Write([]byte{'\n'})
-			if err != nil {
-				log.Fatalf("output file write error: %s", err)
+			select {
+			case line, ok := <-in:
+				if !ok {
+					break lines
+				}
+				c, ok := writers[line.file]
+				if !ok {
+					if c = open(line.file); c == nil {
+						break lines
+					}
+				}
+				select {
+				case c <- line.data:
+					written++
+				case <-ctx.Done():
+					break lines
+				}
+			case c := <-commits:
+				pending = &c
+			case <-ctx.Done():
+				break lines
+			}
+		}
+		finish()
+
+		// Finish all files or none
+		if (ctx.Err() == nil) && (commits == nil) {
+			removeReplaced()
+		}
+		for name, temp := range temps {
+			if (ctx.Err() != nil) || (commits != nil) {
+				os.Remove(temp)
+			} else if err := os.Rename(temp, name); err != nil {
+				stop.fail(fmt.Errorf("failed to finish output file: %w", err))
 			}
 		}
 	}()
 	return done
 }
+
+// writeLinesFile writes lines to a .jsonl.gz file, or a .jsonl file if not compress, until
+// the channel closes or a write fails
+func writeLinesFile(in <-chan []byte, f *os.File, compress bool) error {
+
+	// Compress output file, or only buffer it
+	var w io.WriteCloser = flushCloser{bufio.NewWriter(f)}
+	if compress {
+		w = pargzip.NewWriter(f)
+	}
+
+	// Write lines
+	for b := range in {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte{'\n'}); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// flushCloser flushes a buffered writer on Close
+type flushCloser struct {
+	*bufio.Writer
+}
+
+func (w flushCloser) Close() error {
+	return w.Flush()
+}
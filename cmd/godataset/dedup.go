@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+const (
+	hashStripes  = 64  // independently locked parts of a hashSet, by the top bits of a hash
+	hashRunBlock = 512 // hashes read from disk to look up a spilled hash
+	hashRunsMax  = 8   // spilled runs of a stripe before they are merged into one
+)
+
+// hashSet is a set of 64-bit hashes safe for concurrent use. It is striped so that
+// workers rarely wait for each other. With a memory limit, each stripe spills its hashes
+// to a sorted run in a temporary file when it fills up, and merges its runs as they
+// accumulate, so only a sparse index of every hashRunBlock-th hash stays in memory.
+type hashSet struct {
+	stripes [hashStripes]hashStripe
+	limit   int // hashes in memory per stripe, or 0 for no limit
+
+	dirOnce sync.Once
+	dir     string // for spilled runs
+	dirErr  error
+}
+
+// hashStripe holds the hashes whose top bits select it
+type hashStripe struct {
+	mux    sync.Mutex
+	hashes map[uint64]bool
+	runs   []*hashRun
+}
+
+// hashRun is a sorted file of big-endian hashes spilled from a stripe
+type hashRun struct {
+	f      *os.File
+	n      int      // hashes
+	fences []uint64 // first hash of each block
+}
+
+// newHashSet creates an empty set, which keeps at most about memoryLimit hashes in
+// memory (0 for no limit)
+func newHashSet(memoryLimit int) *hashSet {
+	s := &hashSet{}
+	if memoryLimit > 0 {
+		s.limit = (memoryLimit + hashStripes - 1) / hashStripes
+	}
+	for i := range s.stripes {
+		s.stripes[i].hashes = make(map[uint64]bool)
+	}
+	return s
+}
+
+// loadHashSet creates a set from a file written by save. The hashes stay on disk as one
+// spilled run per stripe, so only their sparse index is kept in memory.
+func loadHashSet(path string, memoryLimit int) (*hashSet, error) {
+	s := newHashSet(memoryLimit)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hashes: %w", err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	// Each stripe is a contiguous part of the sorted file
+	var head, last uint64
+	var n int
+	var readErr error
+	read := func() bool {
+		err := binary.Read(r, binary.BigEndian, &head)
+		switch {
+		case err == io.EOF:
+			return false
+		case err != nil:
+			readErr = err
+			return false
+		case (n > 0) && (head <= last):
+			readErr = fmt.Errorf("%s is not sorted", path)
+			return false
+		}
+		last = head
+		n++
+		return true
+	}
+	more := read()
+	for i := range s.stripes {
+		if !more || (head>>58 != uint64(i)) {
+			continue
+		}
+		if err := s.tempDir(); err != nil {
+			s.close()
+			return nil, fmt.Errorf("failed to spill hashes: %w", err)
+		}
+		run, err := s.writeRun(func() (uint64, bool) {
+			if !more || (head>>58 != uint64(i)) {
+				return 0, false
+			}
+			h := head
+			more = read()
+			return h, true
+		})
+		if err != nil {
+			s.close()
+			return nil, fmt.Errorf("failed to spill hashes: %w", err)
+		}
+		s.stripes[i].runs = append(s.stripes[i].runs, run)
+	}
+	if readErr != nil {
+		s.close()
+		return nil, fmt.Errorf("failed to read hashes: %w", readErr)
+	}
+	return s, nil
+}
+
+// add adds a hash, and returns false if it was already in the set
+func (s *hashSet) add(h uint64) (bool, error) {
+	stripe := &s.stripes[h>>58]
+	stripe.mux.Lock()
+	defer stripe.mux.Unlock()
+
+	if stripe.hashes[h] {
+		return false, nil
+	}
+	for _, run := range stripe.runs {
+		found, err := run.contains(h)
+		if err != nil {
+			return false, fmt.Errorf("failed to read spilled hashes: %w", err)
+		}
+		if found {
+			return false, nil
+		}
+	}
+	stripe.hashes[h] = true
+	if (s.limit > 0) && (len(stripe.hashes) >= s.limit) {
+		if err := s.spill(stripe); err != nil {
+			return true, fmt.Errorf("failed to spill hashes: %w", err)
+		}
+	}
+	return true, nil
+}
+
+// has checks if a hash is in the set
+func (s *hashSet) has(h uint64) (bool, error) {
+	stripe := &s.stripes[h>>58]
+	stripe.mux.Lock()
+	defer stripe.mux.Unlock()
+
+	if stripe.hashes[h] {
+		return true, nil
+	}
+	for _, run := range stripe.runs {
+		found, err := run.contains(h)
+		if err != nil {
+			return false, fmt.Errorf("failed to read spilled hashes: %w", err)
+		}
+		if found {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// tempDir creates the directory for spilled runs, once
+func (s *hashSet) tempDir() error {
+	s.dirOnce.Do(func() {
+		s.dir, s.dirErr = os.MkdirTemp("", "godataset-dedup-*")
+	})
+	return s.dirErr
+}
+
+// spill moves the hashes of a stripe to a new run, merging runs if there are too many
+func (s *hashSet) spill(stripe *hashStripe) error {
+	if err := s.tempDir(); err != nil {
+		return err
+	}
+
+	// Write the hashes in order
+	run, err := s.writeRun(stripe.sorted())
+	if err != nil {
+		return err
+	}
+	stripe.runs = append(stripe.runs, run)
+	stripe.hashes = make(map[uint64]bool)
+	if len(stripe.runs) <= hashRunsMax {
+		return nil
+	}
+
+	// Merge all runs of the stripe
+	next, readErr := stripe.merged()
+	merged, err := s.writeRun(next)
+	if *readErr != nil {
+		return *readErr
+	}
+	if err != nil {
+		return err
+	}
+	for _, r := range stripe.runs {
+		r.remove()
+	}
+	stripe.runs = []*hashRun{merged}
+	return nil
+}
+
+// sorted gives the hashes of a stripe in memory in increasing order
+func (stripe *hashStripe) sorted() func() (uint64, bool) {
+	hashes := make([]uint64, 0, len(stripe.hashes))
+	for h := range stripe.hashes {
+		hashes = append(hashes, h)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+	i := 0
+	return func() (uint64, bool) {
+		if i == len(hashes) {
+			return 0, false
+		}
+		i++
+		return hashes[i-1], true
+	}
+}
+
+// merged gives all hashes of a stripe in increasing order, taking the smallest next hash
+// of any run or the hashes in memory each time. Any read error is set once next returns
+// false.
+func (stripe *hashStripe) merged() (next func() (uint64, bool), readErr *error) {
+	readErr = new(error)
+	sources := []func() (uint64, bool){stripe.sorted()}
+	for _, r := range stripe.runs {
+		reader := bufio.NewReader(io.NewSectionReader(r.f, 0, int64(r.n)*8))
+		left := r.n
+		sources = append(sources, func() (uint64, bool) {
+			var h uint64
+			if (left == 0) || (*readErr != nil) {
+				return 0, false
+			}
+			if err := binary.Read(reader, binary.BigEndian, &h); err != nil {
+				*readErr = err
+				return 0, false
+			}
+			left--
+			return h, true
+		})
+	}
+	heads := make([]uint64, len(sources))
+	ok := make([]bool, len(sources))
+	for i := range sources {
+		heads[i], ok[i] = sources[i]()
+	}
+	next = func() (uint64, bool) {
+		min := -1
+		for i := range heads {
+			if ok[i] && ((min < 0) || (heads[i] < heads[min])) {
+				min = i
+			}
+		}
+		if (min < 0) || (*readErr != nil) {
+			return 0, false
+		}
+		h := heads[min]
+		heads[min], ok[min] = sources[min]()
+		return h, true
+	}
+	return next, readErr
+}
+
+// writeRun writes a run of the hashes given in order by next
+func (s *hashSet) writeRun(next func() (uint64, bool)) (*hashRun, error) {
+	f, err := os.CreateTemp(s.dir, "run-*")
+	if err != nil {
+		return nil, err
+	}
+	run := &hashRun{f: f}
+	w := bufio.NewWriter(f)
+	var b [8]byte
+	for h, ok := next(); ok; h, ok = next() {
+		if run.n%hashRunBlock == 0 {
+			run.fences = append(run.fences, h)
+		}
+		binary.BigEndian.PutUint64(b[:], h)
+		if _, err := w.Write(b[:]); err != nil {
+			run.remove()
+			return nil, err
+		}
+		run.n++
+	}
+	if err := w.Flush(); err != nil {
+		run.remove()
+		return nil, err
+	}
+	return run, nil
+}
+
+// contains looks up a hash by reading the one block which could hold it
+func (r *hashRun) contains(h uint64) (bool, error) {
+	block := sort.Search(len(r.fences), func(i int) bool { return r.fences[i] > h }) - 1
+	if block < 0 {
+		return false, nil
+	}
+	start := block * hashRunBlock
+	count := r.n - start
+	if count > hashRunBlock {
+		count = hashRunBlock
+	}
+	b := make([]byte, 8*count)
+	if _, err := r.f.ReadAt(b, int64(start)*8); err != nil {
+		return false, err
+	}
+	i := sort.Search(count, func(i int) bool { return binary.BigEndian.Uint64(b[8*i:]) >= h })
+	return (i < count) && (binary.BigEndian.Uint64(b[8*i:]) == h), nil
+}
+
+func (r *hashRun) remove() {
+	r.f.Close()
+	os.Remove(r.f.Name())
+}
+
+// save writes the hashes to a file in increasing order as big-endian uint64s, the format
+// of a spilled run, replacing the file atomically
+func (s *hashSet) save(path string) error {
+	err := writeFileAtomic(path, func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		var b [8]byte
+		for i := range s.stripes {
+			stripe := &s.stripes[i]
+			stripe.mux.Lock()
+			next, readErr := stripe.merged()
+			for h, ok := next(); ok; h, ok = next() {
+				binary.BigEndian.PutUint64(b[:], h)
+				bw.Write(b[:]) // Errors are kept until Flush
+			}
+			stripe.mux.Unlock()
+			if *readErr != nil {
+				return fmt.Errorf("failed to read spilled hashes: %w", *readErr)
+			}
+		}
+		return bw.Flush()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write hashes: %w", err)
+	}
+	return nil
+}
+
+// close removes any spilled runs
+func (s *hashSet) close() {
+	for i := range s.stripes {
+		for _, r := range s.stripes[i].runs {
+			r.remove()
+		}
+		s.stripes[i].runs = nil
+	}
+	if s.dir != "" {
+		os.RemoveAll(s.dir)
+	}
+}
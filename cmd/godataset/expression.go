@@ -0,0 +1,681 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dodgebc/go-game-utils/sgfgrab"
+)
+
+// Filter expressions are comparisons of game fields with values, for example
+//
+//	Size == "19x19" && Year >= 2010 && BlackRank >= 5d && WhiteRank >= 5d &&
+//	Handicap == 0 && Komi >= 6.5 && Komi <= 7.5 && End != "Time" && Source in ["kgs", "ogs"]
+//
+// Comparisons (==, !=, <, <=, >, >=, and in [...]) are joined with &&, ||, !, and
+// parentheses (or "and", "or", and "not"). Fields are named like GameData fields:
+//
+//	numbers: Rows, Cols, Komi, Handicap, Length, Score, Time, Year (Komi is unknown
+//	         without KM, Score unless End is "Scored", and Time and Year when not given)
+//	dates:   Date (its first day, compared with dates like 2016-03-01, 2016-03, 2016, or
+//	         "2016-03-01", where a month or year stands for its first day)
+//	text:    Size (like "19x19"), GameID (in decimal, after -gameid), Source, Winner, End, Ruleset, Player, BlackPlayer,
+//	         WhitePlayer, and the -keeptext fields (GameName, Event, Round, Place, Rules,
+//	         RecordSource, DateText, GameComment)
+//	ranks:   BlackRank, WhiteRank (compared with ranks like 5d or "5d", never true when unknown)
+//	extra:   Extra.XX for -extra properties (compared as text, or as numbers with numbers)
+//
+// Comparisons with unknown numbers, dates, and ranks are never true, not even !=. Text only
+// supports equality. Fields can also be compared with each other, like
+// BlackRank > WhiteRank.
+
+// exprKind is the type of an operand
+type exprKind int
+
+const (
+	exprNumber exprKind = iota
+	exprText
+	exprRank
+	exprDate
+	exprExtra // text which can also be compared as a number
+)
+
+// exprValue is an operand value, with only the fields for its kind set
+type exprValue struct {
+	number  float64
+	text    string
+	rank    sgfgrab.Rank
+	date    sgfgrab.Date
+	unknown bool // unknown number, date, or rank, or extra text which is not a number
+}
+
+// exprField reads a field from a game
+type exprField struct {
+	kind exprKind
+	get  func(g *sgfgrab.GameData) exprValue
+}
+
+// numberField, optionalNumberField, textField, rankField, and dateField make exprFields
+func numberField(get func(g *sgfgrab.GameData) float64) exprField {
+	return exprField{exprNumber, func(g *sgfgrab.GameData) exprValue { return exprValue{number: get(g)} }}
+}
+
+func optionalNumberField(get func(g *sgfgrab.GameData) (float64, bool)) exprField {
+	return exprField{exprNumber, func(g *sgfgrab.GameData) exprValue {
+		v, ok := get(g)
+		return exprValue{number: v, unknown: !ok}
+	}}
+}
+
+func textField(get func(g *sgfgrab.GameData) string) exprField {
+	return exprField{exprText, func(g *sgfgrab.GameData) exprValue { return exprValue{text: get(g)} }}
+}
+
+func rankField(get func(g *sgfgrab.GameData) *sgfgrab.Rank) exprField {
+	return exprField{exprRank, func(g *sgfgrab.GameData) exprValue {
+		r := get(g)
+		if (r == nil) || r.Unranked {
+			return exprValue{unknown: true}
+		}
+		return exprValue{rank: *r}
+	}}
+}
+
+func dateField(get func(g *sgfgrab.GameData) *sgfgrab.DateRange) exprField {
+	return exprField{exprDate, func(g *sgfgrab.GameData) exprValue {
+		r := get(g)
+		if r == nil {
+			return exprValue{unknown: true}
+		}
+		return exprValue{date: r.Start}
+	}}
+}
+
+// exprFields are the fields available to filter expressions
+var exprFields = map[string]exprField{
+	"Rows":         numberField(func(g *sgfgrab.GameData) float64 { return float64(g.Size[0]) }),
+	"Cols":         numberField(func(g *sgfgrab.GameData) float64 { return float64(g.Size[1]) }),
+	"Komi":         optionalNumberField(func(g *sgfgrab.GameData) (float64, bool) { return g.Komi, g.Recorded("KM") }),
+	"Handicap":     numberField(func(g *sgfgrab.GameData) float64 { return float64(g.Handicap) }),
+	"Length":       numberField(func(g *sgfgrab.GameData) float64 { return float64(g.Length) }),
+	"Score":        optionalNumberField(func(g *sgfgrab.GameData) (float64, bool) { return g.Score, g.End == "Scored" }),
+	"Time":         optionalNumberField(func(g *sgfgrab.GameData) (float64, bool) { return float64(g.Time), g.Time != 0 }),
+	"Year":         optionalNumberField(func(g *sgfgrab.GameData) (float64, bool) { return float64(g.Year), g.Year != 0 }),
+	"Date":         dateField(func(g *sgfgrab.GameData) *sgfgrab.DateRange { return g.Date }),
+	"Size":         textField(func(g *sgfgrab.GameData) string { return fmt.Sprintf("%dx%d", g.Size[0], g.Size[1]) }),
+	"GameID":       textField(func(g *sgfgrab.GameData) string { return strconv.FormatUint(g.GameID, 10) }),
+	"Source":       textField(func(g *sgfgrab.GameData) string { return g.Source }),
+	"Winner":       textField(func(g *sgfgrab.GameData) string { return g.Winner }),
+	"End":          textField(func(g *sgfgrab.GameData) string { return g.End }),
+	"Ruleset":      textField(func(g *sgfgrab.GameData) string { return g.Ruleset }),
+	"Player":       textField(func(g *sgfgrab.GameData) string { return g.Player }),
+	"BlackPlayer":  textField(func(g *sgfgrab.GameData) string { return g.BlackPlayer }),
+	"WhitePlayer":  textField(func(g *sgfgrab.GameData) string { return g.WhitePlayer }),
+	"GameName":     textField(func(g *sgfgrab.GameData) string { return g.GameName }),
+	"Event":        textField(func(g *sgfgrab.GameData) string { return g.Event }),
+	"Round":        textField(func(g *sgfgrab.GameData) string { return g.Round }),
+	"Place":        textField(func(g *sgfgrab.GameData) string { return g.Place }),
+	"Rules":        textField(func(g *sgfgrab.GameData) string { return g.Rules }),
+	"RecordSource": textField(func(g *sgfgrab.GameData) string { return g.RecordSource }),
+	"DateText":     textField(func(g *sgfgrab.GameData) string { return g.DateText }),
+	"GameComment":  textField(func(g *sgfgrab.GameData) string { return g.GameComment }),
+	"BlackRank":    rankField(func(g *sgfgrab.GameData) *sgfgrab.Rank { return g.BlackRankValue }),
+	"WhiteRank":    rankField(func(g *sgfgrab.GameData) *sgfgrab.Rank { return g.WhiteRankValue }),
+}
+
+// extraField reads a property from GameData.Extra, with lists joined by commas
+func extraField(identifier string) exprField {
+	return exprField{exprExtra, func(g *sgfgrab.GameData) exprValue {
+		var text string
+		switch v := g.Extra[identifier].(type) {
+		case nil:
+		case string:
+			text = v
+		case []interface{}:
+			parts := make([]string, len(v))
+			for i := range v {
+				parts[i] = fmt.Sprint(v[i])
+			}
+			text = strings.Join(parts, ",")
+		default:
+			text = fmt.Sprint(v)
+		}
+		number, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+		return exprValue{number: number, text: text, unknown: err != nil}
+	}}
+}
+
+// exprOperand is a field or a literal value
+type exprOperand struct {
+	text  string    // as written
+	field exprField // get is nil for literals
+	value exprValue // for literals
+}
+
+func (o exprOperand) kind() exprKind {
+	return o.field.kind
+}
+
+func (o exprOperand) eval(g *sgfgrab.GameData) exprValue {
+	if o.field.get == nil {
+		return o.value
+	}
+	return o.field.get(g)
+}
+
+// describe shows the value of a field operand in a game
+func (o exprOperand) describe(g *sgfgrab.GameData) string {
+	v := o.eval(g)
+	switch {
+	case (o.kind() != exprText) && (o.kind() != exprExtra) && v.unknown:
+		return fmt.Sprintf("%s unknown", o.text)
+	case o.kind() == exprRank:
+		return fmt.Sprintf("%s is %s", o.text, v.rank)
+	case o.kind() == exprDate:
+		return fmt.Sprintf("%s is %s", o.text, v.date)
+	case o.kind() == exprNumber:
+		return fmt.Sprintf("%s is %v", o.text, v.number)
+	}
+	return fmt.Sprintf("%s is %q", o.text, v.text)
+}
+
+// exprNode is a compiled filter expression
+type exprNode interface {
+	eval(g *sgfgrab.GameData) bool
+	explain(g *sgfgrab.GameData) string // why eval is false
+}
+
+type exprAnd struct {
+	left, right exprNode
+}
+
+func (e exprAnd) eval(g *sgfgrab.GameData) bool {
+	return e.left.eval(g) && e.right.eval(g)
+}
+
+func (e exprAnd) explain(g *sgfgrab.GameData) string {
+	if !e.left.eval(g) {
+		return e.left.explain(g)
+	}
+	return e.right.explain(g)
+}
+
+type exprOr struct {
+	left, right exprNode
+	text        string
+}
+
+func (e exprOr) eval(g *sgfgrab.GameData) bool {
+	return e.left.eval(g) || e.right.eval(g)
+}
+
+func (e exprOr) explain(g *sgfgrab.GameData) string {
+	return fmt.Sprintf("failed %s", e.text)
+}
+
+type exprNot struct {
+	inner exprNode
+	text  string
+}
+
+func (e exprNot) eval(g *sgfgrab.GameData) bool {
+	return !e.inner.eval(g)
+}
+
+func (e exprNot) explain(g *sgfgrab.GameData) string {
+	return fmt.Sprintf("failed %s", e.text)
+}
+
+type exprCompare struct {
+	op          string // comparison operator or "in"
+	kind        exprKind
+	left, right exprOperand
+	list        []exprOperand // for "in"
+	text        string
+}
+
+func (e exprCompare) eval(g *sgfgrab.GameData) bool {
+	left := e.left.eval(g)
+	if e.op == "in" {
+		for _, o := range e.list {
+			if compareValues(e.kind, "==", left, o.eval(g)) {
+				return true
+			}
+		}
+		return false
+	}
+	return compareValues(e.kind, e.op, left, e.right.eval(g))
+}
+
+func (e exprCompare) explain(g *sgfgrab.GameData) string {
+	var values []string
+	for _, o := range []exprOperand{e.left, e.right} {
+		if o.field.get != nil {
+			values = append(values, o.describe(g))
+		}
+	}
+	if len(values) == 0 {
+		return fmt.Sprintf("failed %s", e.text)
+	}
+	return fmt.Sprintf("failed %s (%s)", e.text, strings.Join(values, ", "))
+}
+
+// compareValues compares two values of a kind (exprExtra is compared as text)
+func compareValues(kind exprKind, op string, a, b exprValue) bool {
+	var less, greater bool
+	switch kind {
+	case exprText, exprExtra:
+		return (a.text == b.text) == (op == "==")
+	case exprNumber:
+		if a.unknown || b.unknown {
+			return false
+		}
+		less, greater = a.number < b.number, a.number > b.number
+	case exprRank:
+		if a.unknown || b.unknown {
+			return false
+		}
+		less, greater = a.rank.Less(b.rank), b.rank.Less(a.rank)
+	case exprDate:
+		if a.unknown || b.unknown {
+			return false
+		}
+		less, greater = a.date.Before(b.date), b.date.Before(a.date)
+	}
+	switch op {
+	case "==":
+		return !less && !greater
+	case "!=":
+		return less || greater
+	case "<":
+		return less
+	case "<=":
+		return !greater
+	case ">":
+		return greater
+	case ">=":
+		return !less
+	}
+	return false
+}
+
+// compileFilter parses a filter expression
+func compileFilter(expression string) (exprNode, error) {
+	tokens, err := lexFilter(expression)
+	if err != nil {
+		return nil, err
+	}
+	p := exprParser{text: expression, tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEnd {
+		return nil, fmt.Errorf("unexpected %q at position %d", t.text, t.start)
+	}
+	return node, nil
+}
+
+// tokenKind is the type of a lexical token
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenField
+	tokenNumber
+	tokenRank
+	tokenDate
+	tokenString
+	tokenOperator
+)
+
+type exprToken struct {
+	kind       tokenKind
+	text       string // operators and keywords are normalized, like "and" to "&&"
+	start, end int    // position in the expression
+}
+
+// lexFilter splits a filter expression into tokens, ending with a tokenEnd
+func lexFilter(expression string) ([]exprToken, error) {
+	isLetter := func(c byte) bool { return ((c >= 'a') && (c <= 'z')) || ((c >= 'A') && (c <= 'Z')) || (c == '_') }
+	isDigit := func(c byte) bool { return (c >= '0') && (c <= '9') }
+
+	var tokens []exprToken
+	for i := 0; i < len(expression); {
+		c := expression[i]
+		j := i + 1
+		var kind tokenKind
+		switch {
+		case (c == ' ') || (c == '\t') || (c == '\n') || (c == '\r'):
+			i++
+			continue
+		case isLetter(c):
+			for (j < len(expression)) && (isLetter(expression[j]) || isDigit(expression[j]) || (expression[j] == '.')) {
+				j++
+			}
+			kind = tokenField
+		case isDigit(c) || (((c == '-') || (c == '.')) && (j < len(expression)) && (isDigit(expression[j]) || (expression[j] == '.'))):
+			for (j < len(expression)) && (isDigit(expression[j]) || (expression[j] == '.')) {
+				j++
+			}
+			kind = tokenNumber
+			if (j+1 < len(expression)) && (expression[j] == '-') && isDigit(expression[j+1]) {
+				for (j < len(expression)) && (isDigit(expression[j]) || (expression[j] == '-')) {
+					j++
+				}
+				kind = tokenDate
+			} else if (j < len(expression)) && isLetter(expression[j]) {
+				for (j < len(expression)) && isLetter(expression[j]) {
+					j++
+				}
+				kind = tokenRank
+			}
+		case c == '"':
+			for (j < len(expression)) && (expression[j] != '"') {
+				if expression[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(expression) {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+			j++
+			kind = tokenString
+		case strings.Contains("=!<>&|", string(c)):
+			if j < len(expression) {
+				switch expression[i : j+1] {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					j++
+				}
+			}
+			kind = tokenOperator
+		case strings.Contains("()[],", string(c)):
+			kind = tokenOperator
+		default:
+			return nil, fmt.Errorf("unexpected %q at position %d", c, i)
+		}
+
+		t := exprToken{kind, expression[i:j], i, j}
+		switch {
+		case (t.kind == tokenOperator) && ((t.text == "=") || (t.text == "&") || (t.text == "|")):
+			return nil, fmt.Errorf("unexpected %q at position %d", t.text, i)
+		case t.kind == tokenField:
+			keywords := map[string]string{"and": "&&", "or": "||", "not": "!", "in": "in"}
+			if op, ok := keywords[t.text]; ok {
+				t.kind, t.text = tokenOperator, op
+			}
+		}
+		tokens = append(tokens, t)
+		i = j
+	}
+	return append(tokens, exprToken{tokenEnd, "end", len(expression), len(expression)}), nil
+}
+
+// exprParser is a recursive descent parser for filter expressions
+type exprParser struct {
+	text   string
+	tokens []exprToken
+	i      int
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.i]
+}
+
+func (p *exprParser) next() exprToken {
+	t := p.tokens[p.i]
+	if t.kind != tokenEnd {
+		p.i++
+	}
+	return t
+}
+
+// accept consumes an operator if it is next
+func (p *exprParser) accept(op string) bool {
+	if t := p.peek(); (t.kind == tokenOperator) && (t.text == op) {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(op string) error {
+	if !p.accept(op) {
+		t := p.peek()
+		return fmt.Errorf("expected %q but found %q at position %d", op, t.text, t.start)
+	}
+	return nil
+}
+
+// since is the expression text from a position to the last token consumed
+func (p *exprParser) since(start int) string {
+	return p.text[start:p.tokens[p.i-1].end]
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	start := p.peek().start
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = exprOr{left, right, p.since(start)}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = exprAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	start := p.peek().start
+	if p.accept("!") {
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return exprNot{inner, p.since(start)}, nil
+	}
+	if p.accept("(") {
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(")")
+	}
+	return p.parseCompare()
+}
+
+func (p *exprParser) parseCompare() (exprNode, error) {
+	start := p.peek().start
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	t := p.next()
+	if t.kind != tokenOperator {
+		return nil, fmt.Errorf("expected comparison but found %q at position %d", t.text, t.start)
+	}
+	e := exprCompare{op: t.text, left: left}
+	switch t.text {
+	case "in":
+		if err := p.expect("["); err != nil {
+			return nil, err
+		}
+		for {
+			o, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			kind, err := matchKinds("==", &e.left, &o)
+			if err != nil {
+				return nil, err
+			}
+			if (len(e.list) > 0) && (kind != e.kind) {
+				return nil, fmt.Errorf("%w %s with %s", errExprKinds, e.left.text, o.text)
+			}
+			e.kind = kind
+			e.list = append(e.list, o)
+			if !p.accept(",") {
+				break
+			}
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+	case "==", "!=", "<", "<=", ">", ">=":
+		if e.right, err = p.parseOperand(); err != nil {
+			return nil, err
+		}
+		if e.kind, err = matchKinds(e.op, &e.left, &e.right); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("expected comparison but found %q at position %d", t.text, t.start)
+	}
+	e.text = p.since(start)
+	return e, nil
+}
+
+func (p *exprParser) parseOperand() (exprOperand, error) {
+	t := p.next()
+	o := exprOperand{text: t.text}
+	switch t.kind {
+	case tokenField:
+		if identifier := strings.TrimPrefix(t.text, "Extra."); identifier != t.text {
+			o.field = extraField(identifier)
+			return o, nil
+		}
+		field, ok := exprFields[t.text]
+		if !ok {
+			return o, fmt.Errorf("unknown field %q at position %d", t.text, t.start)
+		}
+		o.field = field
+		return o, nil
+	case tokenNumber:
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return o, fmt.Errorf("invalid number %q at position %d", t.text, t.start)
+		}
+		o.field.kind, o.value.number = exprNumber, v
+		return o, nil
+	case tokenRank:
+		r, err := parseRankLiteral(t.text)
+		if err != nil {
+			return o, fmt.Errorf("invalid rank %q at position %d", t.text, t.start)
+		}
+		o.field.kind, o.value.rank = exprRank, r
+		return o, nil
+	case tokenDate:
+		d, err := parseDateLiteral(t.text)
+		if err != nil {
+			return o, fmt.Errorf("invalid date %q at position %d", t.text, t.start)
+		}
+		o.field.kind, o.value.date = exprDate, d
+		return o, nil
+	case tokenString:
+		s, err := strconv.Unquote(t.text)
+		if err != nil {
+			return o, fmt.Errorf("invalid string %s at position %d", t.text, t.start)
+		}
+		o.field.kind, o.value.text = exprText, s
+		return o, nil
+	}
+	return o, fmt.Errorf("expected field or value but found %q at position %d", t.text, t.start)
+}
+
+// reRankLiteral matches the ranks written in filter expressions
+var reRankLiteral = regexp.MustCompile("^[0-9]{1,2}[kdpKDP]$")
+
+// parseRankLiteral parses a rank like 5d, with nothing else
+func parseRankLiteral(s string) (sgfgrab.Rank, error) {
+	if !reRankLiteral.MatchString(s) {
+		return sgfgrab.Rank{}, fmt.Errorf("invalid rank %q", s)
+	}
+	return sgfgrab.ParseRankValue("B", strings.ToLower(s))
+}
+
+// parseDateLiteral parses a date like 2016-03-01, 2016-03, or 2016, with nothing else
+func parseDateLiteral(s string) (sgfgrab.Date, error) {
+	r, err := sgfgrab.ParseDateRange(s)
+	if (err != nil) || (r.Start.String() != s) {
+		return sgfgrab.Date{}, fmt.Errorf("invalid date %q", s)
+	}
+	return r.Start, nil
+}
+
+// errExprKinds means that two operands cannot be compared
+var errExprKinds = errors.New("cannot compare")
+
+// matchKinds finds the kind of a comparison, turning text literals into ranks or dates,
+// and numbers into years, if needed
+func matchKinds(op string, a, b *exprOperand) (exprKind, error) {
+	fail := fmt.Errorf("%w %s with %s", errExprKinds, a.text, b.text)
+	for _, o := range []*exprOperand{a, b} {
+		other := a
+		if o == a {
+			other = b
+		}
+		if ((o.kind() != exprRank) && (o.kind() != exprDate)) || (other.kind() == o.kind()) {
+			continue
+		}
+		literal := other.value.text
+		switch {
+		case other.field.get != nil:
+			return 0, fail
+		case (o.kind() == exprDate) && (other.kind() == exprNumber):
+			literal = other.text
+		case other.kind() != exprText:
+			return 0, fail
+		}
+		if o.kind() == exprRank {
+			r, err := parseRankLiteral(literal)
+			if err != nil {
+				return 0, fmt.Errorf("invalid rank %s", other.text)
+			}
+			other.field.kind, other.value.rank = exprRank, r
+		} else {
+			d, err := parseDateLiteral(literal)
+			if err != nil {
+				return 0, fmt.Errorf("invalid date %s", other.text)
+			}
+			other.field.kind, other.value.date = exprDate, d
+		}
+	}
+
+	var kind exprKind
+	switch {
+	case a.kind() == b.kind():
+		kind = a.kind()
+	case (a.kind() == exprExtra) && ((b.kind() == exprText) || (b.kind() == exprNumber)):
+		kind = b.kind()
+	case (b.kind() == exprExtra) && ((a.kind() == exprText) || (a.kind() == exprNumber)):
+		kind = a.kind()
+	default:
+		return 0, fail
+	}
+	if ((kind == exprText) || (kind == exprExtra)) && (op != "==") && (op != "!=") {
+		return 0, fmt.Errorf("%w %s with %s using %s (only == and != for text)", errExprKinds, a.text, b.text, op)
+	}
+	return kind, nil
+}
@@ -2,15 +2,15 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
-	"hash/maphash"
-	"log"
-	"math/rand"
+	"hash/fnv"
 	"os"
 	"strings"
 	"sync"
 
+	"github.com/dodgebc/go-game-utils/sgfgrab"
 	"github.com/dodgebc/go-game-utils/weiqi"
 )
 
@@ -18,7 +18,7 @@ import (
 type filterFunc func(p packet) error
 
 // filterWrapper creates a filtered channel and a non-nil error channel using the given filterFunc
-func filterWrapper(in <-chan packet, filter filterFunc, workers int) (<-chan packet, <-chan packet) {
+func filterWrapper(ctx context.Context, in <-chan packet, filter filterFunc, workers int) (<-chan packet, <-chan packet) {
 	good := make(chan packet)
 	bad := make(chan packet)
 
@@ -35,10 +35,14 @@ func filterWrapper(in <-chan packet, filter filterFunc, workers int) (<-chan pac
 
 				for p := range in {
 					p.err = filter(p)
+					out := good
 					if p.err != nil {
-						bad <- p
-					} else {
-						good <- p
+						out = bad
+					}
+					select {
+					case out <- p:
+					case <-ctx.Done():
+						return
 					}
 				}
 			}()
@@ -49,56 +53,124 @@ func filterWrapper(in <-chan packet, filter filterFunc, workers int) (<-chan pac
 }
 
 // Filter games which are too short
-func filterMinLength(in <-chan packet, minLength int, workers int) (<-chan packet, <-chan packet) {
+func filterMinLength(ctx context.Context, in <-chan packet, minLength int, workers int) (<-chan packet, <-chan packet) {
 	filter := func(p packet) error {
 		if p.game.Length < minLength {
 			return fmt.Errorf("game length %d too short", p.game.Length)
 		}
 		return nil
 	}
-	return filterWrapper(in, filter, workers)
+	return filterWrapper(ctx, in, filter, workers)
+}
+
+// duplicateHash is a stable hash of the moves and result of a game, the same across runs
+// so that it can be saved in a manifest
+func duplicateHash(g *sgfgrab.GameData) uint64 {
+	h := fnv.New64a()
+	for _, m := range g.Moves {
+		h.Write([]byte(m))
+	}
+	h.Write([]byte(g.Winner))
+	return h.Sum64()
 }
 
-// Filter duplicate games
-func filterDuplicate(in <-chan packet, workers int) (<-chan packet, <-chan packet) {
+// checkDuplicate rejects a game already in seen, and adds it otherwise
+func checkDuplicate(p packet, seen *hashSet, stop *failure) error {
+	added, err := seen.add(duplicateHash(&p.game))
+	if err != nil {
+		stop.fail(err)
+		return err
+	}
+	if !added {
+		return errors.New("duplicate game")
+	}
+	return nil
+}
 
-	// Initialize hashing
-	hashTable := make(map[uint64]bool)
-	var mux sync.Mutex
-	var hash maphash.Hash
+// Filter duplicate games, including any already in seen
+func filterDuplicate(ctx context.Context, in <-chan packet, seen *hashSet, stop *failure, workers int) (<-chan packet, <-chan packet) {
+	filter := func(p packet) error {
+		return checkDuplicate(p, seen, stop)
+	}
+	return filterWrapper(ctx, in, filter, workers)
+}
 
-	// Apply filter
+// Filter games whose GameID was issued by an earlier build of the dataset
+func filterExisting(ctx context.Context, in <-chan packet, issued *hashSet, stop *failure, workers int) (<-chan packet, <-chan packet) {
 	filter := func(p packet) error {
-		mux.Lock()
-		defer mux.Unlock()
-		hash.Reset()
-		for _, m := range p.game.Moves {
-			hash.WriteString(m)
+		found, err := issued.has(p.game.GameID)
+		if err != nil {
+			stop.fail(err)
+			return err
 		}
-		hash.WriteString(p.game.Winner)
-		sum := hash.Sum64()
-		if hashTable[sum] {
-			return errors.New("duplicate game")
+		if found {
+			return fmt.Errorf("game %d already in dataset", p.game.GameID)
 		}
-		hashTable[sum] = true
 		return nil
 	}
-	return filterWrapper(in, filter, workers)
+	return filterWrapper(ctx, in, filter, workers)
 }
 
-// Filter illegal games
-func filterIllegal(in <-chan packet, ruleset string, workers int) (<-chan packet, <-chan packet) {
+// Filter illegal games (under their own ruleset if gameRules, falling back to ruleset)
+func filterIllegal(ctx context.Context, in <-chan packet, ruleset string, gameRules bool, workers int) (<-chan packet, <-chan packet) {
 	filter := func(p packet) error {
-		return weiqi.CheckLegal(p.game.Size[0], p.game.Size[1], p.game.Setup, p.game.Moves, ruleset)
+		gameRuleset := ruleset
+		if gameRules && (p.game.Ruleset != "") {
+			gameRuleset = p.game.Ruleset
+		}
+		return weiqi.CheckLegalPosition(p.game.Size[0], p.game.Size[1], p.game.Setup, p.game.Player, p.game.Moves, gameRuleset)
 	}
-	return filterWrapper(in, filter, workers)
+	return filterWrapper(ctx, in, filter, workers)
+}
+
+// Filter games which fail a -filter expression, explaining the failed comparison
+func filterExpression(ctx context.Context, in <-chan packet, expr exprNode, workers int) (<-chan packet, <-chan packet) {
+	filter := func(p packet) error {
+		if expr.eval(&p.game) {
+			return nil
+		}
+		return errors.New(expr.explain(&p.game))
+	}
+	return filterWrapper(ctx, in, filter, workers)
+}
+
+// Filter handicap games whose setup stones are not the standard fixed handicap
+func filterHandicap(ctx context.Context, in <-chan packet, workers int) (<-chan packet, <-chan packet) {
+	filter := func(p packet) error {
+		if p.game.Handicap < 2 {
+			return nil
+		}
+		return weiqi.CheckFixedHandicap(p.game.Size[0], p.game.Size[1], p.game.Handicap, p.game.Setup)
+	}
+	return filterWrapper(ctx, in, filter, workers)
+}
+
+// Filter games where either player is outside the rank range (empty means no bound)
+func filterRank(ctx context.Context, in <-chan packet, minRank, maxRank string, workers int) (<-chan packet, <-chan packet) {
+	minValue, _ := sgfgrab.ParseRankValue("B", minRank)
+	maxValue, _ := sgfgrab.ParseRankValue("B", maxRank)
+	filter := func(p packet) error {
+		for _, r := range []*sgfgrab.Rank{p.game.BlackRankValue, p.game.WhiteRankValue} {
+			if (r == nil) || r.Unranked {
+				return errors.New("player rank unknown")
+			}
+			if (minRank != "") && r.Less(minValue) {
+				return fmt.Errorf("player rank %s below minimum", r)
+			}
+			if (maxRank != "") && maxValue.Less(*r) {
+				return fmt.Errorf("player rank %s above maximum", r)
+			}
+		}
+		return nil
+	}
+	return filterWrapper(ctx, in, filter, workers)
 }
 
 // applyFunc modifies a game
 type applyFunc func(p *packet)
 
 // applyWrapper creates a channel with modifications using the given applyFunc
-func applyWrapper(in <-chan packet, apply applyFunc, workers int) <-chan packet {
+func applyWrapper(ctx context.Context, in <-chan packet, apply applyFunc, workers int) <-chan packet {
 	out := make(chan packet)
 
 	go func() {
@@ -113,7 +185,11 @@ func applyWrapper(in <-chan packet, apply applyFunc, workers int) <-chan packet
 
 				for p := range in {
 					apply(&p)
-					out <- p
+					select {
+					case out <- p:
+					case <-ctx.Done():
+						return
+					}
 				}
 			}()
 		}
@@ -122,53 +198,39 @@ func applyWrapper(in <-chan packet, apply applyFunc, workers int) <-chan packet
 	return out
 }
 
-// Add a unique game id
-func applyGameID(in <-chan packet, workers int) <-chan packet {
-
-	// Keep track of used game IDs
-	GameIDUsed := make(map[uint32]bool)
-	var mux sync.Mutex
-	src := rand.NewSource(1)
-	random := rand.New(src)
-
-	// Use a unique random number
+// Add a stable game ID from the content and source (expects source names to be applied first)
+func applyGameID(ctx context.Context, in <-chan packet, workers int) <-chan packet {
 	apply := func(p *packet) {
-		mux.Lock()
-		defer mux.Unlock()
-		tryID := random.Uint32()
-		i := 0
-		for used := GameIDUsed[tryID]; used; used = GameIDUsed[tryID] {
-			tryID = random.Uint32()
-			if i++; i > 100 {
-				log.Fatal("random number cycle detected")
-			}
-		}
-		GameIDUsed[tryID] = true
-		p.game.GameID = tryID
+		p.game.GameID = p.game.ContentID()
 	}
-	return applyWrapper(in, apply, workers)
+	return applyWrapper(ctx, in, apply, workers)
 }
 
-// Add source name (expects a channel on which to receive the current tgzName)
-func applySourceName(in <-chan packet, sourceFile string, workers int) <-chan packet {
-
-	// Load source names
+// loadSourceNames reads a csv file mapping archive names to source names
+func loadSourceNames(sourceFile string) (map[string]string, error) {
 	sourceNames := make(map[string]string)
 	f, err := os.Open(sourceFile)
 	if err != nil {
-		log.Fatalf("failed to open sources file: %s", err)
+		return nil, fmt.Errorf("failed to open sources file: %w", err)
 	}
+	defer f.Close()
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
 		cols := strings.Split(scanner.Text(), ",")
 		if len(cols) == 2 {
 			sourceNames[strings.TrimSpace(cols[0])] = strings.TrimSpace(cols[1])
 		} else if len(cols) != 1 {
-			log.Fatalf("sources file should have two columns, found %d", len(cols))
+			return nil, fmt.Errorf("sources file should have two columns, found %d", len(cols))
 		}
 	}
-	f.Close()
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read sources file: %w", err)
+	}
+	return sourceNames, nil
+}
 
+// Add source name from loadSourceNames, otherwise the archive name
+func applySourceName(ctx context.Context, in <-chan packet, sourceNames map[string]string, workers int) <-chan packet {
 	apply := func(p *packet) {
 		if sourceName, ok := sourceNames[p.tgzName]; ok {
 			p.game.Source = sourceName
@@ -176,14 +238,29 @@ func applySourceName(in <-chan packet, sourceFile string, workers int) <-chan pa
 			p.game.Source = p.tgzName
 		}
 	}
-	return applyWrapper(in, apply, workers)
+	return applyWrapper(ctx, in, apply, workers)
+}
+
+// Adjust amateur ranks by source (expects source names to be applied first)
+func applyNormalizeRanks(ctx context.Context, in <-chan packet, workers int) <-chan packet {
+	apply := func(p *packet) {
+		if r := p.game.BlackRankValue; r != nil {
+			normalized := r.Normalize(p.game.Source)
+			p.game.BlackRankValue = &normalized
+		}
+		if r := p.game.WhiteRankValue; r != nil {
+			normalized := r.Normalize(p.game.Source)
+			p.game.WhiteRankValue = &normalized
+		}
+	}
+	return applyWrapper(ctx, in, apply, workers)
 }
 
 // Strip move data
-func applyMetaOnly(in <-chan packet, workers int) <-chan packet {
+func applyMetaOnly(ctx context.Context, in <-chan packet, workers int) <-chan packet {
 	apply := func(p *packet) {
 		p.game.Moves = p.game.Moves[:0]
 		p.game.Setup = p.game.Setup[:0]
 	}
-	return applyWrapper(in, apply, workers)
+	return applyWrapper(ctx, in, apply, workers)
 }
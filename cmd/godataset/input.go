@@ -0,0 +1,198 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dodgebc/go-game-utils/sgfgrab"
+)
+
+// errNotInput means that a file is neither a game record nor a supported archive
+var errNotInput = errors.New("not a game record or a supported archive")
+
+// archiveExtensions are the containers read by readRecords, other than record formats
+var archiveExtensions = []string{".zip", ".tar", ".tgz", ".tbz", ".tbz2", ".gz", ".bz2"}
+
+// readRecords reads game records from an input path, then sends any error reading it
+// (records before the error have already been sent). The path can be a game record, a
+// directory walked recursively, or a .zip, .tar, .tar.gz, or .tar.bz2 archive (or a
+// record compressed by gzip or bzip2), with archives nested in any of these. Containers
+// are recognized by their contents, and records by their extension.
+func readRecords(ctx context.Context, path string) (<-chan recordFile, <-chan error) {
+	out := make(chan recordFile)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(errc)
+		defer close(out)
+		r := recordReader{ctx, out}
+		if err := r.readPath(path); (err != nil) && (ctx.Err() == nil) {
+			errc <- err
+		}
+	}()
+	return out, errc
+}
+
+// recordReader sends records found in an input
+type recordReader struct {
+	ctx context.Context
+	out chan<- recordFile
+}
+
+// readPath reads a file or walks a directory. Records in a top level archive are named
+// by their path in the archive, and others by their path under the input path.
+func (r recordReader) readPath(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to open input: %w", err)
+	}
+	if !info.IsDir() {
+		return r.readFile(path, filepath.Base(path), "")
+	}
+	return filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to read directory: %w", err)
+		}
+		if !d.Type().IsRegular() || !isInput(p) {
+			return nil
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if err := r.readFile(p, rel, rel+"/"); !errors.Is(err, errNotInput) {
+			return err
+		}
+		return nil // Skip files which only look like inputs
+	})
+}
+
+func (r recordReader) readFile(path, name, prefix string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open input: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to open input: %w", err)
+	}
+	return r.read(name, prefix, f, f, info.Size())
+}
+
+// read sends the records in a file or archive stream with the given name. Members of
+// archives are named with the prefix. A ReaderAt avoids reading a whole zip into memory.
+func (r recordReader) read(name, prefix string, in io.Reader, at io.ReaderAt, size int64) error {
+	buffered := bufio.NewReaderSize(in, 4096)
+	head, _ := buffered.Peek(262)
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")) || bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		if at == nil {
+			data, err := io.ReadAll(buffered)
+			if err != nil {
+				return fmt.Errorf("%s: zip archive read error: %w", name, err)
+			}
+			at, size = bytes.NewReader(data), int64(len(data))
+		}
+		zipReader, err := zip.NewReader(at, size)
+		if err != nil {
+			return fmt.Errorf("%s: zip archive read error: %w", name, err)
+		}
+		for _, zf := range zipReader.File {
+			if zf.FileInfo().IsDir() || !isInput(zf.Name) {
+				continue
+			}
+			rc, err := zf.Open()
+			if err != nil {
+				return fmt.Errorf("%s: zip archive file read error: %s: %w", name, zf.Name, err)
+			}
+			err = r.read(prefix+zf.Name, prefix+zf.Name+"/", rc, nil, 0)
+			rc.Close()
+			if (err != nil) && !errors.Is(err, errNotInput) {
+				return err
+			}
+		}
+		return nil
+
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		gzipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return fmt.Errorf("%s: failed to decompress gzip: %w", name, err)
+		}
+		defer gzipReader.Close()
+		return r.read(uncompressedName(name), prefix, gzipReader, nil, 0)
+
+	case bytes.HasPrefix(head, []byte("BZh")):
+		return r.read(uncompressedName(name), prefix, bzip2.NewReader(buffered), nil, 0)
+
+	case ((len(head) >= 262) && (string(head[257:262]) == "ustar")) || strings.EqualFold(filepath.Ext(name), ".tar"):
+		tarReader := tar.NewReader(buffered)
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				return nil // End of archive
+			}
+			if err != nil {
+				return fmt.Errorf("%s: tar archive read error: %w", name, err)
+			}
+			if (header.Typeflag == tar.TypeReg) && isInput(header.Name) {
+				err := r.read(prefix+header.Name, prefix+header.Name+"/", tarReader, nil, 0)
+				if (err != nil) && !errors.Is(err, errNotInput) {
+					return err
+				}
+			}
+		}
+
+	case sgfgrab.ReaderFor(name) != nil:
+		data, err := io.ReadAll(buffered) // Read whole file
+		if err != nil {
+			return fmt.Errorf("%s: file read error: %w", name, err)
+		}
+		select { // Send for processing
+		case r.out <- recordFile{member: name, data: data}:
+			return nil
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		}
+	}
+	return fmt.Errorf("%s: %w", name, errNotInput)
+}
+
+// isInput checks if a file name is a game record or archive by its extension
+func isInput(name string) bool {
+	if sgfgrab.ReaderFor(name) != nil {
+		return true
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range archiveExtensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// uncompressedName is the name of a file after decompression, like "a.tar" for "a.tgz"
+func uncompressedName(name string) string {
+	ext := filepath.Ext(name)
+	switch strings.ToLower(ext) {
+	case ".tgz", ".tbz", ".tbz2":
+		return strings.TrimSuffix(name, ext) + ".tar"
+	case ".gz", ".bz2":
+		return strings.TrimSuffix(name, ext)
+	}
+	return name
+}
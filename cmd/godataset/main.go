@@ -1,11 +1,17 @@
-// godataset builds a .jsonl.gz dataset of games from a .tar.gz archive of SGF files
+// godataset builds a .jsonl.gz (or .jsonl) dataset of games from SGF files (or Tygem .gib,
+// WBaduk .ngf, and PandaNet .ugf/.ugi records), given directly, in directories, or in .zip,
+// .tar, .tar.gz, and .tar.bz2 archives, which may be nested
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 
 	"github.com/dodgebc/go-game-utils/sgfgrab"
 	"github.com/dodgebc/handy-go/progress"
@@ -15,6 +21,28 @@ type packet struct {
 	game    sgfgrab.GameData
 	err     error
 	tgzName string
+	member  string // SGF path within the archive
+	hash    uint64 // contentHash of the game as parsed
+
+	// for -ordered
+	seq      int // record file number across all archives
+	index    int // game number within the record file
+	count    int // games in the record file, or 0 if none
+	position int // game number in the output
+}
+
+// failure records the first error which stops the run, and cancels the pipeline
+type failure struct {
+	once   sync.Once
+	err    error
+	cancel context.CancelFunc
+}
+
+func (f *failure) fail(err error) {
+	f.once.Do(func() {
+		f.err = err
+		f.cancel()
+	})
 }
 
 func main() {
@@ -26,15 +54,87 @@ func main() {
 	if err := args.check(); err != nil {
 		log.Fatal(err)
 	}
+	for _, identifier := range args.extras {
+		sgfgrab.RegisterProperty(identifier, sgfgrab.DuplicateKeepFirst, sgfgrab.ExtraProperty(nil))
+	}
+
+	// Stop everything on the first error or an interrupt
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stopSignals()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := &failure{cancel: cancel}
+
+	// Continue an incremental dataset from its last commit
+	var m *manifest
+	var issued *hashSet   // GameIDs written
+	var existing *hashSet // GameIDs committed before this run
+	seen := newHashSet(args.dedupMemory)
+	if args.incremental {
+		m = args.manifest
+		if m == nil {
+			m = &manifest{Version: manifestVersion, Options: buildOptions(args.stages), Files: make(map[string]manifestFile)}
+		}
+		if err := m.restore(); err != nil {
+			log.Fatal(err)
+		}
+		load := func(path string) *hashSet {
+			if path == "" {
+				return newHashSet(args.dedupMemory)
+			}
+			s, err := loadHashSet(path, args.dedupMemory)
+			if err != nil {
+				log.Fatal(err)
+			}
+			return s
+		}
+		seen = load(m.Duplicates)
+		if args.gameid {
+			issued, existing = load(m.GameIDs), load(m.GameIDs)
+		}
+	}
+
+	// Restore input order before output
+	out := make(chan packet, 4096*args.workers)
+	var order *reorderBuffer
+	released := make(chan packet) // in input order
+	if args.ordered {
+		order = newReorderBuffer(ctx, released)
+	}
+
+	// Report the run
+	report := newRunReport(args.effectiveConfig())
+	var rejects *rejectWriter
+	if args.rejectsFile != "" {
+		var err error
+		if rejects, err = newRejectWriter(args.rejectsFile); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	// Collect for monitoring
-	monChan := make(chan string)
+	monChan := make(chan tally)
+	count := func(kind string, p packet) bool {
+		select {
+		case monChan <- tally{kind, p.member, p.index, p.err}:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	var senders sync.WaitGroup // goroutines passing packets on to out or order
 	collect := func(ps <-chan packet, kind string) {
+		defer senders.Done()
 		for p := range ps {
 			if p.err != nil && args.verbose {
-				log.Println(p.err)
+				log.Printf("%s: %s: %s", p.tgzName, p.member, p.err)
+			}
+			if order != nil {
+				order.done(p, false)
+			}
+			if !count(kind, p) {
+				return
 			}
-			monChan <- kind
 		}
 	}
 
@@ -42,64 +142,171 @@ func main() {
 	in := make(chan packet, 4096*args.workers)
 	good := (<-chan packet)(in)
 	bad := make(<-chan packet)
-	if args.gameid {
-		good = applyGameID(good, args.workers)
-	}
-	if args.metaOnly {
-		good = applyMetaOnly(good, args.workers)
+	kinds := []string{"malformed"} // counted
+	reject := func(bad <-chan packet, kind string) {
+		senders.Add(1)
+		go collect(bad, kind)
+		kinds = append(kinds, kind)
 	}
-	if args.sourceFile != "" {
-		good = applySourceName(good, args.sourceFile, args.workers)
-	}
-	if args.minLength != 0 {
-		good, bad = filterMinLength(good, args.minLength, args.workers)
-		go collect(bad, "short")
-	}
-	if args.deduplicate {
-		good, bad = filterDuplicate(good, args.workers)
-		go collect(bad, "duplicate")
+	for _, stage := range args.stages {
+		switch stage {
+		case "sources":
+			good = applySourceName(ctx, good, args.sourceNames, args.workers)
+		case "gameid":
+			good = applyGameID(ctx, good, args.workers)
+			if existing != nil {
+				good, bad = filterExisting(ctx, good, existing, stop, args.workers)
+				reject(bad, "existing")
+			}
+		case "metaonly":
+			good = applyMetaOnly(ctx, good, args.workers)
+		case "normranks":
+			good = applyNormalizeRanks(ctx, good, args.workers)
+		case "rank":
+			good, bad = filterRank(ctx, good, args.minRank, args.maxRank, args.workers)
+			reject(bad, "rank")
+		case "filter":
+			good, bad = filterExpression(ctx, good, args.filterExpr, args.workers)
+			reject(bad, "filter")
+		case "minlength":
+			good, bad = filterMinLength(ctx, good, args.minLength, args.workers)
+			reject(bad, "short")
+		case "deduplicate":
+			if order != nil {
+				kinds = append(kinds, "duplicate") // Once in input order, so the first copy is kept
+				continue
+			}
+			good, bad = filterDuplicate(ctx, good, seen, stop, args.workers)
+			reject(bad, "duplicate")
+		case "fixedhandicap":
+			good, bad = filterHandicap(ctx, good, args.workers)
+			reject(bad, "handicap")
+		case "checklegal":
+			good, bad = filterIllegal(ctx, good, args.ruleset, args.gameRules, args.workers)
+			reject(bad, "illegal")
+		}
 	}
-	if args.checkLegal {
-		good, bad = filterIllegal(good, args.ruleset, args.workers)
-		go collect(bad, "illegal")
+	kinds = append(kinds, "accepted")
+	var accepted int64 // for commits
+	accept := func(p packet) bool {
+		atomic.AddInt64(&accepted, 1)
+		if issued != nil {
+			if _, err := issued.add(p.game.GameID); err != nil {
+				stop.fail(err)
+				return false
+			}
+		}
+		select {
+		case out <- p:
+		case <-ctx.Done():
+			return false
+		}
+		return count("accepted", p)
 	}
-	out := make(chan packet, 4096*args.workers)
+	senders.Add(1)
 	go func() {
+		defer senders.Done()
 		for p := range good {
-			out <- p
-			monChan <- "accepted"
+			if order != nil {
+				order.done(p, true)
+			} else if !accept(p) {
+				return
+			}
+		}
+	}()
+	go func() {
+		senders.Wait()
+		if order != nil {
+			order.close()
+		} else {
+			close(out)
 		}
-		close(out)
 	}()
-	finishedAll := writeGzipLines(marshalGame(out, args.workers), args.outFile)
-	defer func() { <-finishedAll }()
-	defer close(in)
+
+	// Accept games in input order with -ordered, deduplicating them in that order
+	if order != nil {
+		go func() {
+			defer close(out)
+			position := 0
+			for p := range released {
+				if args.deduplicate {
+					if p.err = checkDuplicate(p, seen, stop); p.err != nil {
+						if args.verbose {
+							log.Printf("%s: %s: %s", p.tgzName, p.member, p.err)
+						}
+						if !count("duplicate", p) {
+							return
+						}
+						continue
+					}
+				}
+				p.position = position
+				position++
+				if !accept(p) {
+					return
+				}
+			}
+		}()
+	}
+	lines := marshalGame(ctx, out, args.files, stop, args.workers)
+	if args.ordered {
+		lines = reorderLines(ctx, lines)
+	}
+	var commits chan commit
+	if args.incremental {
+		commits = make(chan commit)
+	}
+	finishedAll := writeGzipLines(ctx, lines, args.files, args.replaced, commits, stop)
 
 	// Loop over all archives
-	for _, tgzFile := range args.tgzFiles {
-		tgzName := filepath.Base(tgzFile)
+	seq := 0
+	for _, input := range args.inputs {
+		if ctx.Err() != nil {
+			break
+		}
+		tgzName := filepath.Base(filepath.Clean(input))
+
+		// Skip inputs already in an incremental dataset
+		var checksum string
+		if m != nil {
+			var err error
+			if checksum, err = inputChecksum(input); err != nil {
+				if args.onError == "abort" {
+					stop.fail(fmt.Errorf("%s: %w", tgzName, err))
+				} else {
+					log.Printf("%s: skipping input: %s", tgzName, err)
+					report.startArchive(tgzName, input, nil).Skipped = err.Error()
+				}
+				continue
+			}
+			if m.has(checksum) {
+				log.Printf("%s: already in dataset, skipping", tgzName)
+				report.startArchive(tgzName, input, nil).Skipped = "already in dataset"
+				continue
+			}
+		}
+		acceptedBefore := atomic.LoadInt64(&accepted)
 
 		// Monitor progress and un-count
 		var total sync.WaitGroup
 		finish := make(chan struct{})
 		finished := make(chan struct{})
 		mon := progress.NewMonitor(fmt.Sprintf("%s", tgzName))
-		mon.StartCounter("malformed")
-		if args.minLength != 0 {
-			mon.StartCounter("short")
-		}
-		if args.deduplicate {
-			mon.StartCounter("duplicate")
+		for _, kind := range kinds {
+			mon.StartCounter(kind)
 		}
-		if args.checkLegal {
-			mon.StartCounter("illegal")
-		}
-		mon.StartCounter("accepted")
+		archive := report.startArchive(tgzName, input, kinds)
 		go func() {
 			for {
 				select {
-				case kind := <-monChan:
-					mon.IncrementCounter(kind, 1)
+				case t := <-monChan:
+					mon.IncrementCounter(t.kind, 1)
+					report.count(archive, t)
+					if (rejects != nil) && (t.err != nil) {
+						if err := rejects.write(tgzName, t); err != nil {
+							stop.fail(err)
+						}
+					}
 					total.Add(-1)
 				case <-finish:
 					mon.Close()
@@ -110,27 +317,193 @@ func main() {
 		}()
 
 		// Load from archive
-		sgfBytes := make(chan []byte)
+		records, readErr := readRecords(ctx, input)
+		recordFiles := make(chan recordFile)
 		go func() {
-			for b := range readTgzSgf(tgzFile) {
+			defer close(recordFiles)
+			for f := range records {
 				mon.Increment(1)
-				sgfBytes <- b
+				archive.Records++
+				f.seq = seq
+				seq++
+				select {
+				case recordFiles <- f:
+				case <-ctx.Done():
+					return
+				}
 			}
-			close(sgfBytes)
 		}()
 
 		// Send into pipeline and count
-		packets := parseGame(sgfBytes, tgzName, args.workers)
+		packets := parseGame(ctx, recordFiles, tgzName, sgfgrab.Options{KeepText: args.keepText, Repair: args.repair}, args.workers)
 		for p := range packets {
+			if (p.err == nil) && (p.count == 0) { // No games in record
+				if order != nil {
+					order.done(p, false)
+				}
+				continue
+			}
 			total.Add(1)
 			if p.err == nil {
-				in <- p
+				if args.verbose {
+					for _, repair := range p.game.Repairs {
+						log.Printf("%s: %s: %s", p.tgzName, p.member, repair)
+					}
+				}
+				select {
+				case in <- p:
+				case <-ctx.Done():
+				}
 			} else {
-				monChan <- "malformed"
+				if args.verbose {
+					log.Printf("%s: %s: %s", p.tgzName, p.member, p.err)
+				}
+				if order != nil {
+					order.done(p, false)
+				}
+				count("malformed", p)
 			}
 		}
-		total.Wait()
+
+		// Apply the error policy to a bad archive
+		skipped := ""
+		if err := <-readErr; err != nil {
+			if args.onError == "abort" {
+				stop.fail(fmt.Errorf("%s: %w", tgzName, err))
+			} else {
+				log.Printf("%s: skipping rest of input: %s", tgzName, err)
+				skipped = err.Error()
+			}
+			archive.ReadError = err.Error()
+		}
+
+		// Wait for the pipeline to finish with the archive
+		counted := make(chan struct{})
+		go func() {
+			total.Wait()
+			close(counted)
+		}()
+		select {
+		case <-counted:
+		case <-ctx.Done():
+		}
 		close(finish)
 		<-finished
+		archive.finish()
+
+		// Commit the input to an incremental dataset
+		if (m != nil) && (ctx.Err() == nil) {
+			// Record new output and hashes files before they are created, so a crash can
+			// remove them
+			prepare := func(names []string) error {
+				m.Pending = nil
+				for _, name := range names {
+					if _, ok := m.Files[name]; !ok {
+						m.Pending = append(m.Pending, name)
+					}
+				}
+				if args.deduplicate {
+					m.Pending = append(m.Pending, args.files.hashes("duplicates", len(m.Inputs)+1))
+				}
+				if issued != nil {
+					m.Pending = append(m.Pending, args.files.hashes("gameids", len(m.Inputs)+1))
+				}
+				if len(m.Pending) == 0 {
+					return nil
+				}
+				return m.save(args.files.manifest())
+			}
+			files := make(chan map[string]manifestFile, 1)
+			select {
+			case commits <- commit{int(atomic.LoadInt64(&accepted)), prepare, files}:
+			case <-ctx.Done():
+			}
+			select {
+			case committed := <-files:
+				if committed == nil {
+					break // Failed
+				}
+				for name, f := range committed {
+					m.Files[name] = f
+				}
+				m.Pending = nil
+				games := int(atomic.LoadInt64(&accepted) - acceptedBefore)
+				m.Inputs = append(m.Inputs, manifestInput{tgzName, checksum, games, skipped})
+
+				// Replace the hashes files, removing the old ones once the manifest no
+				// longer needs them (they stay pending in case of a crash)
+				var replaced []string
+				saveHashes := func(set *hashSet, kind string, path *string) error {
+					name := args.files.hashes(kind, len(m.Inputs))
+					if err := set.save(name); err != nil {
+						return err
+					}
+					if *path != "" {
+						replaced = append(replaced, *path)
+					}
+					*path = name
+					return nil
+				}
+				var err error
+				if args.deduplicate {
+					err = saveHashes(seen, "duplicates", &m.Duplicates)
+				}
+				if (err == nil) && (issued != nil) {
+					err = saveHashes(issued, "gameids", &m.GameIDs)
+				}
+				if err == nil {
+					m.Pending = replaced
+					err = m.save(args.files.manifest())
+				}
+				if err != nil {
+					stop.fail(err)
+					break
+				}
+				for _, name := range replaced {
+					os.Remove(name)
+				}
+			case <-ctx.Done():
+			}
+		}
+	}
+
+	// Finish output files, or remove them after an error
+	if rejects != nil {
+		if err := rejects.close(); err != nil {
+			stop.fail(err)
+		}
+	}
+	close(in)
+	<-finishedAll
+	seen.close()
+	if issued != nil {
+		issued.close()
+		existing.close()
+	}
+
+	// Report the outcome
+	status := "ok"
+	switch {
+	case stop.err != nil:
+		status = "failed"
+	case ctx.Err() != nil:
+		status = "interrupted"
+	}
+	report.finish(status, stop.err)
+	if args.reportFile != "" {
+		if err := report.save(args.reportFile); err != nil {
+			log.Print(err)
+			if status == "ok" {
+				os.Exit(1)
+			}
+		}
+	}
+	switch {
+	case stop.err != nil:
+		log.Fatal(stop.err)
+	case (ctx.Err() != nil) && (m != nil):
+		log.Fatal("interrupted, rerun to resume after the last input committed")
+	case ctx.Err() != nil:
+		log.Fatal("interrupted, no output written")
 	}
 }
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// manifestVersion changes when older manifests can no longer be resumed
+const manifestVersion = 3
+
+// manifestTail is how many bytes at the end of a committed output file are checksummed,
+// to notice a file which was replaced rather than appended to
+const manifestTail = 64 << 10
+
+// manifest is the sidecar file of an -incremental dataset. It is rewritten after each
+// input is committed to the output files, so a later run can append new inputs and
+// resume after a crash. The hashes for -deduplicate and -gameid are kept in files of
+// their own, written by hashSet.save, with new names for each commit.
+type manifest struct {
+	Version    int                     `json:"version"`
+	Options    map[string]string       `json:"options"` // flags the dataset was built with
+	Inputs     []manifestInput         `json:"inputs"`
+	Files      map[string]manifestFile `json:"files"`                // by output file name
+	Pending    []string                `json:"pending,omitempty"`    // files being created or replaced by a commit
+	Duplicates string                  `json:"duplicates,omitempty"` // hashes file for -deduplicate
+	GameIDs    string                  `json:"gameIDs,omitempty"`    // hashes file for -gameid
+}
+
+// manifestInput is an input committed to the dataset
+type manifestInput struct {
+	Name     string `json:"name"`
+	Checksum string `json:"checksum"` // from inputChecksum
+	Games    int    `json:"games"`
+	Error    string `json:"error,omitempty"` // if the rest of the input was skipped
+}
+
+// manifestFile is the committed part of an output file
+type manifestFile struct {
+	Size int64  `json:"size"`
+	Tail string `json:"tail"` // SHA-256 of the last manifestTail bytes committed
+}
+
+// buildOptions are the flags and order of stages which change the games in a dataset,
+// to be kept the same when it is built incrementally
+func buildOptions(stages []string) map[string]string {
+	options := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		switch f.Name {
+		case "config", "force", "out", "report", "rejects", "incremental", "dedupmemory", "parfactor", "onerror", "verbose":
+		default:
+			options[f.Name] = f.Value.String()
+		}
+	})
+	options["pipeline"] = strings.Join(stages, ",")
+	return options
+}
+
+// loadManifest reads a manifest, or returns nil if there is none
+func loadManifest(path string) (*manifest, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	var m manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %s: %w", path, err)
+	}
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("manifest %s has version %d, not %d", path, m.Version, manifestVersion)
+	}
+	return &m, nil
+}
+
+// checkOptions makes sure the dataset is built with the same options as before
+func (m *manifest) checkOptions(options map[string]string) error {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if was, ok := m.Options[name]; ok && (was != options[name]) {
+			return fmt.Errorf("dataset was built with -%s=%q, not %q", name, was, options[name])
+		}
+	}
+	return nil
+}
+
+// has checks if an input with the checksum was already committed
+func (m *manifest) has(checksum string) bool {
+	for _, input := range m.Inputs {
+		if input.Checksum == checksum {
+			return true
+		}
+	}
+	return false
+}
+
+// save writes the manifest atomically, so a crash leaves the last committed version
+func (m *manifest) save(path string) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(path, func(w io.Writer) error {
+			_, err := w.Write(b)
+			return err
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes a file under a temporary name and renames it into place
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// restore cuts output files back to their committed sizes, dropping anything written by
+// a run which did not finish, and removes the files a commit was creating or replacing.
+// Other files are left alone, even if they look like output files. Output files which no
+// longer hold what was committed (like those of a rebuild without -incremental) are
+// refused rather than cut.
+func (m *manifest) restore() error {
+	for _, name := range m.Pending {
+		if _, ok := m.Files[name]; ok || (name == m.Duplicates) || (name == m.GameIDs) {
+			continue
+		}
+		if err := os.Remove(name); (err != nil) && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove uncommitted output: %w", err)
+		}
+	}
+	m.Pending = nil
+	for name, committed := range m.Files {
+		info, err := os.Stat(name)
+		if err != nil {
+			return fmt.Errorf("committed output missing: %w", err)
+		}
+		if info.Size() < committed.Size {
+			return fmt.Errorf("committed output %s is shorter than the manifest records", name)
+		}
+		tail, err := tailChecksum(name, committed.Size)
+		if err != nil {
+			return fmt.Errorf("failed to read committed output: %w", err)
+		}
+		if tail != committed.Tail {
+			return fmt.Errorf("committed output %s was changed since the manifest was written (rebuild without -incremental)", name)
+		}
+		if info.Size() > committed.Size {
+			if err := os.Truncate(name, committed.Size); err != nil {
+				return fmt.Errorf("failed to remove uncommitted output: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// inputChecksum identifies the contents of an input: a SHA-256 of a file, or for a
+// directory of the names and contents of the files readRecords would read
+func inputChecksum(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open input: %w", err)
+	}
+	if !info.IsDir() {
+		sum, err := fileChecksum(path)
+		return hex.EncodeToString(sum), err
+	}
+	h := sha256.New()
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to read directory: %w", err)
+		}
+		if !d.Type().IsRegular() || !isInput(p) {
+			return nil
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		sum, err := fileChecksum(p)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00%x\n", filepath.ToSlash(rel), sum)
+		return nil
+	})
+	return hex.EncodeToString(h.Sum(nil)), err
+}
+
+func fileChecksum(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open input: %w", err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, fmt.Errorf("failed to read input: %w", err)
+	}
+	return h.Sum(nil), nil
+}
+
+// tailChecksum is the checksum of the last manifestTail bytes of the first size bytes of
+// a file
+func tailChecksum(path string, size int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	start := size - manifestTail
+	if start < 0 {
+		start = 0
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, start, size-start)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// appendFile appends a finished temporary output file to its output file and removes
+// it, returning the committed part of the output file
+func appendFile(name, temp string) (manifestFile, error) {
+	src, err := os.Open(temp)
+	if err != nil {
+		return manifestFile{}, err
+	}
+	defer os.Remove(temp)
+	defer src.Close()
+	dst, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return manifestFile{}, err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return manifestFile{}, err
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return manifestFile{}, err
+	}
+	tail, err := tailChecksum(name, info.Size())
+	return manifestFile{info.Size(), tail}, err
+}
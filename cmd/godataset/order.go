@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// reorderQueue is how many released games wait to be sent before done blocks
+const reorderQueue = 4096
+
+// reorderBuffer releases accepted games in input order (archive, member, game in file)
+// once every game before them has been accepted or rejected. Each record file has a
+// sequence number, and every packet from it must be passed to done exactly once. Released
+// games are sent on by a goroutine of the buffer, so done never sends while holding the
+// lock, and out is closed after close is called once no more packets will be done.
+type reorderBuffer struct {
+	mux      sync.Mutex
+	cond     *sync.Cond // signals released games, room for more, closing, or cancelling
+	next     int        // sequence number of the next record file to release
+	position int        // position of the next game released
+	files    map[int]*reorderFile
+	released []packet // in order, not yet sent
+	closed   bool
+	out      chan<- packet
+	ctx      context.Context // stops sending
+}
+
+// reorderFile holds the games from one record file until it is released
+type reorderFile struct {
+	games    []*packet // accepted games by index
+	left     int       // games not yet accepted or rejected
+	finished bool
+}
+
+func newReorderBuffer(ctx context.Context, out chan<- packet) *reorderBuffer {
+	r := &reorderBuffer{files: make(map[int]*reorderFile), out: out, ctx: ctx}
+	r.cond = sync.NewCond(&r.mux)
+	go func() {
+		<-ctx.Done()
+		r.mux.Lock()
+		r.cond.Broadcast()
+		r.mux.Unlock()
+	}()
+	go r.send()
+	return r
+}
+
+// done records that a packet was accepted or rejected. A packet with count 0 (from a
+// malformed or empty record file) finishes its record file.
+func (r *reorderBuffer) done(p packet, accepted bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	f, ok := r.files[p.seq]
+	if !ok {
+		f = &reorderFile{games: make([]*packet, p.count), left: p.count}
+		r.files[p.seq] = f
+	}
+	if p.count > 0 {
+		if accepted {
+			f.games[p.index] = &p
+		}
+		f.left--
+	}
+	f.finished = f.left == 0
+
+	// Release every finished record file in order
+	for f, ok := r.files[r.next]; ok && f.finished; f, ok = r.files[r.next] {
+		for _, g := range f.games {
+			if g != nil {
+				g.position = r.position
+				r.position++
+				r.released = append(r.released, *g)
+			}
+		}
+		delete(r.files, r.next)
+		r.next++
+	}
+	r.cond.Broadcast()
+
+	// Wait for the sender to catch up
+	for (len(r.released) > reorderQueue) && (r.ctx.Err() == nil) {
+		r.cond.Wait()
+	}
+}
+
+// close ends the output once the games already released are sent
+func (r *reorderBuffer) close() {
+	r.mux.Lock()
+	r.closed = true
+	r.cond.Broadcast()
+	r.mux.Unlock()
+}
+
+// send sends released games until the buffer is closed and empty, or cancelled
+func (r *reorderBuffer) send() {
+	defer close(r.out)
+	for {
+		r.mux.Lock()
+		for (len(r.released) == 0) && !r.closed && (r.ctx.Err() == nil) {
+			r.cond.Wait()
+		}
+		games := r.released
+		r.released = nil
+		r.cond.Broadcast()
+		r.mux.Unlock()
+
+		if len(games) == 0 {
+			return
+		}
+		for _, g := range games {
+			select {
+			case r.out <- g:
+			case <-r.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// reorderLines restores the order of lines by position after parallel marshalling
+func reorderLines(ctx context.Context, in <-chan outputLine) <-chan outputLine {
+	out := make(chan outputLine)
+
+	go func() {
+		defer close(out)
+		pending := make(map[int]outputLine)
+		next := 0
+		for line := range in {
+			pending[line.position] = line
+			for l, ok := pending[next]; ok; l, ok = pending[next] {
+				select {
+				case out <- l:
+				case <-ctx.Done():
+					return
+				}
+				delete(pending, next)
+				next++
+			}
+		}
+	}()
+	return out
+}
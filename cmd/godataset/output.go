@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dodgebc/go-game-utils/sgfgrab"
+)
+
+// split is a named part of the dataset, like "train", holding a fraction of the games
+type split struct {
+	name     string
+	fraction float64
+}
+
+// parseSplits parses splits like "train=0.9,val=0.05,test=0.05" (fractions must add to 1)
+func parseSplits(s string) ([]split, error) {
+	var splits []split
+	total := 0.0
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(s, ",") {
+		cols := strings.Split(part, "=")
+		if len(cols) != 2 {
+			return nil, fmt.Errorf("split %q should look like name=fraction", part)
+		}
+		name := strings.TrimSpace(cols[0])
+		if (name == "") || (strings.Trim(name, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_") != "") {
+			return nil, fmt.Errorf("split name %q should be letters, digits, or underscores", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("split %q given twice", name)
+		}
+		seen[name] = true
+		fraction, err := strconv.ParseFloat(strings.TrimSpace(cols[1]), 64)
+		if (err != nil) || !(fraction > 0) {
+			return nil, fmt.Errorf("split %q fraction should be positive", name)
+		}
+		total += fraction
+		splits = append(splits, split{name, fraction})
+	}
+	if math.Abs(total-1) > 1e-6 {
+		return nil, fmt.Errorf("split fractions add to %g instead of 1", total)
+	}
+	return splits, nil
+}
+
+// contentHash is a stable 64-bit hash of the board size, setup, and moves of a game,
+// which does not depend on metadata or on where the game was found
+func contentHash(g *sgfgrab.GameData) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%dx%d", g.Size[0], g.Size[1])
+	for _, list := range [][]string{g.Setup, g.Moves} {
+		h.Write([]byte{';'})
+		for _, m := range list {
+			h.Write([]byte(m))
+			h.Write([]byte{','})
+		}
+	}
+	return h.Sum64()
+}
+
+// outputFiles names the output file for each game. Splits and shards come from the
+// content hash, so a game lands in the same file across reruns and archive orders.
+type outputFiles struct {
+	path     string  // output path as given
+	base     string  // output path without .jsonl.gz or .jsonl
+	format   string  // "jsonl.gz" or "jsonl"
+	shards   int     // >= 1
+	splits   []split // none for a single dataset
+	stratify string  // "Source" or "Year" to write each stratum to files of its own, or ""
+}
+
+// newOutputFiles creates outputFiles for an output path like "games.jsonl.gz" in a format
+func newOutputFiles(outFile, format string, shards int, splits []split, stratify string) (outputFiles, error) {
+	base := strings.TrimSuffix(strings.TrimSuffix(outFile, ".gz"), ".jsonl")
+	switch {
+	case (format != "jsonl.gz") && (format != "jsonl"):
+		return outputFiles{}, fmt.Errorf("format %q not supported", format)
+	case (base != outFile) && (outFile != base+"."+format):
+		return outputFiles{}, fmt.Errorf("output file %s is not in format %s", outFile, format)
+	case shards < 1:
+		return outputFiles{}, errors.New("shards must be at least 1")
+	case (stratify != "") && (stratify != "Source") && (stratify != "Year"):
+		return outputFiles{}, fmt.Errorf("stratify %q not supported", stratify)
+	}
+	return outputFiles{outFile, base, format, shards, splits, stratify}, nil
+}
+
+// single is true if everything goes to the output path as given
+func (o outputFiles) single() bool {
+	return (o.shards == 1) && (len(o.splits) == 0) && (o.stratify == "")
+}
+
+// existing finds the files of an earlier run which this one replaces: an -incremental
+// manifest (first, so it goes before the files it lists) and the output and hashes files
+// it records, and any named like the files of this run's splits or strata, or of no
+// splits, with or without shards (of any count), in either format. Other files are left alone, even if
+// their names start the same way.
+func (o outputFiles) existing() []string {
+	found := make(map[string]bool)
+	m, err := loadManifest(o.manifest())
+	if (err == nil) && (m != nil) {
+		for name := range m.Files {
+			found[filepath.Clean(name)] = true
+		}
+		for _, name := range append(m.Pending, m.Duplicates, m.GameIDs) {
+			if name != "" {
+				found[filepath.Clean(name)] = true
+			}
+		}
+	}
+
+	// Match the names in the output directory, those of strata only within this run's splits
+	base := regexp.QuoteMeta(filepath.Base(o.base))
+	split := ""
+	if len(o.splits) > 0 {
+		names := make([]string, len(o.splits))
+		for i, s := range o.splits {
+			names[i] = regexp.QuoteMeta(s.name)
+		}
+		split = `\.(` + strings.Join(names, "|") + `)`
+	}
+	patterns := []string{base + `(` + split + `)?`}
+	switch o.stratify {
+	case "Source":
+		patterns = append(patterns, base+split+`\.[a-z0-9_-]+`)
+	case "Year":
+		patterns = append(patterns, base+split+`\.([0-9]+|unknown)`)
+	}
+	re := regexp.MustCompile(`^(` + strings.Join(patterns, "|") + `)(-([0-9]{5})-of-([0-9]{5}))?\.jsonl(\.gz)?$`)
+	hashes := regexp.MustCompile(`^` + base + `\.(duplicates|gameids)-[0-9]{5}\.bin$`)
+	dir := filepath.Dir(o.base)
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		if hashes.MatchString(e.Name()) {
+			found[filepath.Join(dir, e.Name())] = true
+		}
+		match := re.FindStringSubmatch(e.Name())
+		if match == nil {
+			continue
+		}
+		if shard := match[len(match)-3]; shard != "" {
+			n, _ := strconv.Atoi(shard)
+			count, _ := strconv.Atoi(match[len(match)-2])
+			if n >= count {
+				continue
+			}
+		}
+		found[filepath.Join(dir, e.Name())] = true
+	}
+	if _, err := os.Stat(o.path); err == nil {
+		found[filepath.Clean(o.path)] = true
+	}
+	var names []string
+	if _, err := os.Stat(o.manifest()); err == nil {
+		names = append(names, filepath.Clean(o.manifest()))
+	}
+	var rest []string
+	for name := range found {
+		if _, err := os.Stat(name); err == nil {
+			rest = append(rest, name)
+		}
+	}
+	sort.Strings(rest)
+	return append(names, rest...)
+}
+
+// manifest is the path of the sidecar manifest for -incremental
+func (o outputFiles) manifest() string {
+	return o.base + ".manifest.json"
+}
+
+// hashes is the path of the hashes file of a kind ("duplicates" or "gameids") written by
+// a commit of an -incremental dataset, like "games.duplicates-00012.bin"
+func (o outputFiles) hashes(kind string, commit int) string {
+	return fmt.Sprintf("%s.%s-%05d.bin", o.base, kind, commit)
+}
+
+// name gives the file for a game, like "games.train.kgs-00003-of-00008.jsonl.gz"
+func (o outputFiles) name(p packet) string {
+	if o.single() {
+		return o.path
+	}
+	name := o.base
+	if len(o.splits) > 0 {
+		u := float64(p.hash>>11) / (1 << 53) // Uniform in [0, 1), independent of the shard
+		i := 0
+		for cumulative := o.splits[0].fraction; (u >= cumulative) && (i < len(o.splits)-1); cumulative += o.splits[i].fraction {
+			i++
+		}
+		name += "." + o.splits[i].name
+	}
+	switch o.stratify {
+	case "Source":
+		name += "." + stratumName(p.game.Source)
+	case "Year":
+		name += "." + stratumName(strconv.Itoa(p.game.Year))
+	}
+	if o.shards > 1 {
+		name += fmt.Sprintf("-%05d-of-%05d", p.hash%uint64(o.shards), o.shards)
+	}
+	return name + "." + o.format
+}
+
+// stratumName makes a stratum safe for a file name, with "unknown" for no value
+func stratumName(s string) string {
+	if (s == "") || (s == "0") {
+		return "unknown"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case (r >= 'a') && (r <= 'z'), (r >= '0') && (r <= '9'), r == '-':
+			return r
+		case (r >= 'A') && (r <= 'Z'):
+			return r - 'A' + 'a'
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// tally is a game counted by kind ("accepted" or the reason for rejecting it), sent to
+// the monitor of its archive
+type tally struct {
+	kind   string
+	member string
+	index  int   // game number within the record file
+	err    error // nil if accepted
+}
+
+// runReport is the JSON report of a run, written with -report
+type runReport struct {
+	Started  time.Time              `json:"started"`
+	Finished time.Time              `json:"finished"`
+	Seconds  float64                `json:"seconds"`
+	Status   string                 `json:"status"` // "ok", "failed", or "interrupted"
+	Error    string                 `json:"error,omitempty"`
+	Config   map[string]interface{} `json:"config"` // effective config, which can be given to -config
+	Archives []*archiveReport       `json:"archives"`
+	Totals   map[string]int         `json:"totals"` // games of each kind over all archives
+}
+
+// archiveReport is the part of a runReport for one input
+type archiveReport struct {
+	Name      string                    `json:"name"`
+	Path      string                    `json:"path"`
+	Skipped   string                    `json:"skipped,omitempty"` // why the whole input was skipped
+	Seconds   float64                   `json:"seconds"`
+	Records   int                       `json:"records"`             // record files read
+	Counts    map[string]int            `json:"counts"`              // games of each kind
+	Errors    map[string]map[string]int `json:"errors,omitempty"`    // rejections of each kind by errorGroup
+	ReadError string                    `json:"readError,omitempty"` // why the rest of the input was not read
+	started   time.Time
+}
+
+func newRunReport(config map[string]interface{}) *runReport {
+	return &runReport{Started: time.Now(), Config: config, Totals: make(map[string]int)}
+}
+
+// startArchive adds an input to the report, counting each of kinds from zero
+func (r *runReport) startArchive(name, path string, kinds []string) *archiveReport {
+	a := &archiveReport{Name: name, Path: path, Counts: make(map[string]int), started: time.Now()}
+	for _, kind := range kinds {
+		a.Counts[kind] = 0
+		r.Totals[kind] += 0
+	}
+	r.Archives = append(r.Archives, a)
+	return a
+}
+
+// count adds a game to the archive and run totals, only from the monitor of the archive
+func (r *runReport) count(a *archiveReport, t tally) {
+	a.Counts[t.kind]++
+	r.Totals[t.kind]++
+	if t.err == nil {
+		return
+	}
+	if a.Errors == nil {
+		a.Errors = make(map[string]map[string]int)
+	}
+	if a.Errors[t.kind] == nil {
+		a.Errors[t.kind] = make(map[string]int)
+	}
+	a.Errors[t.kind][errorGroup(t.err)]++
+}
+
+func (a *archiveReport) finish() {
+	a.Seconds = time.Since(a.started).Seconds()
+}
+
+// finish sets the outcome of the run
+func (r *runReport) finish(status string, err error) {
+	r.Finished = time.Now()
+	r.Seconds = r.Finished.Sub(r.Started).Seconds()
+	r.Status = status
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+func (r *runReport) save(path string) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	if err := os.WriteFile(path, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return nil
+}
+
+var errorValues = regexp.MustCompile(`"[^"]*"|[0-9]+(\.[0-9]+)?`)
+
+// errorGroup is the type of an error message, with numbers replaced by N and quoted values
+// by "…", so that "game length 12 too short" and "game length 31 too short" are grouped
+func errorGroup(err error) string {
+	return errorValues.ReplaceAllStringFunc(err.Error(), func(v string) string {
+		if strings.HasPrefix(v, `"`) {
+			return `"…"`
+		}
+		return "N"
+	})
+}
+
+// rejectWriter writes the games rejected in a run as JSON lines, compressed if the file
+// name ends in .gz
+type rejectWriter struct {
+	f   *os.File
+	gz  *gzip.Writer
+	enc *json.Encoder
+}
+
+// rejection is a line of a rejects file
+type rejection struct {
+	Archive string `json:"archive"`
+	Member  string `json:"member"`
+	Index   int    `json:"index"` // game number within the member, from 0
+	Kind    string `json:"kind"`
+	Reason  string `json:"reason"`
+}
+
+func newRejectWriter(path string) (*rejectWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create rejects file: %w", err)
+	}
+	w := &rejectWriter{f: f}
+	var out io.Writer = f
+	if strings.HasSuffix(path, ".gz") {
+		w.gz = gzip.NewWriter(f)
+		out = w.gz
+	}
+	w.enc = json.NewEncoder(out)
+	return w, nil
+}
+
+// write records a rejected game, only from the monitor of its archive
+func (w *rejectWriter) write(archive string, t tally) error {
+	if err := w.enc.Encode(rejection{archive, t.member, t.index, t.kind, t.err.Error()}); err != nil {
+		return fmt.Errorf("rejects file write error: %w", err)
+	}
+	return nil
+}
+
+func (w *rejectWriter) close() error {
+	var err error
+	if w.gz != nil {
+		err = w.gz.Close()
+	}
+	if closeErr := w.f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("rejects file write error: %w", err)
+	}
+	return nil
+}
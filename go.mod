@@ -1,6 +1,6 @@
 module github.com/dodgebc/go-game-utils
 
-go 1.14
+go 1.18
 
 require (
 	github.com/dodgebc/handy-go v0.0.0-20200813202042-2d0bdd6d0003
@@ -0,0 +1,250 @@
+package sgfgrab
+
+import (
+	"bytes"
+	"embed"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// charsetFiles holds the double-byte tables generated by charsets/gen.py
+//
+//go:embed charsets/*.bin
+var charsetFiles embed.FS
+
+// doubleByte is a table for an ASCII-compatible double-byte charset
+type doubleByte struct {
+	table    []byte // little-endian UTF-16 units indexed by (lead-0x81)*191 + (trail-0x40)
+	lastLead byte
+	kana     bool // single bytes 0xA1-0xDF are half-width katakana (Shift-JIS)
+}
+
+var charsetGBK, charsetBig5, charsetSJIS, charsetEUCKR doubleByte
+
+func init() {
+	load := func(name string) []byte {
+		b, err := charsetFiles.ReadFile("charsets/" + name)
+		if err != nil {
+			panic(err)
+		}
+		return b
+	}
+	charsetGBK = doubleByte{table: load("gbk.bin"), lastLead: 0xFE}
+	charsetBig5 = doubleByte{table: load("big5.bin"), lastLead: 0xFE}
+	charsetSJIS = doubleByte{table: load("sjis.bin"), lastLead: 0xFC, kana: true}
+	charsetEUCKR = doubleByte{table: load("euckr.bin"), lastLead: 0xFE}
+}
+
+// next decodes the character starting at b[i] and returns its size in bytes, or
+// U+FFFD and 1 for an undecodable byte
+func (d doubleByte) next(b []byte, i int) (rune, int) {
+	c := b[i]
+	switch {
+	case c < 0x80:
+		return rune(c), 1
+	case d.kana && (c >= 0xA1) && (c <= 0xDF):
+		return rune(0xFF61 + int(c) - 0xA1), 1
+	case (c >= 0x81) && (c <= d.lastLead) && (i+1 < len(b)) && (b[i+1] >= 0x40) && (b[i+1] <= 0xFE):
+		j := 2 * ((int(c)-0x81)*191 + int(b[i+1]) - 0x40)
+		if u := binary.LittleEndian.Uint16(d.table[j:]); u != 0 {
+			return rune(u), 2
+		}
+	}
+	return utf8.RuneError, 1
+}
+
+// decode converts to UTF-8 and counts undecodable bytes (written as U+FFFD)
+func (d doubleByte) decode(b []byte) (string, int) {
+	var s strings.Builder
+	s.Grow(len(b) * 3 / 2)
+	bad := 0
+	for i := 0; i < len(b); {
+		r, size := d.next(b, i)
+		if (r == utf8.RuneError) && (size == 1) {
+			bad++
+		}
+		s.WriteRune(r)
+		i += size
+	}
+	return s.String(), bad
+}
+
+// decodeLatin1 converts ISO-8859-1 to UTF-8
+func decodeLatin1(b []byte) string {
+	var s strings.Builder
+	s.Grow(len(b) * 3 / 2)
+	for _, c := range b {
+		s.WriteRune(rune(c))
+	}
+	return s.String()
+}
+
+// NormalizeCharset maps a CA[] value to "UTF-8", "GBK", "Big5", "Shift_JIS", "EUC-KR", "ISO-8859-1", or "" if unsupported.
+// GB18030 (with four-byte sequences beyond GBK) and HZ (a 7-bit escape encoding) are unsupported.
+func NormalizeCharset(v string) string {
+	v = strings.Map(func(r rune) rune {
+		if (r == '-') || (r == '_') || unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, v)
+	switch v {
+	case "utf8", "usascii", "ascii":
+		return "UTF-8"
+	case "gb2312", "gbk", "cp936", "euccn", "windows936":
+		return "GBK"
+	case "big5", "big5hkscs", "cp950", "windows950":
+		return "Big5"
+	case "shiftjis", "sjis", "cp932", "windows31j", "mskanji":
+		return "Shift_JIS"
+	case "euckr", "cp949", "uhc", "ksc56011987", "ksc5601", "windows949":
+		return "EUC-KR"
+	case "iso88591", "latin1", "l1", "windows1252", "cp1252":
+		return "ISO-8859-1"
+	}
+	return ""
+}
+
+// DecodeCharset converts text in a charset named by NormalizeCharset to UTF-8.
+// Undecodable bytes become U+FFFD and are reported as an error.
+func DecodeCharset(b []byte, charset string) (string, error) {
+	var text string
+	var bad int
+	switch charset {
+	case "UTF-8":
+		if !utf8.Valid(b) {
+			return strings.ToValidUTF8(string(b), string(utf8.RuneError)), fmt.Errorf("invalid %s text", charset)
+		}
+		return string(b), nil
+	case "ISO-8859-1":
+		return decodeLatin1(b), nil
+	case "GBK":
+		text, bad = charsetGBK.decode(b)
+	case "Big5":
+		text, bad = charsetBig5.decode(b)
+	case "Shift_JIS":
+		text, bad = charsetSJIS.decode(b)
+	case "EUC-KR":
+		text, bad = charsetEUCKR.decode(b)
+	default:
+		return "", fmt.Errorf("unsupported charset %q", charset)
+	}
+	if bad > 0 {
+		return text, fmt.Errorf("invalid %s text: %d bad bytes", charset, bad)
+	}
+	return text, nil
+}
+
+// sourceOffset maps a byte offset in text decoded from a charset back to the original bytes
+func sourceOffset(b []byte, charset string, offset int) int {
+	var d doubleByte
+	switch charset {
+	case "GBK":
+		d = charsetGBK
+	case "Big5":
+		d = charsetBig5
+	case "Shift_JIS":
+		d = charsetSJIS
+	case "EUC-KR":
+		d = charsetEUCKR
+	case "ISO-8859-1":
+	default:
+		return offset
+	}
+	decoded := 0
+	for i := 0; i < len(b); {
+		if decoded >= offset {
+			return i
+		}
+		r, size := rune(b[i]), 1
+		if d.table != nil {
+			r, size = d.next(b, i)
+		}
+		decoded += utf8.RuneLen(r)
+		i += size
+	}
+	return len(b)
+}
+
+// findCharset returns the first CA[] value, which is plain ASCII in practice
+func findCharset(b []byte) string {
+	for i := 0; ; {
+		j := bytes.Index(b[i:], []byte("CA["))
+		if j < 0 {
+			return ""
+		}
+		i += j
+		if (i == 0) || !unicode.IsUpper(rune(b[i-1])) { // Not part of a longer identifier
+			k := bytes.IndexByte(b[i+3:], ']')
+			if k < 0 {
+				return ""
+			}
+			return string(b[i+3 : i+3+k])
+		}
+		i += 3
+	}
+}
+
+// Decode converts SGF bytes to UTF-8 and returns the charset used.
+// Valid UTF-8 is kept as is (double-byte text almost never is valid UTF-8, but
+// re-saved files often keep a stale CA[]). Otherwise the CA[] charset is used,
+// falling back on detection if it is missing, unsupported, or does not fit.
+func Decode(sgf []byte) (string, string) {
+	if utf8.Valid(sgf) {
+		return string(sgf), "UTF-8"
+	}
+	if charset := NormalizeCharset(findCharset(sgf)); (charset != "") && (charset != "UTF-8") {
+		if text, err := DecodeCharset(sgf, charset); err == nil {
+			return text, charset
+		}
+	}
+	return detectCharset(sgf)
+}
+
+// detectCharset tries each double-byte charset, preferring the fewest bad bytes
+// and then the most common characters of its language
+func detectCharset(b []byte) (string, string) {
+	bestText, bestCharset, bestScore := "", "", 0
+	for _, charset := range []string{"GBK", "Big5", "Shift_JIS", "EUC-KR"} {
+		text, _ := DecodeCharset(b, charset)
+		score := 0
+		for _, r := range text {
+			switch {
+			case r == utf8.RuneError:
+				score -= 20
+			case strings.ContainsRune(commonRunes[charset], r):
+				score += 4
+			case (r >= 0xFF61) && (r <= 0xFF9F): // Half-width katakana, usually a misreading
+				score -= 2
+			case unicode.Is(unicode.Hangul, r):
+				if charset == "EUC-KR" {
+					score++
+				}
+			case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+				if charset == "Shift_JIS" {
+					score++
+				}
+			case (r >= 0xE000) && (r <= 0xF8FF): // Private use
+				score -= 5
+			}
+		}
+		if (bestCharset == "") || (score > bestScore) {
+			bestText, bestCharset, bestScore = text, charset, score
+		}
+	}
+	if bestScore < 0 { // Nothing fits, keep the bytes as single characters
+		return decodeLatin1(b), "ISO-8859-1"
+	}
+	return bestText, bestCharset
+}
+
+// commonRunes are frequent characters in game records, used to break ties between charsets
+var commonRunes = map[string]string{
+	"GBK":       "的一是不了人我在有他这中大来上国个到说们为子和你地出道也时年黑白胜负段级目半局盘中对围棋赛届杯决第名战手",
+	"Big5":      "的一是不了人我在有他這中大來上國個到說們為子和你地出道也時年黑白勝負段級目半局盤中對圍棋賽屆杯決第名戰手",
+	"Shift_JIS": "の一は不た人私にあ彼こ中大来上国個到説ら為子と你地出道も時年黒白勝負段級目半局盤中対囲碁戦届杯決第名手",
+	"EUC-KR":    "의이는가을에한하고서지기다대흑백승불계집반국단급기원전배결승제회명수",
+}
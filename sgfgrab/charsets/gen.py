@@ -0,0 +1,34 @@
+#!/usr/bin/env python3
+"""Generates the double-byte charset tables embedded by sgfgrab.
+
+Each table maps a (lead, trail) byte pair to a UTF-16 code unit, stored
+little-endian at index (lead-0x81)*191 + (trail-0x40). Zero means the pair
+is not mapped. The mappings come from Python's codec tables.
+
+Run from this directory: python3 gen.py
+"""
+
+import struct
+
+TABLES = [
+    # file, Python codec, last lead byte
+    ("gbk.bin", "gbk", 0xFE),
+    ("big5.bin", "cp950", 0xFE),
+    ("sjis.bin", "cp932", 0xFC),
+    ("euckr.bin", "cp949", 0xFE),
+]
+
+for name, codec, last_lead in TABLES:
+    units = []
+    for lead in range(0x81, last_lead + 1):
+        for trail in range(0x40, 0xFF):
+            try:
+                s = bytes([lead, trail]).decode(codec)
+            except UnicodeDecodeError:
+                s = ""
+            if len(s) == 1 and 0 < ord(s) < 0x10000:
+                units.append(ord(s))
+            else:
+                units.append(0)
+    with open(name, "wb") as f:
+        f.write(struct.pack("<%dH" % len(units), *units))
@@ -3,18 +3,34 @@ package sgfgrab
 import (
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sort"
 	"strings"
 )
 
 // ErrAlreadyExists means that a property was already recorded for the game
 var ErrAlreadyExists = errors.New("property already exists")
 
+// ErrSetupAfterMoves means that stones were added or removed after the game started
+var ErrSetupAfterMoves = errors.New("setup after game moves")
+
+// ErrOutsideBoard means that a move or setup stone is not on the board given by SZ
+type ErrOutsideBoard struct {
+	Move string // as in Moves or Setup
+	Size [2]int // (rows, cols)
+}
+
+func (e ErrOutsideBoard) Error() string {
+	return fmt.Sprintf("%s outside %dx%d board", e.Move, e.Size[0], e.Size[1])
+}
+
 // GameData stores important parsed game data
 type GameData struct {
 
 	// must manually set these fields if desired
 	Source string `json:",omitempty"`
-	GameID uint32 `json:",omitempty"`
+	GameID uint64 `json:",omitempty"` // like ContentID
 
 	// critical fields where zero means something
 	Size     [2]int  // (rows, cols) >= 1
@@ -23,64 +39,96 @@ type GameData struct {
 	Length   int     // number of actual game moves
 
 	// optional fields where zero means nothing
-	Winner      string   `json:",omitempty"` // "B", "W", or "" (no winner)
-	Score       float64  `json:",omitempty"` //
-	End         string   `json:",omitempty"` // "Scored", "Time", "Resign", "Forfeit", or ""
-	BlackRank   string   `json:",omitempty"` // [0-9]{1,2}[kdp]
-	WhiteRank   string   `json:",omitempty"` // [0-9]{1,2}[kdp]
-	BlackPlayer string   `json:",omitempty"` //
-	WhitePlayer string   `json:",omitempty"` //
-	Time        int      `json:",omitempty"` // >=0, seconds
-	Year        int      `json:",omitempty"` // [0-9]{4}
-	Setup       []string `json:",omitempty"` // matches ([BW][a-z]{2})?
-	Moves       []string `json:",omitempty"` // matches ([BW][a-z]{2})?
-
-	alreadyRecorded [11]bool
+	Winner         string     `json:",omitempty"` // "B", "W", or "" (no winner)
+	Score          float64    `json:",omitempty"` //
+	End            string     `json:",omitempty"` // "Scored", "Time", "Resign", "Forfeit", "Draw", "Void", "Unknown", or ""
+	BlackRank      string     `json:",omitempty"` // [0-9]{1,2}[kdp]
+	WhiteRank      string     `json:",omitempty"` // [0-9]{1,2}[kdp]
+	BlackRankValue *Rank      `json:",omitempty"` // BlackRank on a numeric scale, or unranked
+	WhiteRankValue *Rank      `json:",omitempty"` // WhiteRank on a numeric scale, or unranked
+	BlackPlayer    string     `json:",omitempty"` //
+	WhitePlayer    string     `json:",omitempty"` //
+	Time           int        `json:",omitempty"` // >=0, seconds
+	Year           int        `json:",omitempty"` // [0-9]{4}, same as Date.Start.Year
+	Date           *DateRange `json:",omitempty"` //
+	Ruleset        string     `json:",omitempty"` // "JPN", "CHN", "KOR", "AGA", "NZ", "ING", or "TT"
+	Setup          []string   `json:",omitempty"` // matches [BWE][a-zA-Z]{2}, E for empty (AE)
+	Player         string     `json:",omitempty"` // "B" or "W" to play first (PL), or "" if not given
+	Moves          []string   `json:",omitempty"` // matches ([BW][a-z]{2})?
+	Repairs        []string   `json:",omitempty"` // fixes made under Options.Repair, in order
+
+	// text fields only recorded with Options.KeepText
+	GameName     string    `json:",omitempty"` // GN
+	Event        string    `json:",omitempty"` // EV
+	Round        string    `json:",omitempty"` // RO
+	Place        string    `json:",omitempty"` // PC
+	Rules        string    `json:",omitempty"` // RU, as written
+	RecordSource string    `json:",omitempty"` // SO
+	DateText     string    `json:",omitempty"` // DT, as written
+	GameComment  string    `json:",omitempty"` // GC
+	Comments     []Comment `json:",omitempty"` // C, in main branch order
+
+	// properties from RegisterProperty, e.g. with ExtraProperty
+	Extra map[string]interface{} `json:",omitempty"`
+
+	recorded    uint64 // bits for each property handler
+	keepText    bool
+	nodeComment string
+}
+
+// Comment is a node comment attached to the number of moves played when it appears
+type Comment struct {
+	Move int // 0 for root and setup nodes, n for the node holding Moves[n-1]
+	Text string
 }
 
 // Finalize checks for any inconsistencies and fills in defaults
 func (g *GameData) Finalize() error {
 
 	// Size default
-	if !g.alreadyRecorded[0] {
+	if !g.isRecorded("SZ") {
 		g.Size = [2]int{19, 19}
 	}
 
+	// Replace "tt" with pass where applicable (and drop it from setup)
+	if ttIsPass(g.Size) {
+		setup := g.Setup[:0]
+		for _, m := range g.Setup {
+			if m[1:] != "tt" {
+				setup = append(setup, m)
+			}
+		}
+		g.Setup = setup
+		for i := range g.Moves {
+			if g.Moves[i][1:] == "tt" {
+				g.Moves[i] = g.Moves[i][:1]
+			}
+		}
+	}
+
 	// No setup stones despite handicap (maybe they are recorded as game moves)
 	if (len(g.Setup) == 0) && (g.Handicap != 0) {
-		if len(g.Moves) >= g.Handicap {
+		if (len(g.Moves) >= g.Handicap) && allBlack(g.Moves[:g.Handicap]) && noPasses(g.Moves[:g.Handicap]) {
 			g.Setup = g.Moves[:g.Handicap]
 			g.Moves = g.Moves[g.Handicap:]
+			for i := range g.Comments {
+				if g.Comments[i].Move -= g.Handicap; g.Comments[i].Move < 0 {
+					g.Comments[i].Move = 0
+				}
+			}
 		}
 	}
 
-	// No handicap despite setup stones (try setting it to number of setup stones)
-	if (len(g.Setup) != 0) && (g.Handicap == 0) {
+	// No handicap despite setup stones that look like one (try setting it to number of setup stones)
+	if (len(g.Setup) != 0) && (g.Handicap == 0) && allBlack(g.Setup) && (g.Player != "B") {
 		g.Handicap = len(g.Setup)
 	}
 
-	// Check number of handicap stones
-	if len(g.Setup) != g.Handicap {
-		return fmt.Errorf("handicap %d has %d setup stones", g.Handicap, len(g.Setup))
-	}
-
-	// Check color of handicap stones (should be all black)
-	for i := range g.Setup {
-		if g.Setup[i][:1] != "B" {
-			return fmt.Errorf("setup stone not black")
-		}
-	}
-
-	// Replace "tt" with pass where applicable
-	if g.Size[0]*g.Size[1] <= 19*19 {
-		for i := range g.Setup {
-			if g.Setup[i][1:] == "tt" {
-				g.Setup[i] = g.Setup[i][:1]
-			}
-		}
-		for i := range g.Moves {
-			if g.Moves[i][1:] == "tt" {
-				g.Moves[i] = g.Moves[i][:1]
+	// Everything must be on the board (checked again in case SZ came late)
+	for _, moves := range [][]string{g.Setup, g.Moves} {
+		for _, m := range moves {
+			if err := checkOnBoard(m, g.Size); err != nil {
+				return err
 			}
 		}
 	}
@@ -91,130 +139,108 @@ func (g *GameData) Finalize() error {
 	return nil
 }
 
-// AddProperty (possibly) parses an identifier/value pair
+// AddProperty (possibly) parses an identifier/value pair with the registered handler
 func (g *GameData) AddProperty(identifier, value string) error {
-	switch identifier {
-	case "SZ":
-		if g.alreadyRecorded[0] {
-			return fmt.Errorf("%w: %s %s", ErrAlreadyExists, identifier, value)
-		}
-		v, err := ParseSize(value)
-		if err != nil {
-			return err
-		}
-		g.Size = v
-		g.alreadyRecorded[0] = true
-		return nil
-	case "KM":
-		if g.alreadyRecorded[1] {
-			return fmt.Errorf("%w: %s %s", ErrAlreadyExists, identifier, value)
-		}
-		v, err := ParseKomi(value)
-		if err != nil {
-			return err
-		}
-		g.Komi = v
-		g.alreadyRecorded[1] = true
-		return nil
-	case "HA":
-		if g.alreadyRecorded[2] {
-			return fmt.Errorf("%w: %s %s", ErrAlreadyExists, identifier, value)
-		}
-		v, err := ParseHandicap(value)
-		if err != nil {
-			return err
-		}
-		g.Handicap = v
-		g.alreadyRecorded[2] = true
-		return nil
-	case "RE":
-		if g.alreadyRecorded[3] {
-			return fmt.Errorf("%w: %s %s", ErrAlreadyExists, identifier, value)
-		}
-		v1, v2, v3, err := ParseResult(value)
-		if err != nil {
-			return err
-		}
-		g.Winner = v1
-		g.Score = v2
-		g.End = v3
-		g.alreadyRecorded[3] = true
-		return nil
-	case "BR":
-		if g.alreadyRecorded[4] {
-			return fmt.Errorf("%w: %s %s", ErrAlreadyExists, identifier, value)
-		}
-		v, err := ParseRank("B", value)
-		if err != nil {
-			return err
-		}
-		g.BlackRank = v
-		g.alreadyRecorded[4] = true
+	p, ok := properties[identifier]
+	if !ok {
 		return nil
-	case "WR":
-		if g.alreadyRecorded[5] {
-			return fmt.Errorf("%w: %s %s", ErrAlreadyExists, identifier, value)
-		}
-		v, err := ParseRank("W", value)
-		if err != nil {
-			return err
-		}
-		g.WhiteRank = v
-		g.alreadyRecorded[5] = true
-		return nil
-	case "PB":
-		if g.alreadyRecorded[6] {
-			return fmt.Errorf("%w: %s %s", ErrAlreadyExists, identifier, value)
-		}
-		g.BlackPlayer = strings.Replace(strings.Replace(value, "\n", " ", -1), "\r", "", -1)
-		g.alreadyRecorded[6] = true
-		return nil
-	case "PW":
-		if g.alreadyRecorded[7] {
-			return fmt.Errorf("%w: %s %s", ErrAlreadyExists, identifier, value)
-		}
-		g.WhitePlayer = strings.Replace(strings.Replace(value, "\n", " ", -1), "\r", "", -1)
-		g.alreadyRecorded[7] = true
-		return nil
-	case "TM":
-		if g.alreadyRecorded[8] {
-			return fmt.Errorf("%w: %s %s", ErrAlreadyExists, identifier, value)
-		}
-		v, err := ParseTime(value)
-		if err != nil {
-			return err
-		}
-		g.Time = v
-		g.alreadyRecorded[8] = true
-		return nil
-	case "DT":
-		if g.alreadyRecorded[10] {
+	}
+	if g.recorded&p.bit != 0 {
+		switch p.duplicate {
+		case DuplicateError:
 			return fmt.Errorf("%w: %s %s", ErrAlreadyExists, identifier, value)
+		case DuplicateKeepFirst:
+			return nil
 		}
-		v, err := ParseDate(value)
-		if err != nil {
-			return err
-		}
-		g.Year = v
-		g.alreadyRecorded[10] = true
-		return nil
-	case "B", "W", "AB", "AW":
-		player := identifier[len(identifier)-1:]
-		v, err := ParseMove(player, value)
-		if err != nil {
-			return err
-		}
-		if identifier[:1] == "A" {
-			g.Setup = append(g.Setup, v)
-		} else {
-			g.Moves = append(g.Moves, v)
-		}
-		return nil
 	}
+	if err := p.record(g, identifier, value); err != nil {
+		return err
+	}
+	g.recorded |= p.bit
+	return nil
+}
 
+// textField maps a text property to its field
+func (g *GameData) textField(identifier string) *string {
+	switch identifier {
+	case "GN":
+		return &g.GameName
+	case "EV":
+		return &g.Event
+	case "RO":
+		return &g.Round
+	case "PC":
+		return &g.Place
+	case "SO":
+		return &g.RecordSource
+	case "GC":
+		return &g.GameComment
+	}
+	panic("not a text property")
+}
+
+// boardSize is Size, or the default if SZ has not been recorded yet
+func (g *GameData) boardSize() [2]int {
+	if !g.isRecorded("SZ") {
+		return [2]int{19, 19}
+	}
+	return g.Size
+}
+
+// ttIsPass checks if "tt" means pass (as in FF[3]) on a board of the given size
+func ttIsPass(size [2]int) bool {
+	return (size[0] <= 19) && (size[1] <= 19)
+}
+
+// checkOnBoard checks that a move or setup stone is a pass or on the board
+func checkOnBoard(m string, size [2]int) error {
+	if (len(m) == 1) || ((m[1:] == "tt") && ttIsPass(size)) {
+		return nil
+	}
+	col, _ := letterToCoordinate(m[1])
+	row, _ := letterToCoordinate(m[2])
+	if (row >= size[0]) || (col >= size[1]) {
+		return ErrOutsideBoard{m, size}
+	}
 	return nil
 }
 
+// endNode attaches any comment from the current node
+func (g *GameData) endNode() {
+	if g.nodeComment == "" {
+		return
+	}
+	g.Comments = append(g.Comments, Comment{Move: len(g.Moves), Text: g.nodeComment})
+	g.nodeComment = ""
+}
+
+// contentProperties are the properties read into ContentID, whose values are never cut
+// short without KeepText
+var contentProperties = map[string]bool{
+	"SZ": true, "KM": true, "HA": true, "PL": true, "RE": true, "DT": true,
+	"PB": true, "PW": true, "BR": true, "WR": true,
+	"B": true, "W": true, "AB": true, "AW": true, "AE": true,
+}
+
+// ContentID is a stable 64-bit hash (FNV-1a) of the source, board size, setup (in any
+// order), moves, and key metadata: komi, handicap, first player, result, player names,
+// ranks as written, and date. It does not depend on parsing options, text fields, or
+// Extra, so the same game from the same source gets the same ID in every run and dataset.
+func (g *GameData) ContentID() uint64 {
+	setup := append([]string(nil), g.Setup...)
+	sort.Strings(setup)
+	date := ""
+	if g.Date != nil {
+		date = fmt.Sprintf("%s/%s", g.Date.Start, g.Date.End)
+	}
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%q %dx%d %q %q %g %d %q %q %g %q %q %q %q %q %q %d",
+		g.Source, g.Size[0], g.Size[1], strings.Join(setup, ","), strings.Join(g.Moves, ","),
+		g.Komi, g.Handicap, g.Player, g.Winner, g.Score, g.End,
+		g.BlackPlayer, g.WhitePlayer, g.BlackRank, g.WhiteRank, date, g.Year)
+	return h.Sum64()
+}
+
 // Equals compares two games
 func (g *GameData) Equals(g2 GameData) bool {
 	switch {
@@ -234,14 +260,61 @@ func (g *GameData) Equals(g2 GameData) bool {
 		return false
 	case g.WhiteRank != g2.WhiteRank:
 		return false
+	case !equalRanks(g.BlackRankValue, g2.BlackRankValue):
+		return false
+	case !equalRanks(g.WhiteRankValue, g2.WhiteRankValue):
+		return false
 	case g.BlackPlayer != g2.BlackPlayer:
 		return false
 	case g.WhitePlayer != g2.WhitePlayer:
 		return false
 	case g.Time != g2.Time:
 		return false
+	case g.Player != g2.Player:
+		return false
 	case g.Year != g2.Year:
 		return false
+	case (g.Date == nil) != (g2.Date == nil):
+		return false
+	case (g.Date != nil) && (*g.Date != *g2.Date):
+		return false
+	case g.GameName != g2.GameName:
+		return false
+	case g.Event != g2.Event:
+		return false
+	case g.Round != g2.Round:
+		return false
+	case g.Place != g2.Place:
+		return false
+	case g.Rules != g2.Rules:
+		return false
+	case g.Ruleset != g2.Ruleset:
+		return false
+	case g.RecordSource != g2.RecordSource:
+		return false
+	case g.DateText != g2.DateText:
+		return false
+	case g.GameComment != g2.GameComment:
+		return false
+	}
+	if !reflect.DeepEqual(g.Extra, g2.Extra) {
+		return false
+	}
+	if len(g.Repairs) != len(g2.Repairs) {
+		return false
+	}
+	for i := range g.Repairs {
+		if g.Repairs[i] != g2.Repairs[i] {
+			return false
+		}
+	}
+	if len(g.Comments) != len(g2.Comments) {
+		return false
+	}
+	for i := range g.Comments {
+		if g.Comments[i] != g2.Comments[i] {
+			return false
+		}
 	}
 	if len(g.Moves) != len(g2.Moves) {
 		return false
@@ -261,3 +334,31 @@ func (g *GameData) Equals(g2 GameData) bool {
 	}
 	return true
 }
+
+// equalRanks compares optional ranks
+func equalRanks(r1, r2 *Rank) bool {
+	if (r1 == nil) || (r2 == nil) {
+		return r1 == r2
+	}
+	return *r1 == *r2
+}
+
+// noPasses checks that all moves are on the board
+func noPasses(moves []string) bool {
+	for _, m := range moves {
+		if len(m) == 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// allBlack checks if all moves or setup stones are black
+func allBlack(moves []string) bool {
+	for _, m := range moves {
+		if m[:1] != "B" {
+			return false
+		}
+	}
+	return true
+}
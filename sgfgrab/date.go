@@ -0,0 +1,196 @@
+package sgfgrab
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Date is a calendar date where Month and Day are zero when unknown
+type Date struct {
+	Year, Month, Day int
+}
+
+func (d Date) String() string {
+	switch {
+	case d.Month == 0:
+		return fmt.Sprintf("%04d", d.Year)
+	case d.Day == 0:
+		return fmt.Sprintf("%04d-%02d", d.Year, d.Month)
+	}
+	return fmt.Sprintf("%04d-%02d-%02d", d.Year, d.Month, d.Day)
+}
+
+// MarshalJSON writes the date as an ISO 8601 string, which sorts chronologically
+func (d Date) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(d.String())), nil
+}
+
+// UnmarshalJSON reads a date written by MarshalJSON
+func (d *Date) UnmarshalJSON(b []byte) error {
+	s, err := strconv.Unquote(string(b))
+	if err != nil {
+		return err
+	}
+	r, err := ParseDateRange(s)
+	if err != nil {
+		return err
+	}
+	*d = r.Start
+	return nil
+}
+
+// Before compares dates, treating unknown months and days as the start of the period
+func (d Date) Before(d2 Date) bool {
+	if d.Year != d2.Year {
+		return d.Year < d2.Year
+	}
+	if d.Month != d2.Month {
+		return d.Month < d2.Month
+	}
+	return d.Day < d2.Day
+}
+
+// DateRange is the period over which a game was played
+type DateRange struct {
+	Start     Date
+	End       Date   // same as Start for a single date
+	Precision string // "year", "month", or "day"
+}
+
+var reDateYear, reDateFull *regexp.Regexp
+
+func init() {
+	reDateYear = regexp.MustCompile("^[0-9]{4}")
+	reDateFull = regexp.MustCompile("^[0-9]{8}$")
+}
+
+// ParseDateRange parses a game date, including SGF shortcuts like "1976-08-12,13" and
+// "1996-05,06", separators like "2016/03/13" or "2016.3.13", and Chinese, Japanese, or
+// Korean dates like "2016年3月13日" and "2016년 3월 13일". Anything after the first date
+// and its shortcuts (e.g. a time) is ignored. Unreadable dates starting with a year
+// keep just the year.
+func ParseDateRange(v string) (DateRange, error) {
+	r, err := parseDateList(normalizeDate(v))
+	if err != nil {
+		y, _ := strconv.Atoi(reDateYear.FindString(strings.TrimSpace(v)))
+		if y < 1 {
+			return DateRange{}, ErrParse{"DT", v}
+		}
+		return DateRange{Start: Date{Year: y}, End: Date{Year: y}, Precision: "year"}, nil
+	}
+	return r, nil
+}
+
+// normalizeDate rewrites a date with "-" separators and no spaces, cut at the first time or comment
+func normalizeDate(v string) string {
+	v = strings.NewReplacer(
+		"年", "-", "月", "-", "日", "",
+		"년", "-", "월", "-", "일", "",
+		"/", "-", ".", "-", "，", ",",
+	).Replace(strings.TrimSpace(v))
+
+	// Remove spaces next to separators, then cut at the first remaining space
+	fields := strings.Fields(v)
+	v = ""
+	for i, f := range fields {
+		if (i > 0) && !strings.HasSuffix(v, "-") && !strings.HasSuffix(v, ",") && !strings.HasPrefix(f, "-") && !strings.HasPrefix(f, ",") {
+			break
+		}
+		v += f
+	}
+	if i := strings.IndexByte(v, 'T'); i >= 0 { // ISO 8601 time
+		v = v[:i]
+	}
+	v = strings.TrimRight(v, "-,")
+
+	// Compact dates like "20160313"
+	if reDateFull.MatchString(v) {
+		v = v[:4] + "-" + v[4:6] + "-" + v[6:]
+	}
+	return v
+}
+
+// parseDateList parses a comma separated list of dates and SGF shortcuts into a range
+func parseDateList(v string) (DateRange, error) {
+	var r DateRange
+	var prev Date
+	for i, part := range strings.Split(v, ",") {
+		nums := strings.Split(part, "-")
+		ints := make([]int, len(nums))
+		for j := range nums {
+			if (len(nums[j]) == 0) || (len(nums[j]) > 4) {
+				return DateRange{}, ErrParse{"DT", v}
+			}
+			n, err := strconv.Atoi(nums[j])
+			if err != nil {
+				return DateRange{}, ErrParse{"DT", v}
+			}
+			ints[j] = n
+		}
+
+		// Fill in the date, starting from the previous one for shortcuts
+		d := prev
+		switch {
+		case len(nums[0]) == 4: // Full date
+			if len(ints) > 3 {
+				return DateRange{}, ErrParse{"DT", v}
+			}
+			d = Date{Year: ints[0]}
+			if len(ints) > 1 {
+				d.Month = ints[1]
+			}
+			if len(ints) > 2 {
+				d.Day = ints[2]
+			}
+		case i == 0:
+			return DateRange{}, ErrParse{"DT", v}
+		case (len(ints) == 2) && (prev.Day != 0): // MM-DD
+			d.Month, d.Day = ints[0], ints[1]
+		case (len(ints) == 1) && (prev.Day != 0): // DD
+			d.Day = ints[0]
+		case (len(ints) == 1) && (prev.Month != 0): // MM
+			d.Month = ints[0]
+		default:
+			return DateRange{}, ErrParse{"DT", v}
+		}
+		if !validDate(d) {
+			return DateRange{}, ErrParse{"DT", v}
+		}
+
+		// Extend range
+		if i == 0 {
+			r = DateRange{Start: d, End: d, Precision: "day"}
+			if d.Month == 0 {
+				r.Precision = "year"
+			} else if d.Day == 0 {
+				r.Precision = "month"
+			}
+		}
+		if d.Before(r.Start) {
+			r.Start = d
+		}
+		if r.End.Before(d) {
+			r.End = d
+		}
+		prev = d
+	}
+	return r, nil
+}
+
+// validDate checks that the month and day exist
+func validDate(d Date) bool {
+	if (d.Year < 1) || (d.Month < 0) || (d.Month > 12) || (d.Day < 0) {
+		return false
+	}
+	if (d.Month == 0) && (d.Day != 0) {
+		return false
+	}
+	if d.Day != 0 {
+		t := time.Date(d.Year, time.Month(d.Month), d.Day, 0, 0, 0, 0, time.UTC)
+		return t.Day() == d.Day
+	}
+	return true
+}
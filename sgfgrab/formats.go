@@ -0,0 +1,448 @@
+package sgfgrab
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/dodgebc/go-game-utils/weiqi"
+)
+
+// Reader scrapes the text of a game record for GameData fields
+type Reader func(text string, opts Options) ([]GameData, error)
+
+// Readers maps lowercase file extensions to the reader for that format
+var Readers = map[string]Reader{
+	".sgf": GrabWithOptions,
+	".gib": GrabGIB,
+	".ngf": GrabNGF,
+	".ugf": GrabUGF,
+	".ugi": GrabUGF,
+}
+
+// ReaderFor finds the reader for a file name by its extension, or nil if there is none
+func ReaderFor(name string) Reader {
+	return Readers[strings.ToLower(path.Ext(name))]
+}
+
+// GrabFile decodes a game record and scrapes it with the reader for its file name
+func GrabFile(name string, data []byte, opts Options) ([]GameData, error) {
+	read := ReaderFor(name)
+	if read == nil {
+		return []GameData{}, fmt.Errorf("no reader for %q", path.Ext(name))
+	}
+	text, charset := Decode(data)
+	games, err := read(text, opts)
+	if grabErr, ok := err.(GrabError); ok {
+		grabErr.Offset = sourceOffset(data, charset, grabErr.Offset)
+		err = grabErr
+	}
+	return games, err
+}
+
+// GrabGIB scrapes a Tygem .gib record for GameData fields
+func GrabGIB(text string, opts Options) ([]GameData, error) {
+	c := newConverter(opts)
+	c.add("SZ", "19")
+	next := "B"
+	for c.nextLine(text) {
+		line := c.text
+		switch {
+		case strings.HasPrefix(line, `\[`) && strings.HasSuffix(line, `\]`):
+			kv := strings.SplitN(line[2:len(line)-2], "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			c.key = kv[0]
+			v := strings.TrimSpace(kv[1])
+			switch c.key {
+			case "GAMENAME":
+				c.add("GN", v)
+			case "GAMEPLACE":
+				c.add("PC", v)
+			case "GAMEBLACKNAME":
+				c.addPlayer("B", v)
+			case "GAMEWHITENAME":
+				c.addPlayer("W", v)
+			case "GAMEDATE": // Like "2016- 3-13-19-46-29"
+				parts := strings.Split(strings.ReplaceAll(v, " ", ""), "-")
+				if len(parts) > 3 {
+					parts = parts[:3]
+				}
+				c.add("DT", strings.Join(parts, "-"))
+			case "GAMEINFOMAIN": // Like "GBKIND:3,GTYPE:0,GRLT:3,ZIPSU:0,GONGJE:65,..."
+				info := make(map[string]string)
+				for _, field := range strings.Split(v, ",") {
+					if kv := strings.SplitN(field, ":", 2); len(kv) == 2 {
+						info[kv[0]] = kv[1]
+					}
+				}
+				if komi, err := strconv.Atoi(info["GONGJE"]); err == nil {
+					if err := c.add("KM", strconv.FormatFloat(float64(komi)/10, 'f', -1, 64)); err != nil {
+						return []GameData{}, err
+					}
+				}
+				if result := gibResult(info["GRLT"], info["ZIPSU"]); result != "" {
+					c.add("RE", result)
+				}
+			}
+		case strings.HasPrefix(line, "INI "): // Like "INI 0 1 3 &4", with the handicap fourth
+			c.key = "INI"
+			fields := strings.Fields(line)
+			if len(fields) < 4 {
+				return []GameData{}, c.locate(fmt.Errorf("%w: short INI line", ErrSyntax))
+			}
+			if err := c.addHandicap(fields[3]); err != nil {
+				return []GameData{}, err
+			}
+			if c.game.Handicap >= 2 {
+				next = "W"
+			}
+		case strings.HasPrefix(line, "STO "): // Like "STO 0 2 1 15 3", with color 1 (black) or 2 and x, y
+			c.key = "STO"
+			fields := strings.Fields(line)
+			if len(fields) < 6 {
+				return []GameData{}, c.locate(fmt.Errorf("%w: short STO line", ErrSyntax))
+			}
+			color := map[string]string{"1": "B", "2": "W"}[fields[3]]
+			if color == "" {
+				return []GameData{}, c.locate(ErrParse{"STO", line})
+			}
+			if err := c.add(color, pointFromNumbers(fields[4], fields[5])); err != nil {
+				return []GameData{}, err
+			}
+			next = map[string]string{"B": "W", "W": "B"}[color]
+		case strings.HasPrefix(line, "SKI "): // Pass by the player to move
+			c.key = "SKI"
+			if err := c.add(next, ""); err != nil {
+				return []GameData{}, err
+			}
+			next = map[string]string{"B": "W", "W": "B"}[next]
+		}
+	}
+	return c.finish()
+}
+
+// gibResult converts GIB result codes to an SGF result, or "" if unknown
+func gibResult(grlt, zipsu string) string {
+	switch grlt {
+	case "0", "1":
+		score, err := strconv.Atoi(zipsu)
+		if err != nil {
+			return ""
+		}
+		return map[string]string{"0": "B+", "1": "W+"}[grlt] + strconv.FormatFloat(float64(score)/10, 'f', -1, 64)
+	case "3":
+		return "B+R"
+	case "4":
+		return "W+R"
+	case "7":
+		return "B+T"
+	case "8":
+		return "W+T"
+	}
+	return ""
+}
+
+// GrabNGF scrapes a WBaduk or Cyberoro .ngf record for GameData fields
+func GrabNGF(text string, opts Options) ([]GameData, error) {
+	c := newConverter(opts)
+	header := []string{"GN", "SZ", "white", "black", "", "HA", "", "KM", "DT", "", "RE", ""}
+	for c.nextLine(text) {
+		line := c.text
+		if c.line <= len(header) { // Fixed header lines
+			c.key = header[c.line-1]
+			var err error
+			switch c.key {
+			case "white":
+				c.addPlayer("W", line)
+			case "black":
+				c.addPlayer("B", line)
+			case "HA":
+				err = c.addHandicap(line)
+			case "SZ", "KM", "DT", "RE", "GN":
+				err = c.add(c.key, line)
+			}
+			if err != nil {
+				return []GameData{}, err
+			}
+			continue
+		}
+
+		// Moves like "PMABBQDDQ": move number, color, and coordinates from "B" (twice)
+		if !strings.HasPrefix(line, "PM") {
+			continue
+		}
+		c.key = "PM"
+		if len(line) < 7 {
+			return []GameData{}, c.locate(fmt.Errorf("%w: short PM line", ErrSyntax))
+		}
+		color := line[4:5]
+		if (color != "B") && (color != "W") {
+			return []GameData{}, c.locate(ErrParse{"PM", line})
+		}
+		if line[5:7] == "AA" { // Pass
+			if err := c.add(color, ""); err != nil {
+				return []GameData{}, err
+			}
+			continue
+		}
+		if err := c.addPoint(color, int(line[5])-'B', int(line[6])-'B'); err != nil {
+			return []GameData{}, err
+		}
+	}
+	if c.line < len(header) {
+		return []GameData{}, c.locate(fmt.Errorf("%w: header has %d lines, want %d", ErrSyntax, c.line, len(header)))
+	}
+	return c.finish()
+}
+
+// GrabUGF scrapes a PandaNet .ugf or .ugi record for GameData fields
+func GrabUGF(text string, opts Options) ([]GameData, error) {
+	c := newConverter(opts)
+	section := ""
+	for c.nextLine(text) {
+		line := c.text
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = line
+			continue
+		}
+
+		switch section {
+		case "[Header]":
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			c.key = kv[0]
+			fields := strings.Split(kv[1], ",")
+			var err error
+			switch c.key {
+			case "Title":
+				c.add("GN", fields[0])
+			case "Place":
+				c.add("PC", fields[0])
+			case "Date":
+				c.add("DT", fields[0])
+			case "Rule":
+				c.add("RU", fields[0])
+			case "Size":
+				err = c.add("SZ", fields[0])
+			case "Hdcp": // Handicap and komi
+				err = c.add("HA", fields[0])
+				if (err == nil) && (len(fields) > 1) {
+					err = c.add("KM", fields[1])
+				}
+			case "PlayerB", "PlayerW": // Name and rank
+				c.add("P"+c.key[6:], fields[0])
+				if (len(fields) > 1) && (fields[1] != "") {
+					c.add(c.key[6:]+"R", strings.ToLower(fields[1]))
+				}
+			case "Winner": // Winner and score, or "C" for resignation
+				if len(fields) > 1 {
+					if _, err := strconv.ParseFloat(fields[1], 64); err == nil {
+						c.add("RE", fields[0]+"+"+fields[1])
+					} else if fields[1] == "C" {
+						c.add("RE", fields[0]+"+R")
+					} else {
+						c.add("RE", fields[0]+"+")
+					}
+				}
+			}
+			if err != nil {
+				return []GameData{}, err
+			}
+		case "[Data]": // Like "PD,B1,0": coordinates (rows from the bottom), color and move number, time
+			c.key = "Data"
+			fields := strings.Split(line, ",")
+			if (len(fields) < 2) || (len(fields[0]) != 2) || (len(fields[1]) < 2) {
+				return []GameData{}, c.locate(ErrParse{"Data", line})
+			}
+			color := fields[1][:1]
+			if (color != "B") && (color != "W") {
+				return []GameData{}, c.locate(ErrParse{"Data", line})
+			}
+			identifier := color
+			if fields[1][1:] == "0" { // Handicap stones are move zero
+				identifier = "A" + color
+			}
+			if (fields[0] == "YA") && (c.game.boardSize()[1] < 25) { // Pass
+				if err := c.add(identifier, ""); err != nil {
+					return []GameData{}, err
+				}
+				continue
+			}
+			col, row := int(fields[0][0])-'A', c.game.boardSize()[0]-1-(int(fields[0][1])-'A')
+			if err := c.addPoint(identifier, col, row); err != nil {
+				return []GameData{}, err
+			}
+		}
+	}
+	return c.finish()
+}
+
+// converter builds GameData from another record format, one SGF property at a time
+type converter struct {
+	game      GameData
+	opts      Options
+	text      string // current line, trimmed
+	line      int    // starting from 1
+	offset    int    // of the current line
+	next      int    // offset of the next line
+	key       string // field being converted, for errors
+	truncated bool
+}
+
+func newConverter(opts Options) *converter {
+	return &converter{game: GameData{keepText: opts.KeepText}, opts: opts}
+}
+
+// nextLine advances to the next line of text
+func (c *converter) nextLine(text string) bool {
+	if c.next >= len(text) {
+		return false
+	}
+	c.offset = c.next
+	end := strings.IndexByte(text[c.offset:], '\n')
+	if end < 0 {
+		end = len(text) - c.offset
+	}
+	c.text = strings.TrimSpace(text[c.offset : c.offset+end])
+	c.next = c.offset + end + 1
+	c.line++
+	return true
+}
+
+// locate places an error on the current line
+func (c *converter) locate(err error) error {
+	return GrabError{
+		Offset: c.offset, Line: c.line, Column: 1,
+		Node: len(c.game.Moves), Move: len(c.game.Moves),
+		Property: c.key, Err: err,
+	}
+}
+
+// add records an SGF property, returning an error only for critical properties
+// that could not be repaired
+func (c *converter) add(identifier, value string) error {
+	if c.truncated {
+		return nil
+	}
+	err := c.game.AddProperty(identifier, value)
+	if err == nil {
+		return nil
+	}
+	return c.repair(identifier, err)
+}
+
+// repair applies the repair policy to an error adding a property
+func (c *converter) repair(identifier string, err error) error {
+	switch identifier {
+	case "SZ", "KM", "HA", "B", "W", "AB", "AW", "AE":
+		err = c.locate(err)
+		switch {
+		case (c.opts.Repair&RepairTruncate != 0) && ((identifier == "B") || (identifier == "W")):
+			c.game.Repairs = append(c.game.Repairs, "truncated game: "+err.Error())
+			c.truncated = true
+		case c.opts.Repair&RepairDropNode != 0:
+			c.game.Repairs = append(c.game.Repairs, "dropped line: "+err.Error())
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// addHandicap records a handicap with stones on the usual points for the board size
+func (c *converter) addHandicap(v string) error {
+	if err := c.add("HA", v); err != nil {
+		return err
+	}
+	if c.game.Handicap < 2 {
+		return nil
+	}
+	points, err := handicapPoints(c.game.boardSize(), c.game.Handicap)
+	if err != nil {
+		return c.locate(err)
+	}
+	for _, p := range points {
+		if err := c.add("AB", p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addPlayer records the name and any rank of a player like "Lee Sedol (9D)" or "pwhite 3D*"
+func (c *converter) addPlayer(color, v string) {
+	name, rank := splitNameRank(v)
+	c.add("P"+color, name)
+	if rank != "" {
+		c.add(color+"R", strings.ToLower(rank))
+	}
+}
+
+// addPoint records a move or setup stone from zero-based coordinates, which must be on
+// the board
+func (c *converter) addPoint(identifier string, col, row int) error {
+	size := c.game.boardSize()
+	if (col < 0) || (row < 0) || (col >= size[1]) || (row >= size[0]) || (col >= len(coordinateLetters)) || (row >= len(coordinateLetters)) {
+		if c.truncated {
+			return nil
+		}
+		return c.repair(identifier, ErrParse{c.key, c.text})
+	}
+	return c.add(identifier, coordinateLetters[col:col+1]+coordinateLetters[row:row+1])
+}
+
+// finish checks the game and returns it
+func (c *converter) finish() ([]GameData, error) {
+	c.game.endNode()
+	if err := c.game.Finalize(); err != nil {
+		return []GameData{}, c.locate(err)
+	}
+	return []GameData{c.game}, nil
+}
+
+// pointFromNumbers converts zero-based x and y coordinates to SGF, or returns them
+// as written (to fail parsing) if they are not numbers
+func pointFromNumbers(x, y string) string {
+	col, err1 := strconv.Atoi(x)
+	row, err2 := strconv.Atoi(y)
+	if (err1 != nil) || (err2 != nil) || (col < 0) || (row < 0) || (col >= len(coordinateLetters)) || (row >= len(coordinateLetters)) {
+		return x + "," + y
+	}
+	return coordinateLetters[col:col+1] + coordinateLetters[row:row+1]
+}
+
+// splitNameRank splits a player into name and rank, if the rank can be found
+func splitNameRank(v string) (string, string) {
+	v = strings.TrimSpace(v)
+	if strings.HasSuffix(v, ")") {
+		if i := strings.LastIndex(v, "("); i >= 0 {
+			return strings.TrimSpace(v[:i]), v[i+1 : len(v)-1]
+		}
+	}
+	if i := strings.LastIndexAny(v, " \t"); i >= 0 {
+		if _, err := ParseRank("B", strings.ToLower(v[i+1:])); err == nil {
+			return strings.TrimSpace(v[:i]), v[i+1:]
+		}
+	}
+	return v, ""
+}
+
+// handicapPoints places a fixed handicap on the star points in the traditional order
+// used by game servers (upper right, lower left, lower right, upper left, then sides and
+// center)
+func handicapPoints(size [2]int, handicap int) ([]string, error) {
+	stones, err := weiqi.FixedHandicapOrder(size[0], size[1], handicap, weiqi.HandicapTraditional)
+	if err != nil {
+		return nil, err
+	}
+	points := make([]string, 0, len(stones))
+	for _, m := range stones {
+		points = append(points, m.String()[1:])
+	}
+	return points, nil
+}
@@ -2,13 +2,74 @@
 package sgfgrab
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 	"unicode"
 )
 
+// ErrSyntax means that the SGF structure itself is broken
+var ErrSyntax = errors.New("syntax error")
+
+// GrabError locates an error within an SGF file
+type GrabError struct {
+	Offset   int    // byte offset of the property value or syntax error, in the original bytes for GrabFile
+	Line     int    // starting from 1
+	Column   int    // starting from 1, counting characters (not bytes) of the line
+	Game     int    // index of the game within the file
+	Node     int    // index of the node within the main branch, 0 for the root
+	Move     int    // number of game moves before the error
+	Property string // identifier, or "" for syntax and consistency errors
+	Err      error
+}
+
+func (e GrabError) Error() string {
+	location := fmt.Sprintf("line %d, column %d (byte %d), game %d, node %d, move %d", e.Line, e.Column, e.Offset, e.Game, e.Node, e.Move)
+	if e.Property != "" {
+		location += ", property " + e.Property
+	}
+	return fmt.Sprintf("%s: %s", location, e.Err)
+}
+
+func (e GrabError) Unwrap() error {
+	return e.Err
+}
+
+// position tracks where Grab is in the SGF text
+type position struct {
+	offset, line, column int
+}
+
+// Repair selects fixes GrabWithOptions makes to malformed SGF instead of failing
+type Repair uint
+
+const (
+	// RepairDropNode drops a main branch node with a bad critical property or a stray "]"
+	RepairDropNode Repair = 1 << iota
+	// RepairTruncate ends a game at its first bad move (B, W, or setup after moves)
+	RepairTruncate
+	// RepairCloseParens finishes games still open at the end of the file
+	RepairCloseParens
+	// RepairDuplicates keeps the first of repeated SZ, KM, or HA properties
+	RepairDuplicates
+
+	// RepairAll makes every repair (RepairTruncate before RepairDropNode for bad moves)
+	RepairAll = RepairDropNode | RepairTruncate | RepairCloseParens | RepairDuplicates
+)
+
+// Options configures optional GameData fields recorded by GrabWithOptions
+type Options struct {
+	KeepText bool   // keep full-length text values, comments, and descriptive game fields
+	Repair   Repair // fixes to make, each listed in GameData.Repairs
+}
+
 // Grab scrapes an SGF for GameData fields
 func Grab(sgfText string) ([]GameData, error) {
+	return GrabWithOptions(sgfText, Options{})
+}
+
+// GrabWithOptions scrapes an SGF for GameData fields, including those enabled by opts
+func GrabWithOptions(sgfText string, opts Options) ([]GameData, error) {
 
 	var brackOpen bool
 	var parensOpen int
@@ -16,12 +77,49 @@ func Grab(sgfText string) ([]GameData, error) {
 	var mainBranch bool
 	var identWritten bool
 
+	var skipNode bool  // rest of the node was dropped
+	var truncated bool // rest of the game was dropped
+
 	var identifier strings.Builder
 	var value strings.Builder
-	var game GameData
+	var cutValue bool // value is cut short, since it is only kept as text
+	game := GameData{keepText: opts.KeepText}
 	var allGames []GameData
 
-	for _, r := range sgfText {
+	// Error locations
+	var node int
+	var nodeStarted bool
+	var nodeStart GameData // for dropping nodes
+	dropNode := func(err error) {
+		repairs := game.Repairs
+		if mainBranch {
+			game = nodeStart
+			skipNode = true
+		}
+		game.Repairs = append(repairs, "dropped node: "+err.Error())
+	}
+	var valueAt position
+	at := position{line: 1, column: 1}
+	locate := func(pos position, property string, err error) error {
+		return GrabError{
+			Offset: pos.offset, Line: pos.line, Column: pos.column,
+			Game: len(allGames), Node: node, Move: len(game.Moves),
+			Property: property, Err: err,
+		}
+	}
+
+	for i, r := range sgfText {
+
+		// Track location for errors
+		if i > 0 {
+			if sgfText[at.offset] == '\n' {
+				at.line++
+				at.column = 1
+			} else {
+				at.column++
+			}
+		}
+		at.offset = i
 
 		// Manage brackets and escapes
 		isValue := false
@@ -42,15 +140,36 @@ func Grab(sgfText string) ([]GameData, error) {
 		} else if r == '[' {
 			brackOpen = true
 			isIdent = false
+			valueAt = at
+			cutValue = !opts.KeepText && !contentProperties[identifier.String()]
 		} else if r == ']' {
-			return []GameData{}, fmt.Errorf("missing open bracket")
+			err := locate(at, "", fmt.Errorf("%w: missing open bracket", ErrSyntax))
+			if opts.Repair&RepairDropNode == 0 {
+				return []GameData{}, err
+			}
+			dropNode(err)
+			continue
 		}
 
-		// Manage parentheses
+		// Manage parentheses and nodes
 		if !isValue {
+			if (r == ';') || (r == '(') || (r == ')') {
+				game.endNode()
+				skipNode = false
+			}
+			if (r == ';') && mainBranch {
+				if nodeStarted {
+					node++
+				}
+				nodeStarted = true
+				if opts.Repair&RepairDropNode != 0 {
+					nodeStart = game
+				}
+			}
 			if r == '(' {
 				if parensOpen == 0 {
 					mainBranch = true
+					nodeStart = game
 				}
 				parensOpen++
 			} else if r == ')' {
@@ -59,10 +178,13 @@ func Grab(sgfText string) ([]GameData, error) {
 				if parensOpen == 0 {
 					err := game.Finalize()
 					if err != nil {
-						return []GameData{}, err
+						return []GameData{}, locate(at, "", err)
 					}
 					allGames = append(allGames, game)
-					game = GameData{}
+					game = GameData{keepText: opts.KeepText}
+					node = 0
+					nodeStarted = false
+					truncated = false
 				}
 			}
 		}
@@ -71,7 +193,7 @@ func Grab(sgfText string) ([]GameData, error) {
 		if mainBranch {
 
 			if isValue { // Update value
-				if value.Len() < 30 { // Longer is probably some irrelevant comment
+				if !cutValue || (value.Len() < 30) { // Longer is probably some irrelevant comment
 					value.WriteRune(r)
 				}
 			} else if isIdent && unicode.IsUpper(r) { // Update identifier
@@ -80,22 +202,52 @@ func Grab(sgfText string) ([]GameData, error) {
 					identWritten = false
 				}
 				identifier.WriteRune(r)
-			} else if justDone { // Push property to GameData
-				err := game.AddProperty(identifier.String(), value.String())
+			} else if justDone && !skipNode && !truncated { // Push property to GameData
+				ident := identifier.String()
+				err := game.AddProperty(ident, value.String())
 				if err != nil {
-					switch identifier.String() { // Only critical properties end the parse
-					case "SZ", "KM", "HA", "B", "W", "AB", "AW":
-						return []GameData{}, err
+					switch ident { // Only critical properties end the parse
+					case "SZ", "KM", "HA", "B", "W", "AB", "AW", "AE":
+						err = locate(valueAt, ident, err)
+						switch {
+						case (opts.Repair&RepairDuplicates != 0) && errors.Is(err, ErrAlreadyExists):
+							game.Repairs = append(game.Repairs, "ignored duplicate: "+err.Error())
+						case (opts.Repair&RepairTruncate != 0) && ((ident == "B") || (ident == "W") || errors.Is(err, ErrSetupAfterMoves)):
+							game.Repairs = append(game.Repairs, "truncated game: "+err.Error())
+							truncated = true
+						case opts.Repair&RepairDropNode != 0:
+							dropNode(err)
+						default:
+							return []GameData{}, err
+						}
 					}
 					//return []GameData{}, err // With this line, all properties can end the parse
 				}
 				value.Reset()
 				identWritten = true
+			} else if justDone {
+				value.Reset()
+				identWritten = true
 			}
 
 		}
 
 	}
 
+	// Finish a game left open
+	if (parensOpen > 0) && (opts.Repair&RepairCloseParens != 0) {
+		game.endNode()
+		repair := fmt.Sprintf("closed %d missing parentheses", parensOpen)
+		if brackOpen {
+			repair += " after an unterminated value"
+		}
+		game.Repairs = append(game.Repairs, repair)
+		err := game.Finalize()
+		if err != nil {
+			return []GameData{}, locate(at, "", err)
+		}
+		allGames = append(allGames, game)
+	}
+
 	return allGames, nil
 }
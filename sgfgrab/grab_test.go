@@ -1,7 +1,18 @@
 package sgfgrab
 
 import (
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+	"unicode/utf8"
+
+	"github.com/dodgebc/go-game-utils/weiqi"
 )
 
 func BenchmarkAlphaGo(b *testing.B) {
@@ -89,21 +100,109 @@ func TestParseError(t *testing.T) {
 	}
 }
 
-func TestHandicapCheck(t *testing.T) {
-	sgfText := "(;HA[1];AB[aa];AB[ab])"
+func TestGrabErrorLocation(t *testing.T) {
+	sgfText := "(;SZ[9])\n(;GN[é]\n;B[aa];W[Zc2])"
 	_, err := Grab(sgfText)
-	if err == nil {
-		t.Error("no error with too many setup stones")
+	var grabErr GrabError
+	if !errors.As(err, &grabErr) {
+		t.Fatalf("error %v is not a GrabError", err)
+	}
+	expect := GrabError{Offset: 26, Line: 3, Column: 9, Game: 1, Node: 2, Move: 1, Property: "W"}
+	grabErr.Err = nil
+	if grabErr != expect {
+		t.Errorf("\ngot:\n%#v\n\nwant:\n%#v", grabErr, expect)
+	}
+	var parseErr ErrParse
+	if !errors.As(err, &parseErr) {
+		t.Errorf("error %v does not wrap ErrParse", err)
+	}
+
+	// GrabFile locates errors in the bytes before decoding, here after two GBK characters
+	sgfBytes := []byte("(;CA[GBK]PB[\xbf\xc2\xbd\xe0]\n;B[Zc2])")
+	_, err = GrabFile("game.sgf", sgfBytes, Options{})
+	if !errors.As(err, &grabErr) || (grabErr.Offset != 20) || (grabErr.Line != 2) || (grabErr.Column != 3) {
+		t.Errorf("unexpected error location in GBK: %v", err)
 	}
 
-	sgfText = "(;HA[1];AW[aa])"
+	sgfText = "(;SZ[9]\n;B[aa]])"
 	_, err = Grab(sgfText)
-	if err == nil {
-		t.Error("no error with white setup stone")
+	if !errors.Is(err, ErrSyntax) || !errors.As(err, &grabErr) || (grabErr.Line != 2) || (grabErr.Column != 7) || (grabErr.Property != "") {
+		t.Errorf("unexpected error on missing open bracket: %v", err)
 	}
 
-	sgfText = "(;AB[bb])"
+	sgfText = "(;B[aa];AW[bb])"
+	_, err = Grab(sgfText)
+	if !errors.Is(err, ErrSetupAfterMoves) || !errors.As(err, &grabErr) || (grabErr.Node != 1) || (grabErr.Property != "AW") {
+		t.Errorf("unexpected error on setup after moves: %v", err)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	cases := []struct {
+		sgfText string
+		repair  Repair
+		moves   []string
+		size    [2]int
+		repairs int
+	}{
+		{"(;SZ[9];B[aa];W[Zc2]B[bb];B[cc])", RepairDropNode, []string{"Baa", "Bcc"}, [2]int{9, 9}, 1},
+		{"(;SZ[9];B[aa];W[Zc2]B[bb];B[cc])", RepairTruncate, []string{"Baa"}, [2]int{9, 9}, 1},
+		{"(;SZ[9];B[aa];W[Zc2]B[bb];B[cc])", RepairAll, []string{"Baa"}, [2]int{9, 9}, 1},
+		{"(;SZ[9];B[aa]];W[bb])", RepairDropNode, []string{"Wbb"}, [2]int{9, 9}, 1},
+		{"(;SZ[9]SZ[13]KM[0]KM[7];B[aa])", RepairDuplicates, []string{"Baa"}, [2]int{9, 9}, 2},
+		{"(;SZ[9];B[aa];W[bb]", RepairCloseParens, []string{"Baa", "Wbb"}, [2]int{9, 9}, 1},
+		{"(;SZ[9];B[aa](;W[bb];B[c", RepairCloseParens, []string{"Baa", "Wbb"}, [2]int{9, 9}, 1},
+		{"(;SZ[9x]PB[me];B[aa])", RepairDropNode, []string{"Baa"}, [2]int{19, 19}, 1},
+	}
+	for _, c := range cases {
+		gs, err := GrabWithOptions(c.sgfText, Options{Repair: c.repair})
+		if err != nil {
+			t.Errorf("%q: %v", c.sgfText, err)
+			continue
+		}
+		if len(gs) != 1 {
+			t.Errorf("%q: got %d games, want 1", c.sgfText, len(gs))
+			continue
+		}
+		expect := GameData{Size: c.size, Moves: c.moves, Repairs: gs[0].Repairs}
+		if !gs[0].Equals(expect) || (len(gs[0].Repairs) != c.repairs) {
+			t.Errorf("%q:\ngot:\n%#v\n\nwant:\n%#v with %d repairs", c.sgfText, gs[0], expect, c.repairs)
+		}
+		if gs[0].BlackPlayer != "" {
+			t.Errorf("%q: dropped node kept player name", c.sgfText)
+		}
+	}
+
+	// Without the repair, errors are unchanged
+	if _, err := GrabWithOptions("(;SZ[9];B[aa];W[Zc2])", Options{Repair: RepairDuplicates}); err == nil {
+		t.Error("no error on bad move without truncation")
+	}
+	if gs, err := Grab("(;SZ[9];B[aa]"); (err != nil) || (len(gs) != 0) {
+		t.Error("unclosed game returned without repair")
+	}
+}
+
+func TestHandicapCheck(t *testing.T) {
+	sgfText := "(;HA[1];AB[aa];AB[ab])"
 	g, err := Grab(sgfText)
+	if (err != nil) || (len(g) != 1) || (g[0].Handicap != 1) || (len(g[0].Setup) != 2) {
+		t.Error("setup stones not kept separate from handicap")
+	}
+
+	sgfText = "(;AB[aa]AW[bb])"
+	g, err = Grab(sgfText)
+	if (err != nil) || (len(g) != 1) || (g[0].Handicap != 0) {
+		t.Error("handicap inferred from white setup stone")
+	}
+
+	sgfText = "(;AB[aa]PL[B])"
+	g, err = Grab(sgfText)
+	if (err != nil) || (len(g) != 1) || (g[0].Handicap != 0) {
+		t.Error("handicap inferred with black to play")
+	}
+
+	sgfText = "(;AB[bb])"
+	g, err = Grab(sgfText)
 	if (err != nil) || (len(g) != 1) || (g[0].Handicap != 1) {
 		t.Error("no handicap not corrected")
 	}
@@ -113,10 +212,47 @@ func TestHandicapCheck(t *testing.T) {
 	if (err != nil) || (len(g) != 1) || (g[0].Handicap != 1) || (len(g[0].Setup) != 1) || (g[0].Setup[0] != "Bab") {
 		t.Error("mislabeled setup stones not corrected")
 	}
+
+	sgfText = "(;HA[2];B[];B[ab];W[cc])"
+	g, err = Grab(sgfText)
+	if (err != nil) || (len(g) != 1) || (len(g[0].Setup) != 0) || (len(g[0].Moves) != 3) {
+		t.Errorf("pass taken for a setup stone: %v", g)
+	}
+}
+
+func TestSetupPosition(t *testing.T) {
+	sgfText := "(;SZ[9]AB[aa][bc:cd]AW[ee]AE[ff]PL[w];W[gg]PL[B];B[hh])"
+	gs, err := Grab(sgfText)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(gs) != 1 {
+		t.Fatalf("got %d games, want 1", len(gs))
+	}
+	expect := GameData{
+		Size:   [2]int{9, 9},
+		Setup:  []string{"Baa", "Bbc", "Bbd", "Bcc", "Bcd", "Wee", "Eff"},
+		Player: "W",
+		Moves:  []string{"Wgg", "Bhh"},
+	}
+	if !gs[0].Equals(expect) {
+		t.Errorf("\ngot:\n%#v\n\nwant:\n%#v", gs[0], expect)
+	}
+
+	sgfText = "(;B[aa];AW[bb])"
+	if _, err := Grab(sgfText); !errors.Is(err, ErrSetupAfterMoves) {
+		t.Errorf("unexpected error on setup after moves: %v", err)
+	}
+
+	for _, sgfText := range []string{"(;AB[cc:aa])", "(;AB[aa:bb:cc])", "(;AE[a])", "(;AW[a~])"} {
+		if _, err := Grab(sgfText); err == nil {
+			t.Errorf("no error on bad setup %q", sgfText)
+		}
+	}
 }
 
 func TestRootProperties(t *testing.T) {
-	sgfText := "(;SZ[9:10]KM[0.5]HA[2]RE[B+20.5]PB[me]PW[you]BR[4k]WR[9p]TM[200]OT[something]DT[2020-01-01];AB[cc][dd](;B[ab];W[bA];B[tt](;W[])(;W[cc])))"
+	sgfText := "(;SZ[9:10]KM[0.5]HA[2]RE[B+20.5]PB[me]PW[you]BR[4k]WR[9p]TM[200]OT[something]DT[2020-01-01];AB[cc][dd](;B[ab];W[bi];B[tt](;W[])(;W[cc])))"
 	gs, err := Grab(sgfText)
 	if err != nil {
 		t.Error(err)
@@ -126,26 +262,160 @@ func TestRootProperties(t *testing.T) {
 	}
 	g := gs[0]
 	expect := GameData{
-		Size:        [2]int{10, 9},
-		Komi:        0.5,
-		Handicap:    2,
-		Winner:      "B",
-		Score:       20.5,
-		End:         "Scored",
-		BlackPlayer: "me",
-		WhitePlayer: "you",
-		BlackRank:   "4k",
-		WhiteRank:   "9p",
-		Time:        200,
-		Year:        2020,
-		Moves:       []string{"Bab", "WbA", "B", "W"},
-		Setup:       []string{"Bcc", "Bdd"},
+		Size:           [2]int{10, 9},
+		Komi:           0.5,
+		Handicap:       2,
+		Winner:         "B",
+		Score:          20.5,
+		End:            "Scored",
+		BlackPlayer:    "me",
+		WhitePlayer:    "you",
+		BlackRank:      "4k",
+		WhiteRank:      "9p",
+		BlackRankValue: &Rank{Value: -3},
+		WhiteRankValue: &Rank{Value: 10, Pro: true},
+		Time:           200,
+		Year:           2020,
+		Date:           &DateRange{Date{2020, 1, 1}, Date{2020, 1, 1}, "day"},
+		Moves:          []string{"Bab", "Wbi", "B", "W"},
+		Setup:          []string{"Bcc", "Bdd"},
 	}
 	if !g.Equals(expect) {
 		t.Errorf("\ngot:\n%#v\n\nwant:\n%#v", g, expect)
 	}
 }
 
+func TestOutsideBoard(t *testing.T) {
+	for _, sgfText := range []string{"(;SZ[9];B[aa];W[zz])", "(;SZ[9:13];B[ja])", "(;SZ[9:13];B[an])", "(;SZ[9]AB[hh:jj])", "(;SZ[19:25];B[tt])", "(;B[aa]SZ[5];W[ff])"} {
+		_, err := Grab(sgfText)
+		var outsideErr ErrOutsideBoard
+		if !errors.As(err, &outsideErr) {
+			t.Errorf("unexpected error on move outside board %q: %v", sgfText, err)
+		}
+	}
+
+	sgfText := "(;SZ[9];B[aa];W[zz];B[bb])"
+	gs, err := GrabWithOptions(sgfText, Options{Repair: RepairTruncate})
+	if (err != nil) || (len(gs) != 1) || (len(gs[0].Moves) != 1) {
+		t.Errorf("move outside board not truncated: %v", err)
+	}
+
+	sgfText = "(;SZ[19:13]AB[tt][aa];B[tt];W[];B[ ];W[sm];B[aZ])"
+	if _, err := Grab(sgfText); err == nil {
+		t.Error("no error on uppercase coordinate outside board")
+	}
+	sgfText = "(;SZ[19:13]AB[tt][aa];B[tt];W[];B[ ];W[sm])"
+	gs, err = Grab(sgfText)
+	if err != nil {
+		t.Error(err)
+	}
+	expect := GameData{Size: [2]int{13, 19}, Setup: []string{"Baa"}, Handicap: 1, Moves: []string{"B", "W", "B", "Wsm"}}
+	if (len(gs) != 1) || !gs[0].Equals(expect) {
+		t.Errorf("\ngot:\n%#v\n\nwant:\n%#v", gs, expect)
+	}
+
+	sgfText = "(;SZ[52];B[tt];W[ZZ])"
+	gs, err = Grab(sgfText)
+	if (err != nil) || (len(gs) != 1) || (len(gs[0].Moves) != 2) || (gs[0].Moves[0] != "Btt") {
+		t.Errorf("tt not kept on large board: %v", err)
+	}
+}
+
+func TestRegisterProperty(t *testing.T) {
+	gc := properties["GC"]
+	defer func() {
+		properties["GC"] = gc
+		delete(properties, "GID")
+		delete(properties, "XT")
+	}()
+	if !IsBuiltinProperty("GC") || !IsBuiltinProperty("PB") || IsBuiltinProperty("GID") {
+		t.Error("built-in properties not recognized")
+	}
+	RegisterProperty("GID", DuplicateKeepLast, ExtraProperty(func(v string) (interface{}, error) {
+		return strconv.Atoi(v)
+	}))
+	RegisterProperty("XT", DuplicateAll, ExtraList(nil))
+	RegisterProperty("GC", DuplicateKeepFirst, ExtraProperty(nil))
+
+	sgfText := "(;GID[12]GID[x]GID[34]XT[a]GC[ranked]GC[free];XT[ b ];B[aa])"
+	gs, err := Grab(sgfText)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(gs) != 1 {
+		t.Fatalf("got %d games, want 1", len(gs))
+	}
+	expect := GameData{
+		Size:  [2]int{19, 19},
+		Moves: []string{"Baa"},
+		Extra: map[string]interface{}{"GID": 34, "XT": []interface{}{"a", "b"}, "GC": "ranked"},
+	}
+	if !gs[0].Equals(expect) {
+		t.Errorf("\ngot:\n%#v\n\nwant:\n%#v", gs[0], expect)
+	}
+	b, err := json.Marshal(gs[0])
+	if (err != nil) || !strings.Contains(string(b), `"Extra":{"GC":"ranked","GID":34,"XT":["a","b"]}`) {
+		t.Errorf("unexpected json %s: %v", b, err)
+	}
+	if !IsBuiltinProperty("GC") || IsBuiltinProperty("GID") {
+		t.Error("registering changed the built-in properties")
+	}
+}
+
+func TestContentID(t *testing.T) {
+	grab := func(sgfText string, opts Options) GameData {
+		gs, err := GrabWithOptions(sgfText, opts)
+		if (err != nil) || (len(gs) != 1) {
+			t.Fatalf("failed to grab %q: %v", sgfText, err)
+		}
+		return gs[0]
+	}
+	sgfText := "(;SZ[9]KM[7]PB[Ann]PW[Bob]BR[3d]DT[2012-05-06]RE[W+R]AB[cc][gg];W[ee]C[nice];B[ff])"
+	g := grab(sgfText, Options{})
+	id := g.ContentID()
+	if id != 0x1e3a3a6de908e6a9 { // IDs must not change between versions
+		t.Errorf("ContentID changed to %#x", id)
+	}
+
+	// Same ID with text kept, setup in a different order, or other formatting
+	same := []string{
+		"(;SZ[9]KM[7]PB[Ann]PW[Bob]BR[3d]DT[2012-05-06]RE[W+R]AB[gg][cc]GC[a comment];W[ee];B[ff])",
+		"(;SZ[9]\n KM[7.0]PW[Bob]PB[Ann]BR[3d]DT[2012-05-06]RE[W+Resign]AB[cc]AB[gg]\n;W[ee](;B[ff])(;B[aa]))",
+	}
+	if g2 := grab(sgfText, Options{KeepText: true}); g2.ContentID() != id {
+		t.Error("ContentID depends on KeepText")
+	}
+	longText := "(;PB[Ann Marie Beatrice Charlotte Delacroix]C[" + strings.Repeat("long comment ", 5) + "])"
+	short, long := grab(longText, Options{}), grab(longText, Options{KeepText: true})
+	if (short.BlackPlayer != long.BlackPlayer) || (short.ContentID() != long.ContentID()) {
+		t.Errorf("long player name %q cut without KeepText", short.BlackPlayer)
+	}
+	for _, s := range same {
+		if g2 := grab(s, Options{}); g2.ContentID() != id {
+			t.Errorf("ContentID differs for %q", s)
+		}
+	}
+
+	// Different ID with different moves, metadata, or source
+	different := []string{
+		"(;SZ[9]KM[7]PB[Ann]PW[Bob]BR[3d]DT[2012-05-06]RE[W+R]AB[cc][gg];W[ee];B[fg])",
+		"(;SZ[9]KM[7]PB[Ann]PW[Bob]BR[3d]DT[2012-05-06]RE[W+R]AB[cc][gg];W[ee];B[ff];W[])",
+		"(;SZ[9]KM[6.5]PB[Ann]PW[Bob]BR[3d]DT[2012-05-06]RE[W+R]AB[cc][gg];W[ee];B[ff])",
+		"(;SZ[9]KM[7]PB[Ann]PW[Bob]BR[3d]DT[2012-05-07]RE[W+R]AB[cc][gg];W[ee];B[ff])",
+		"(;SZ[9]KM[7]PB[Bob]PW[Ann]BR[3d]DT[2012-05-06]RE[W+R]AB[cc][gg];W[ee];B[ff])",
+		"(;SZ[9]KM[7]PB[Ann]PW[Bob]BR[3d]DT[2012-05-06]RE[B+R]AB[cc][gg];W[ee];B[ff])",
+	}
+	for _, s := range different {
+		if g2 := grab(s, Options{}); g2.ContentID() == id {
+			t.Errorf("ContentID is the same for %q", s)
+		}
+	}
+	g.Source = "kgs"
+	if g.ContentID() == id {
+		t.Error("ContentID does not depend on Source")
+	}
+}
+
 func TestMultipleGames(t *testing.T) {
 	sgfText := "(;SZ[3:2])(;SZ[9])"
 	gs, err := Grab(sgfText)
@@ -211,6 +481,598 @@ func TestTrivial(t *testing.T) {
 	}
 }
 
+func TestKeepText(t *testing.T) {
+	sgfText := "(;PB[A Player Whose Name Is Quite A Bit Longer Than Thirty]GN[Friendly\\]]EV[Cup]RO[3]PC[Here]RU[Japanese]SO[Book]DT[2020-01-01,02]GC[Soft\\\nbreak]C[root];B[aa]C[one\r\ntwo];C[first]W[bb]C[second](;B[cc]C[main])(;B[dd]C[variation]))"
+	gs, err := GrabWithOptions(sgfText, Options{KeepText: true})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(gs) != 1 {
+		t.Fatalf("got %d games, want 1", len(gs))
+	}
+	expect := GameData{
+		Size:         [2]int{19, 19},
+		BlackPlayer:  "A Player Whose Name Is Quite A Bit Longer Than Thirty",
+		Year:         2020,
+		Date:         &DateRange{Date{2020, 1, 1}, Date{2020, 1, 2}, "day"},
+		Moves:        []string{"Baa", "Wbb", "Bcc"},
+		GameName:     "Friendly]",
+		Event:        "Cup",
+		Round:        "3",
+		Place:        "Here",
+		Rules:        "Japanese",
+		Ruleset:      "JPN",
+		RecordSource: "Book",
+		DateText:     "2020-01-01,02",
+		GameComment:  "Softbreak",
+		Comments:     []Comment{{0, "root"}, {1, "one\ntwo"}, {2, "first\nsecond"}, {3, "main"}},
+	}
+	if !gs[0].Equals(expect) {
+		t.Errorf("\ngot:\n%#v\n\nwant:\n%#v", gs[0], expect)
+	}
+
+	// Default mode ignores text fields, but keeps long values of the fields in ContentID
+	gs, err = Grab(sgfText)
+	if err != nil {
+		t.Error(err)
+	}
+	if (len(gs) != 1) || (gs[0].GameName != "") || (len(gs[0].Comments) != 0) || (gs[0].BlackPlayer != expect.BlackPlayer) {
+		t.Errorf("text fields recorded without KeepText: %#v", gs)
+	}
+
+	// Comments follow moves that turn out to be handicap stones
+	gs, err = GrabWithOptions("(;HA[2]C[root];B[aa]C[one];B[bb]C[two];W[cc]C[three])", Options{KeepText: true})
+	if err != nil {
+		t.Error(err)
+	}
+	expectComments := []Comment{{0, "root"}, {0, "one"}, {0, "two"}, {1, "three"}}
+	if (len(gs) != 1) || !gs[0].Equals(GameData{Size: [2]int{19, 19}, Handicap: 2, Setup: []string{"Baa", "Bbb"}, Moves: []string{"Wcc"}, Comments: expectComments}) {
+		t.Errorf("comments not shifted with handicap stones: %#v", gs)
+	}
+}
+
+func TestParseDateRange(t *testing.T) {
+	testTable := []struct {
+		v      string
+		start  Date
+		end    Date
+		prec   string
+		failed bool
+	}{
+		{v: "2016-03-13", start: Date{2016, 3, 13}, end: Date{2016, 3, 13}, prec: "day"},
+		{v: "2016", start: Date{2016, 0, 0}, end: Date{2016, 0, 0}, prec: "year"},
+		{v: "1976-08-12,13", start: Date{1976, 8, 12}, end: Date{1976, 8, 13}, prec: "day"},
+		{v: "1996-05,06", start: Date{1996, 5, 0}, end: Date{1996, 6, 0}, prec: "month"},
+		{v: "1996-12-27,28,1997-01-03,04", start: Date{1996, 12, 27}, end: Date{1997, 1, 4}, prec: "day"},
+		{v: "1996-05-30,06-02", start: Date{1996, 5, 30}, end: Date{1996, 6, 2}, prec: "day"},
+		{v: "2016/3/13 10:00:00", start: Date{2016, 3, 13}, end: Date{2016, 3, 13}, prec: "day"},
+		{v: "2016.03.13", start: Date{2016, 3, 13}, end: Date{2016, 3, 13}, prec: "day"},
+		{v: "20160313", start: Date{2016, 3, 13}, end: Date{2016, 3, 13}, prec: "day"},
+		{v: "2016-03-13T10:00:00Z", start: Date{2016, 3, 13}, end: Date{2016, 3, 13}, prec: "day"},
+		{v: "2016年3月13日", start: Date{2016, 3, 13}, end: Date{2016, 3, 13}, prec: "day"},
+		{v: "2016年3月", start: Date{2016, 3, 0}, end: Date{2016, 3, 0}, prec: "month"},
+		{v: "2016년 3월 13일", start: Date{2016, 3, 13}, end: Date{2016, 3, 13}, prec: "day"},
+		{v: "2016. 3. 13.", start: Date{2016, 3, 13}, end: Date{2016, 3, 13}, prec: "day"},
+		{v: "2016-02-30", start: Date{2016, 0, 0}, end: Date{2016, 0, 0}, prec: "year"},
+		{v: "1996 spring", start: Date{1996, 0, 0}, end: Date{1996, 0, 0}, prec: "year"},
+		{v: "202", failed: true},
+		{v: "0000", failed: true},
+		{v: "0000-03-13", failed: true},
+		{v: "March 2016", failed: true},
+	}
+	for _, test := range testTable {
+		r, err := ParseDateRange(test.v)
+		if test.failed {
+			if err == nil {
+				t.Errorf("no error parsing %q", test.v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("error parsing %q: %s", test.v, err)
+		}
+		if (r.Start != test.start) || (r.End != test.end) || (r.Precision != test.prec) {
+			t.Errorf("parsed %q as %v to %v (%s), want %v to %v (%s)", test.v, r.Start, r.End, r.Precision, test.start, test.end, test.prec)
+		}
+	}
+}
+
+func TestParseRankValue(t *testing.T) {
+	testTable := []struct {
+		v      string
+		rank   Rank
+		s      string
+		failed bool
+	}{
+		{v: "30k", rank: Rank{Value: -29}, s: "30k"},
+		{v: "1k", rank: Rank{Value: 0}, s: "1k"},
+		{v: "1d", rank: Rank{Value: 1}, s: "1d"},
+		{v: "3d?", rank: Rank{Value: 3, Provisional: true}, s: "3d"},
+		{v: "9p", rank: Rank{Value: 10, Pro: true}, s: "9p"},
+		{v: "P3d", rank: Rank{Value: 8, Pro: true}, s: "3p"},
+		{v: "5段", rank: Rank{Value: 5}, s: "5d"},
+		{v: "?", rank: Rank{Unranked: true}, s: "?"},
+		{v: "[-]", rank: Rank{Unranked: true}, s: "?"},
+		{v: "NR", rank: Rank{Unranked: true}, s: "?"},
+		{v: "master", failed: true},
+	}
+	for _, test := range testTable {
+		r, err := ParseRankValue("B", test.v)
+		if test.failed {
+			if err == nil {
+				t.Errorf("no error parsing %q", test.v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("error parsing %q: %s", test.v, err)
+		}
+		if (r != test.rank) || (r.String() != test.s) {
+			t.Errorf("parsed %q as %#v (%s), want %#v (%s)", test.v, r, r, test.rank, test.s)
+		}
+	}
+
+	// Ordering and normalization
+	k1, _ := ParseRankValue("B", "1k")
+	d1, _ := ParseRankValue("B", "1d")
+	p1, _ := ParseRankValue("B", "1p")
+	unranked, _ := ParseRankValue("B", "?")
+	if !unranked.Less(k1) || !k1.Less(d1) || !d1.Less(p1) || p1.Less(d1) || k1.Less(unranked) {
+		t.Error("ranks ordered incorrectly")
+	}
+	if (d1.Normalize("Fox").Value != 1+RankOffsets["fox"]) || (d1.Normalize("nowhere") != d1) || (p1.Normalize("Fox") != p1) {
+		t.Error("ranks normalized incorrectly")
+	}
+}
+
+func TestParseResult(t *testing.T) {
+	testTable := []struct {
+		v      string
+		winner string
+		score  float64
+		end    string
+		failed bool
+	}{
+		{v: "B+R", winner: "B", end: "Resign"},
+		{v: "W+Resign ", winner: "W", end: "Resign"},
+		{v: "w+t", winner: "W", end: "Time"},
+		{v: "B+F", winner: "B", end: "Forfeit"},
+		{v: "W+12.5", winner: "W", score: 12.5, end: "Scored"},
+		{v: "B+3.5 points", winner: "B", score: 3.5, end: "Scored"},
+		{v: "W+6.5 (counting)", winner: "W", score: 6.5, end: "Scored"},
+		{v: "B+", winner: "B"},
+		{v: "0", end: "Draw"},
+		{v: "Draw", end: "Draw"},
+		{v: "Jigo", end: "Draw"},
+		{v: "W+0", end: "Draw"},
+		{v: "Void", end: "Void"},
+		{v: "?", end: "Unknown"},
+		{v: "", end: "Unknown"},
+		{v: "黑中盘胜", winner: "B", end: "Resign"},
+		{v: "白超时胜", winner: "W", end: "Time"},
+		{v: "黑胜", winner: "B"},
+		{v: "白胜3又1/4子", winner: "W", score: 6.5, end: "Scored"},
+		{v: "黑胜3/4子", winner: "B", score: 1.5, end: "Scored"},
+		{v: "黑胜2.5目", winner: "B", score: 2.5, end: "Scored"},
+		{v: "白负", winner: "B"},
+		{v: "和棋", end: "Draw"},
+		{v: "黒1目半勝ち", winner: "B", score: 1.5, end: "Scored"},
+		{v: "白中押し勝ち", winner: "W", end: "Resign"},
+		{v: "백 불계승", winner: "W", end: "Resign"},
+		{v: "흑 반집승", winner: "B", score: 0.5, end: "Scored"},
+		{v: "흑 3.5집승", winner: "B", score: 3.5, end: "Scored"},
+		{v: "Black wins by resignation", winner: "B", end: "Resign"},
+		{v: "White wins by 2.5 points!", winner: "W", score: 2.5, end: "Scored"},
+		{v: "White wins a close game", winner: "W"},
+		{v: "Black lost on time", winner: "W", end: "Time"},
+		{v: "White loses by 3.5", winner: "B", score: 3.5, end: "Scored"},
+		{v: "Black wins after avoiding a ko", winner: "B"},
+		{v: "Black resigns", winner: "W", end: "Resign"},
+		{v: "White resigned", winner: "B", end: "Resign"},
+		{v: "white forfeits", winner: "B", end: "Forfeit"},
+		{v: "Black forfeited", winner: "W", end: "Forfeit"},
+		{v: "black timeout", winner: "W", end: "Time"},
+		{v: "White on time", winner: "B", end: "Time"},
+		{v: "Black wins on time", winner: "B", end: "Time"},
+		{v: "黑认输", winner: "W", end: ""},
+		{v: "B wins", winner: "B"},
+		{v: "W wins by 2.5", winner: "W", score: 2.5, end: "Scored"},
+		{v: "b lost by 1.5", winner: "W", score: 1.5, end: "Scored"},
+		{v: "Black won't play", failed: true},
+		{v: "White to play", failed: true},
+		{v: "黑中盘", failed: true},
+		{v: "Z+10.5", failed: true},
+		{v: "B+1.2.3", failed: true},
+	}
+	for _, test := range testTable {
+		winner, score, end, err := ParseResult(test.v)
+		if test.failed {
+			if err == nil {
+				t.Errorf("no error parsing %q", test.v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("error parsing %q: %s", test.v, err)
+		}
+		if (winner != test.winner) || (score != test.score) || (end != test.end) {
+			t.Errorf("parsed %q as %q %v %q, want %q %v %q", test.v, winner, score, end, test.winner, test.score, test.end)
+		}
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	testTable := map[string]string{
+		"Japanese": "JPN", "japanese": "JPN", "Chinese": "CHN", "AGA": "AGA", "NZ": "NZ",
+		"New Zealand": "NZ", "Korean": "KOR", "Ing": "ING", "GOE": "ING", "tromp-taylor": "TT",
+		"Tromp Taylor": "TT", "Japanese rules": "JPN", "中国": "CHN",
+	}
+	for v, expect := range testTable {
+		if ruleset, err := ParseRules(v); (err != nil) || (ruleset != expect) {
+			t.Errorf("parsed %q as %q (%v), want %q", v, ruleset, err, expect)
+		}
+	}
+	if _, err := ParseRules("house rules"); err == nil {
+		t.Error("no error on unknown ruleset")
+	}
+}
+
+func TestNormalizeCharset(t *testing.T) {
+	testTable := map[string]string{
+		"UTF-8": "UTF-8", "gb2312": "GBK", "GBK": "GBK", "cp936": "GBK", "Big5": "Big5",
+		"Shift_JIS": "Shift_JIS", "euc-kr": "EUC-KR", "latin1": "ISO-8859-1",
+		"GB18030": "", "HZ-GB-2312": "", "koi8-r": "",
+	}
+	for v, expect := range testTable {
+		if charset := NormalizeCharset(v); charset != expect {
+			t.Errorf("normalized %q as %q, want %q", v, charset, expect)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	testTable := []struct {
+		sgf     string
+		charset string
+		player  string
+		rank    string
+	}{
+		{"(;CA[gb2312]PB[\xbf\xc2\xbd\xe0]BR[\xc8\xfd\xb6\xce])", "GBK", "柯洁", "3d"},
+		{"(;CA[Big5]PB[\xac\x5f\xbc\xe4])", "Big5", "柯潔", ""},
+		{"(;CA[SJIS]PB[\x95\x5c\x88\xe4\x8e\x52])", "Shift_JIS", "表井山", ""},            // Trail byte is a backslash
+		{"(;PB[\xc0\xcc\xbc\xbc\xb5\xb9]BR[\xce\xfa\xd3\xab])", "EUC-KR", "이세돌", "9d"}, // Detected
+		{"(;CA[GBK]PB[柯洁]BR[三段])", "UTF-8", "柯洁", "3d"},
+		{"(;CA[EUC-KR]PB[\xc0\xcc\xbc\xbc\xb5\xb9]BR[9\xb4\xdc])", "EUC-KR", "이세돌", "9d"}, // Stale CA[]
+		{"(;CA[GB18030]PB[\xbf\xc2\xbd\xe0]BR[\xc8\xfd\xb6\xce])", "GBK", "柯洁", "3d"},     // Unsupported CA[], detected
+	}
+	for _, test := range testTable {
+		text, charset := Decode([]byte(test.sgf))
+		if charset != test.charset {
+			t.Errorf("decoded %q as %s, want %s", test.sgf, charset, test.charset)
+		}
+		gs, err := Grab(text)
+		if err != nil {
+			t.Error(err)
+		}
+		if (len(gs) != 1) || (gs[0].BlackPlayer != test.player) || (gs[0].BlackRank != test.rank) {
+			t.Errorf("got %#v, want player %q and rank %q", gs, test.player, test.rank)
+		}
+	}
+}
+
+func TestGIB(t *testing.T) {
+	gibText := "\\HS\r\n\\[GAMEBLACKNAME=Lee Sedol (9D)\\]\r\n\\[GAMEWHITENAME=Gu Li (9D)\\]\r\n" +
+		"\\[GAMEDATE=2016- 3-13-19-46-29\\]\r\n\\[GAMEINFOMAIN=GBKIND:3,GTYPE:0,GRLT:4,ZIPSU:0,GONGJE:65\\]\r\n\\HE\r\n" +
+		"\\GS\r\n2 1 0\r\nINI 0 1 2 &4\r\nSTO 0 2 2 15 3\r\nSKI 0 3\r\nSTO 0 4 2 2 2\r\n\\GE\r\n"
+	gs, err := GrabFile("game.GIB", []byte(gibText), Options{})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(gs) != 1 {
+		t.Fatalf("got %d games, want 1", len(gs))
+	}
+	expect := GameData{
+		Size:           [2]int{19, 19},
+		Komi:           6.5,
+		Handicap:       2,
+		Winner:         "W",
+		End:            "Resign",
+		BlackPlayer:    "Lee Sedol",
+		WhitePlayer:    "Gu Li",
+		BlackRank:      "9d",
+		WhiteRank:      "9d",
+		BlackRankValue: &Rank{Value: 9},
+		WhiteRankValue: &Rank{Value: 9},
+		Year:           2016,
+		Date:           &DateRange{Date{2016, 3, 13}, Date{2016, 3, 13}, "day"},
+		Setup:          []string{"Bpd", "Bdp"},
+		Moves:          []string{"Wpd", "B", "Wcc"},
+	}
+	if !gs[0].Equals(expect) {
+		t.Errorf("\ngot:\n%#v\n\nwant:\n%#v", gs[0], expect)
+	}
+
+	if _, err := GrabGIB("\\GS\nSTO 0 2 3 15 3\n\\GE\n", Options{}); err == nil {
+		t.Error("no error on bad color")
+	}
+
+	// Handicap stones of a converted game are a fixed handicap
+	gibText = strings.Replace(gibText, "INI 0 1 2 &4", "INI 0 1 3 &4", 1)
+	gs, err = GrabFile("game.GIB", []byte(gibText), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := weiqi.CheckFixedHandicap(gs[0].Size[0], gs[0].Size[1], gs[0].Handicap, gs[0].Setup); err != nil {
+		t.Errorf("handicap 3 setup %v: %s", gs[0].Setup, err)
+	}
+}
+
+func TestNGF(t *testing.T) {
+	ngfText := "Friendly game\n19\nwhiteplayer 3D*\nblackplayer 5K\nhttp://www.cyberoro.com\n0\n0\n6.5\n20020416 [14:32]\n0\nWhite wins by resignation!\n3\n" +
+		"PMABBQEEQ\nPMACWEQQE\nPMADBAAAA\n"
+	gs, err := GrabFile("game.ngf", []byte(ngfText), Options{KeepText: true})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(gs) != 1 {
+		t.Fatalf("got %d games, want 1", len(gs))
+	}
+	expect := GameData{
+		Size:           [2]int{19, 19},
+		Komi:           6.5,
+		Winner:         "W",
+		End:            "Resign",
+		BlackPlayer:    "blackplayer",
+		WhitePlayer:    "whiteplayer",
+		BlackRank:      "5k",
+		WhiteRank:      "3d",
+		BlackRankValue: &Rank{Value: -4},
+		WhiteRankValue: &Rank{Value: 3, Provisional: true},
+		Year:           2002,
+		Date:           &DateRange{Date{2002, 4, 16}, Date{2002, 4, 16}, "day"},
+		GameName:       "Friendly game",
+		DateText:       "20020416 [14:32]",
+		Moves:          []string{"Bpd", "Wdp", "B"},
+	}
+	if !gs[0].Equals(expect) {
+		t.Errorf("\ngot:\n%#v\n\nwant:\n%#v", gs[0], expect)
+	}
+
+	if _, err := GrabNGF("Friendly game\n19\n", Options{}); !errors.Is(err, ErrSyntax) {
+		t.Errorf("unexpected error on short header: %v", err)
+	}
+
+	// Moves off the board are errors, or repaired, not passes
+	offBoard := ngfText + "PMAEWZZZZ\n"
+	var parseErr ErrParse
+	if _, err := GrabNGF(offBoard, Options{}); !errors.As(err, &parseErr) {
+		t.Errorf("unexpected error on move off the board: %v", err)
+	}
+	gs, err = GrabNGF(offBoard, Options{Repair: RepairDropNode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (len(gs[0].Moves) != 3) || (len(gs[0].Repairs) != 1) {
+		t.Errorf("move off the board not dropped: moves %v, repairs %v", gs[0].Moves, gs[0].Repairs)
+	}
+}
+
+func TestUGF(t *testing.T) {
+	ugfText := "[Header]\nLang=JPN\nTitle=Some Cup,1\nDate=2003/03/08,11:00\nHdcp=2,0.5\nSize=9\nPlayerB=black,2d,\nPlayerW=white,1p,\nWinner=B,C\n" +
+		"[Data]\nCG,B0,0\nGC,B0,0\nGG,W1,0\nYA,B2,0\nAA,W3,0\n"
+	gs, err := GrabFile("game.ugi", []byte(ugfText), Options{})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(gs) != 1 {
+		t.Fatalf("got %d games, want 1", len(gs))
+	}
+	expect := GameData{
+		Size:           [2]int{9, 9},
+		Komi:           0.5,
+		Handicap:       2,
+		Winner:         "B",
+		End:            "Resign",
+		BlackPlayer:    "black",
+		WhitePlayer:    "white",
+		BlackRank:      "2d",
+		WhiteRank:      "1p",
+		BlackRankValue: &Rank{Value: 2},
+		WhiteRankValue: &Rank{Value: 7 + 1.0/3, Pro: true},
+		Year:           2003,
+		Date:           &DateRange{Date{2003, 3, 8}, Date{2003, 3, 8}, "day"},
+		Setup:          []string{"Bcc", "Bgg"},
+		Moves:          []string{"Wgc", "B", "Wai"},
+	}
+	if !gs[0].Equals(expect) {
+		t.Errorf("\ngot:\n%#v\n\nwant:\n%#v", gs[0], expect)
+	}
+
+	if _, err := GrabFile("game.txt", []byte(ugfText), Options{}); err == nil {
+		t.Error("no error on unknown extension")
+	}
+	if _, err := GrabFile("game.ugi", []byte(ugfText+"KA,B4,0\n"), Options{}); err == nil {
+		t.Error("no error on move off the board")
+	}
+}
+
+func TestHandicapPoints(t *testing.T) {
+	cases := []struct {
+		size     int
+		handicap int
+		points   []string
+	}{
+		{19, 2, []string{"pd", "dp"}},
+		{19, 3, []string{"pd", "dp", "pp"}},
+		{19, 5, []string{"pd", "dp", "pp", "dd", "jj"}},
+		{19, 8, []string{"pd", "dp", "pp", "dd", "dj", "pj", "jd", "jp"}},
+		{13, 9, []string{"jd", "dj", "jj", "dd", "dg", "jg", "gd", "gj", "gg"}},
+		{9, 4, []string{"gc", "cg", "gg", "cc"}},
+	}
+	for _, c := range cases {
+		points, err := handicapPoints([2]int{c.size, c.size}, c.handicap)
+		if err != nil {
+			t.Error(err)
+		}
+		if strings.Join(points, " ") != strings.Join(c.points, " ") {
+			t.Errorf("handicap %d on %d: got %v, want %v", c.handicap, c.size, points, c.points)
+		}
+	}
+	if _, err := handicapPoints([2]int{8, 8}, 5); err == nil {
+		t.Error("no error on too many handicap stones")
+	}
+}
+
+// addSeedCorpus adds the SGFs in testdata to a fuzz target (the long example games
+// would make minimizing slow)
+func addSeedCorpus(f *testing.F) {
+	names, err := filepath.Glob(filepath.Join("testdata", "*.sgf"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, name := range names {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+}
+
+// checkGames checks invariants of grabbed games
+func checkGames(t *testing.T, gs []GameData, err error) {
+	if err != nil {
+		var grabErr GrabError
+		if !errors.As(err, &grabErr) {
+			t.Errorf("error %v is not a GrabError", err)
+		}
+		if len(gs) != 0 {
+			t.Errorf("got %d games with error", len(gs))
+		}
+		return
+	}
+	for _, g := range gs {
+		if (g.Size[0] < 1) || (g.Size[1] < 1) {
+			t.Errorf("bad size %v", g.Size)
+		}
+		if (g.Handicap < 0) || (g.Time < 0) || (g.Score < 0) || math.IsNaN(g.Komi) || math.IsInf(g.Komi, 0) {
+			t.Errorf("bad numeric field in %#v", g)
+		}
+		if g.Length != len(g.Moves) {
+			t.Errorf("length %d with %d moves", g.Length, len(g.Moves))
+		}
+		for _, m := range g.Moves {
+			if !reGameMove.MatchString(m) || (checkOnBoard(m, g.Size) != nil) {
+				t.Errorf("bad move %q on %v board", m, g.Size)
+			}
+		}
+		for _, m := range g.Setup {
+			if !reSetup.MatchString(m) || (checkOnBoard(m, g.Size) != nil) {
+				t.Errorf("bad setup stone %q on %v board", m, g.Size)
+			}
+		}
+		if _, err := json.Marshal(g); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+var reGameMove = regexp.MustCompile("^[BW]([a-zA-Z]{2})?$")
+var reSetup = regexp.MustCompile("^[BWE][a-zA-Z]{2}$")
+
+func FuzzGrab(f *testing.F) {
+	addSeedCorpus(f)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		sgfText, _ := Decode(b)
+		if !utf8.ValidString(sgfText) {
+			t.Errorf("decoded text is not UTF-8: %q", sgfText)
+		}
+		gs, err := Grab(sgfText)
+		checkGames(t, gs, err)
+		gs, err = GrabWithOptions(sgfText, Options{KeepText: true, Repair: RepairAll})
+		checkGames(t, gs, err)
+	})
+}
+
+func FuzzGrabFile(f *testing.F) {
+	f.Add(uint8(0), []byte("\\[GAMEINFOMAIN=GRLT:0,ZIPSU:35,GONGJE:65\\]\nINI 0 1 3 &4\nSTO 0 2 2 15 3\nSKI 0 3\n"))
+	f.Add(uint8(1), []byte("title\n19\nw 3D*\nb 5K\nsite\n2\n0\n0.5\n20020416\n0\nBlack wins by 3.5 points\n2\nPMABWQEEQ\nPMACBAAAA\n"))
+	f.Add(uint8(2), []byte("[Header]\nHdcp=2,0.5\nSize=9\nWinner=B,C\n[Data]\nCG,B0,0\nGG,W1,0\nYA,B2,0\n"))
+	extensions := []string{".gib", ".ngf", ".ugf", ".sgf"}
+	f.Fuzz(func(t *testing.T, ext uint8, b []byte) {
+		gs, err := GrabFile("game"+extensions[int(ext)%len(extensions)], b, Options{})
+		checkGames(t, gs, err)
+		gs, err = GrabFile("game"+extensions[int(ext)%len(extensions)], b, Options{Repair: RepairAll})
+		checkGames(t, gs, err)
+	})
+}
+
+func FuzzParse(f *testing.F) {
+	for _, v := range []string{"19", "19:13", "6.5", "3", "B+R", "W+3.5", "黑中盘胜", "Draw", "3k?", "P7d", "九段", "Japanese",
+		"1h30m", "2016-03-13", "1976-08-12,13", "2016年3月13日", "a\\]b\\\ncd", "pd", "tt", "aa:cc", "w", ""} {
+		f.Add(v)
+	}
+	f.Fuzz(func(t *testing.T, v string) {
+		if size, err := ParseSize(v); (err == nil) && ((size[0] < 1) || (size[1] < 1)) {
+			t.Errorf("ParseSize(%q) = %v", v, size)
+		}
+		if komi, err := ParseKomi(v); (err == nil) && (math.IsNaN(komi) || math.IsInf(komi, 0)) {
+			t.Errorf("ParseKomi(%q) = %v", v, komi)
+		}
+		if handicap, err := ParseHandicap(v); (err == nil) && (handicap < 0) {
+			t.Errorf("ParseHandicap(%q) = %v", v, handicap)
+		}
+		if winner, score, end, err := ParseResult(v); err == nil {
+			if (winner != "") && (winner != "B") && (winner != "W") || (score < 0) || math.IsNaN(score) {
+				t.Errorf("ParseResult(%q) = %q, %v, %q", v, winner, score, end)
+			}
+			switch end {
+			case "Scored", "Time", "Resign", "Forfeit", "Draw", "Void", "Unknown", "":
+			default:
+				t.Errorf("ParseResult(%q) end %q", v, end)
+			}
+		}
+		if rank, err := ParseRank("B", v); (err == nil) && !reRanks.MatchString(rank) {
+			t.Errorf("ParseRank(%q) = %q", v, rank)
+		}
+		if r, err := ParseRankValue("W", v); (err == nil) && (math.IsNaN(r.Value) || r.Less(r) || ((r.Pro || r.Unranked) && (r.Normalize("fox") != r))) {
+			t.Errorf("ParseRankValue(%q) = %v", v, r)
+		}
+		if ruleset, err := ParseRules(v); err == nil {
+			switch ruleset {
+			case "JPN", "CHN", "KOR", "AGA", "NZ", "ING", "TT":
+			default:
+				t.Errorf("ParseRules(%q) = %q", v, ruleset)
+			}
+		}
+		if seconds, err := ParseTime(v); (err == nil) && (seconds < 0) {
+			t.Errorf("ParseTime(%q) = %v", v, seconds)
+		}
+		if year, err := ParseDate(v); (err == nil) && ((year < 0) || (year > 9999)) {
+			t.Errorf("ParseDate(%q) = %v", v, year)
+		}
+		if r, err := ParseDateRange(v); (err == nil) && (!validDate(r.Start) || !validDate(r.End) || r.End.Before(r.Start)) {
+			t.Errorf("ParseDateRange(%q) = %v", v, r)
+		}
+		if text := ParseText(v); (text != strings.TrimSpace(text)) || strings.Contains(text, "\r") {
+			t.Errorf("ParseText(%q) = %q", v, text)
+		}
+		if m, err := ParseMove("B", v); (err == nil) && !reGameMove.MatchString(m) {
+			t.Errorf("ParseMove(%q) = %q", v, m)
+		}
+		if player, err := ParsePlayer(v); (err == nil) && (player != "B") && (player != "W") {
+			t.Errorf("ParsePlayer(%q) = %q", v, player)
+		}
+		if points, err := ParsePoints("E", v); err == nil {
+			for _, p := range points {
+				if !reSetup.MatchString(p) {
+					t.Errorf("ParsePoints(%q) = %q", v, points)
+				}
+			}
+		}
+	})
+}
+
 var alphaGoSgfText string = `(;GM[1]FF[4]CA[UTF-8]AP[CGoban:3]ST[2]
 	RU[Chinese]SZ[19]KM[7.50]TM[7200]OT[3x60 byo-yomi]
 	PW[Lee Sedol]PB[AlphaGo]WR[9p]DT[2016-03-13]C[Game 4 - Endurance
@@ -848,32 +1710,52 @@ var ogsSgfText string = `(;FF[4]
 	))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))))`
 
 var ogsGameData GameData = GameData{
-	Size:        [2]int{19, 19},
-	Komi:        7.5,
-	Handicap:    0,
-	Winner:      "B",
-	Score:       2.5,
-	End:         "Scored",
-	BlackRank:   "23k",
-	WhiteRank:   "19k",
-	BlackPlayer: "Spectral-7k",
-	WhitePlayer: "Spectral-10k",
-	Time:        600,
-	Year:        2019,
-	Moves:       []string{"Bpd", "Wdd", "Bdp", "Wpp", "Bqn", "Wnq", "Bpj", "Wnc", "Blc", "Wqc", "Bqd", "Wpc", "Bod", "Wnb", "Bme", "Wcn", "Bfq", "Wdj", "Bfc", "Wcf", "Bdb", "Wcc", "Bhd", "Wql", "Bpl", "Wqk", "Bpk", "Wqj", "Bqi", "Wri", "Bqh", "Wrh", "Bqg", "Wqm", "Bpm", "Wpn", "Bpo", "Won", "Bqp", "Woo", "Bqo", "Wpq", "Bqq", "Wrn", "Bro", "Wrm", "Bpr", "Wor", "Bqr", "Whq", "Bbp", "Who", "Bcl", "Wen", "Bel", "Wfj", "Bgl", "Whj", "Bil", "Wjj", "Bkl", "Wlj", "Bml", "Wlm", "Bll", "Wjm", "Bjl", "Whm", "Bhl", "Wfm", "Bfl", "Wkm", "Bmm", "Wmn", "Bim", "Win", "Bgm", "Wgn", "Bhn", "Wio", "Bgo", "Whm", "Bfo", "Wfn", "Bhn", "Weo", "Bep", "Whm", "Bln", "Wlo", "Bhn", "Wgp", "Bfp", "Whm", "Bjn", "Wkn", "Bhn", "Wco", "Bhm", "Wcp", "Bcq", "Wbo", "Bbq", "Wbl", "Bbk", "Wck", "Bdk", "Wcj", "Bbm", "Wbj", "Bal", "Wek", "Bdl", "Woi", "Bpi", "Wnk", "Bnl", "Wjc", "Bkd", "Wlb", "Bkb", "Wkc", "Bmb", "Wld", "Bla", "Wmc", "Blb", "Wjb", "Bmd", "Wle", "Bjd", "Wlf", "Bic", "Wib", "Bhb", "Wja", "Bha", "Wna", "Bia", "Wmf", "Bof", "Wnf", "Boe", "Wie", "Bhe", "Wif", "Bhf", "Wig", "Bhg", "Whh", "Bgh", "Wgi", "Bfh", "Wff", "Bef", "Wee", "Beg", "Wfd", "Bec", "Wcb", "Bcg", "Wbg", "Bch", "Wbh", "Bdf", "Wde", "Bei", "Wej", "Bci", "Wbi", "Bdi", "Wgr", "Bfr", "Wgq", "Bgs", "Whs", "Bfs", "Wir", "Brg", "Wrk", "Brc", "Wrb", "Brd", "Wsb", "Boc", "Wob", "Boh", "Wnh", "Bni", "Wmi", "Boj", "Wnj", "Bng", "Wmh", "Bca", "Wba", "Bda", "Wbb", "Bdc", "Wgd", "Bgc", "Wid", "Bka", "Wje", "Bke", "Wkf", "Bih", "Whi", "Bjh", "Wkg", "Bkh", "Wjg", "Bmg", "Wlg", "Bog", "Wlh", "Bmk", "Wmj", "Bsh", "Wsi", "Bsg", "Wso", "Bsp", "Wsn", "Brq", "Wps", "Bqs", "Wos", "Bnn", "Wno", "Bnm", "Waj", "Bak", "Wsc", "Bsd", "Wfg", "Bgg", "Wfi", "Beh", "Wgk", "Bik", "Wij", "Bkk", "Wkj", "Bom", "Wok", "Boi", "Wce", "Bgf", "Wfe", "Bnd", "Wpb", "B", "W"},
+	Size:           [2]int{19, 19},
+	Komi:           7.5,
+	Handicap:       0,
+	Winner:         "B",
+	Score:          2.5,
+	End:            "Scored",
+	BlackRank:      "23k",
+	WhiteRank:      "19k",
+	BlackRankValue: &Rank{Value: -22},
+	WhiteRankValue: &Rank{Value: -18},
+	BlackPlayer:    "Spectral-7k",
+	WhitePlayer:    "Spectral-10k",
+	Time:           600,
+	Year:           2019,
+	Date:           &DateRange{Date{2019, 6, 17}, Date{2019, 6, 17}, "day"},
+	Ruleset:        "CHN",
+	Moves:          []string{"Bpd", "Wdd", "Bdp", "Wpp", "Bqn", "Wnq", "Bpj", "Wnc", "Blc", "Wqc", "Bqd", "Wpc", "Bod", "Wnb", "Bme", "Wcn", "Bfq", "Wdj", "Bfc", "Wcf", "Bdb", "Wcc", "Bhd", "Wql", "Bpl", "Wqk", "Bpk", "Wqj", "Bqi", "Wri", "Bqh", "Wrh", "Bqg", "Wqm", "Bpm", "Wpn", "Bpo", "Won", "Bqp", "Woo", "Bqo", "Wpq", "Bqq", "Wrn", "Bro", "Wrm", "Bpr", "Wor", "Bqr", "Whq", "Bbp", "Who", "Bcl", "Wen", "Bel", "Wfj", "Bgl", "Whj", "Bil", "Wjj", "Bkl", "Wlj", "Bml", "Wlm", "Bll", "Wjm", "Bjl", "Whm", "Bhl", "Wfm", "Bfl", "Wkm", "Bmm", "Wmn", "Bim", "Win", "Bgm", "Wgn", "Bhn", "Wio", "Bgo", "Whm", "Bfo", "Wfn", "Bhn", "Weo", "Bep", "Whm", "Bln", "Wlo", "Bhn", "Wgp", "Bfp", "Whm", "Bjn", "Wkn", "Bhn", "Wco", "Bhm", "Wcp", "Bcq", "Wbo", "Bbq", "Wbl", "Bbk", "Wck", "Bdk", "Wcj", "Bbm", "Wbj", "Bal", "Wek", "Bdl", "Woi", "Bpi", "Wnk", "Bnl", "Wjc", "Bkd", "Wlb", "Bkb", "Wkc", "Bmb", "Wld", "Bla", "Wmc", "Blb", "Wjb", "Bmd", "Wle", "Bjd", "Wlf", "Bic", "Wib", "Bhb", "Wja", "Bha", "Wna", "Bia", "Wmf", "Bof", "Wnf", "Boe", "Wie", "Bhe", "Wif", "Bhf", "Wig", "Bhg", "Whh", "Bgh", "Wgi", "Bfh", "Wff", "Bef", "Wee", "Beg", "Wfd", "Bec", "Wcb", "Bcg", "Wbg", "Bch", "Wbh", "Bdf", "Wde", "Bei", "Wej", "Bci", "Wbi", "Bdi", "Wgr", "Bfr", "Wgq", "Bgs", "Whs", "Bfs", "Wir", "Brg", "Wrk", "Brc", "Wrb", "Brd", "Wsb", "Boc", "Wob", "Boh", "Wnh", "Bni", "Wmi", "Boj", "Wnj", "Bng", "Wmh", "Bca", "Wba", "Bda", "Wbb", "Bdc", "Wgd", "Bgc", "Wid", "Bka", "Wje", "Bke", "Wkf", "Bih", "Whi", "Bjh", "Wkg", "Bkh", "Wjg", "Bmg", "Wlg", "Bog", "Wlh", "Bmk", "Wmj", "Bsh", "Wsi", "Bsg", "Wso", "Bsp", "Wsn", "Brq", "Wps", "Bqs", "Wos", "Bnn", "Wno", "Bnm", "Waj", "Bak", "Wsc", "Bsd", "Wfg", "Bgg", "Wfi", "Beh", "Wgk", "Bik", "Wij", "Bkk", "Wkj", "Bom", "Wok", "Boi", "Wce", "Bgf", "Wfe", "Bnd", "Wpb", "B", "W"},
 }
 var alphaGoGameData GameData = GameData{
-	Size:        [2]int{19, 19},
-	Komi:        7.5,
-	Handicap:    0,
-	Winner:      "W",
-	Score:       0,
-	End:         "Resign",
-	BlackRank:   "",
-	WhiteRank:   "9p",
-	BlackPlayer: "AlphaGo",
-	WhitePlayer: "Lee Sedol",
-	Time:        7200,
-	Year:        2016,
-	Moves:       []string{"Bpd", "Wdp", "Bcd", "Wqp", "Bop", "Woq", "Bnq", "Wpq", "Bcn", "Wfq", "Bmp", "Wpo", "Biq", "Wec", "Bhd", "Wcg", "Bed", "Wcj", "Bdc", "Wbp", "Bnc", "Wqi", "Bep", "Weo", "Bdk", "Wfp", "Bck", "Wdj", "Bej", "Wei", "Bfi", "Weh", "Bfh", "Wbj", "Bfk", "Wfg", "Bgg", "Wff", "Bgf", "Wmc", "Bmd", "Wlc", "Bnb", "Wid", "Bhc", "Wjg", "Bpj", "Wpi", "Boj", "Woi", "Bni", "Wnh", "Bmh", "Wng", "Bmg", "Wmi", "Bnj", "Wmf", "Bli", "Wne", "Bnd", "Wmj", "Blf", "Wmk", "Bme", "Wnf", "Blh", "Wqj", "Bkk", "Wik", "Bji", "Wgh", "Bhj", "Wge", "Bhe", "Wfd", "Bfc", "Wki", "Bjj", "Wlj", "Bkh", "Wjh", "Bml", "Wnk", "Bol", "Wok", "Bpk", "Wpl", "Bqk", "Wnl", "Bkj", "Wii", "Brk", "Wom", "Bpg", "Wql", "Bcp", "Wco", "Boe", "Wrl", "Bsk", "Wrj", "Bhg", "Wij", "Bkm", "Wgi", "Bfj", "Wjl", "Bkl", "Wgl", "Bfl", "Wgm", "Bch", "Wee", "Beb", "Wbg", "Bdg", "Weg", "Ben", "Wfo", "Bdf", "Wdh", "Bim", "Whk", "Bbn", "Wif", "Bgd", "Wfe", "Bhf", "Wih", "Bbh", "Wci", "Bho", "Wgo", "Bor", "Wrg", "Bdn", "Wcq", "Bpr", "Wqr", "Brf", "Wqg", "Bqf", "Wjc", "Bgr", "Wsf", "Bse", "Wsg", "Brd", "Wbl", "Bbk", "Wak", "Bcl", "Whn", "Bin", "Whp", "Bfr", "Wer", "Bes", "Wds", "Bah", "Wai", "Bkd", "Wie", "Bkc", "Wkb", "Bgk", "Wib", "Bqh", "Wrh", "Bqs", "Wrs", "Boh", "Wsl", "Bof", "Wsj", "Bni", "Wnj", "Boo", "Wjp"},
+	Size:           [2]int{19, 19},
+	Komi:           7.5,
+	Handicap:       0,
+	Winner:         "W",
+	Score:          0,
+	End:            "Resign",
+	BlackRank:      "",
+	WhiteRank:      "9p",
+	WhiteRankValue: &Rank{Value: 10, Pro: true},
+	BlackPlayer:    "AlphaGo",
+	WhitePlayer:    "Lee Sedol",
+	Time:           7200,
+	Year:           2016,
+	Date:           &DateRange{Date{2016, 3, 13}, Date{2016, 3, 13}, "day"},
+	Ruleset:        "CHN",
+	Moves:          []string{"Bpd", "Wdp", "Bcd", "Wqp", "Bop", "Woq", "Bnq", "Wpq", "Bcn", "Wfq", "Bmp", "Wpo", "Biq", "Wec", "Bhd", "Wcg", "Bed", "Wcj", "Bdc", "Wbp", "Bnc", "Wqi", "Bep", "Weo", "Bdk", "Wfp", "Bck", "Wdj", "Bej", "Wei", "Bfi", "Weh", "Bfh", "Wbj", "Bfk", "Wfg", "Bgg", "Wff", "Bgf", "Wmc", "Bmd", "Wlc", "Bnb", "Wid", "Bhc", "Wjg", "Bpj", "Wpi", "Boj", "Woi", "Bni", "Wnh", "Bmh", "Wng", "Bmg", "Wmi", "Bnj", "Wmf", "Bli", "Wne", "Bnd", "Wmj", "Blf", "Wmk", "Bme", "Wnf", "Blh", "Wqj", "Bkk", "Wik", "Bji", "Wgh", "Bhj", "Wge", "Bhe", "Wfd", "Bfc", "Wki", "Bjj", "Wlj", "Bkh", "Wjh", "Bml", "Wnk", "Bol", "Wok", "Bpk", "Wpl", "Bqk", "Wnl", "Bkj", "Wii", "Brk", "Wom", "Bpg", "Wql", "Bcp", "Wco", "Boe", "Wrl", "Bsk", "Wrj", "Bhg", "Wij", "Bkm", "Wgi", "Bfj", "Wjl", "Bkl", "Wgl", "Bfl", "Wgm", "Bch", "Wee", "Beb", "Wbg", "Bdg", "Weg", "Ben", "Wfo", "Bdf", "Wdh", "Bim", "Whk", "Bbn", "Wif", "Bgd", "Wfe", "Bhf", "Wih", "Bbh", "Wci", "Bho", "Wgo", "Bor", "Wrg", "Bdn", "Wcq", "Bpr", "Wqr", "Brf", "Wqg", "Bqf", "Wjc", "Bgr", "Wsf", "Bse", "Wsg", "Brd", "Wbl", "Bbk", "Wak", "Bcl", "Whn", "Bin", "Whp", "Bfr", "Wer", "Bes", "Wds", "Bah", "Wai", "Bkd", "Wie", "Bkc", "Wkb", "Bgk", "Wib", "Bqh", "Wrh", "Bqs", "Wrs", "Boh", "Wsl", "Bof", "Wsj", "Bni", "Wnj", "Boo", "Wjp"},
+}
+
+func TestRecorded(t *testing.T) {
+	games, err := Grab("(;KM[0]HA[0];B[aa])(;SZ[9];B[aa])")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !games[0].Recorded("KM") || !games[0].Recorded("HA") || games[0].Recorded("SZ") {
+		t.Errorf("first game records KM %v, HA %v, SZ %v", games[0].Recorded("KM"), games[0].Recorded("HA"), games[0].Recorded("SZ"))
+	}
+	if games[1].Recorded("KM") || !games[1].Recorded("SZ") || games[1].Recorded("XX") {
+		t.Error("second game records KM or XX, or not SZ")
+	}
 }
@@ -10,14 +10,16 @@ import (
 )
 
 // Pre-compile regular expressions for parsing
-var reSquare, reRect, reResult, reRanks, reDate, reMove *regexp.Regexp
+var reSquare, reRect, reResult, reResultFraction, reResultNumber, reRanks, reDate, reMove *regexp.Regexp
 
 func init() {
 	reSquare = regexp.MustCompile("^[0-9]{1,2}$")
 	reRect = regexp.MustCompile("^[0-9]{1,2}:[0-9]{1,2}$")
-	reResult = regexp.MustCompile("^([BW])\\+([0-9]*(?:\\.[0-9]*)?|R|Resign|T|Time|F|Forfeit)$") // Just "W+" is accomodated by the score expression
-	reRanks = regexp.MustCompile("^[0-9]{1,2}[kdp]")                                             // Just check start to accomodate e.g. "9p, Kisei"
-	reDate = regexp.MustCompile("^[0-9]{4}")                                                     // Just get the year at the start
+	reResult = regexp.MustCompile("(?i)^([BW])\\s*\\+\\s*([0-9]*(?:\\.[0-9]*)?|R|Resign|T|Time|F|Forfeit)(?:[\\s(].*)?$") // Just "W+" is accomodated by the score expression
+	reResultFraction = regexp.MustCompile("(?:([0-9]+)\\s*(?:又|and)\\s*)?([0-9]+)/([0-9]+)")
+	reResultNumber = regexp.MustCompile("[0-9]+(?:\\.[0-9]+)?")
+	reRanks = regexp.MustCompile("^[0-9]{1,2}[kdp]") // Just check start to accomodate e.g. "9p, Kisei"
+	reDate = regexp.MustCompile("^[0-9]{4}")         // Just get the year at the start
 }
 
 // ErrParse means that a property was not able to be parsed
@@ -82,27 +84,158 @@ func ParseHandicap(v string) (int, error) {
 	return 0, ErrParse{"HA", v}
 }
 
-// ParseResult parses result into winner, score, and end ("Time", "Resign", or "Forfeit")
+// ParseResult parses result into winner, score, and end ("Scored", "Time", "Resign",
+// "Forfeit", "Draw", "Void", "Unknown", or "" for a winner by unknown means)
 func ParseResult(v string) (string, float64, string, error) {
-	findResult := reResult.FindStringSubmatch(v)
+	trimmed := strings.TrimRight(strings.TrimSpace(v), "!.")
+	switch strings.ToLower(trimmed) {
+	case "0", "d", "=", "draw", "jigo", "tie":
+		return "", 0.0, "Draw", nil
+	case "void", "no result", "suspended":
+		return "", 0.0, "Void", nil
+	case "", "?", "unknown":
+		return "", 0.0, "Unknown", nil
+	}
+
+	findResult := reResult.FindStringSubmatch(trimmed)
 	if len(findResult) != 3 {
-		return "", 0.0, "", ErrParse{"RE", v}
+		return parseResultWords(v)
 	}
-	switch findResult[2] {
-	case "R", "Resign":
-		return findResult[1], 0.0, "Resign", nil
-	case "T", "Time":
-		return findResult[1], 0.0, "Time", nil
-	case "F", "Forfeit":
-		return findResult[1], 0.0, "Forfeit", nil
+	winner := strings.ToUpper(findResult[1])
+	switch strings.ToLower(findResult[2]) {
+	case "r", "resign":
+		return winner, 0.0, "Resign", nil
+	case "t", "time":
+		return winner, 0.0, "Time", nil
+	case "f", "forfeit":
+		return winner, 0.0, "Forfeit", nil
+	case "":
+		return winner, 0.0, "", nil
 	}
 
 	// Should be float now
 	vFloat, err := strconv.ParseFloat(findResult[2], 64)
 	if (err != nil) || (math.IsNaN(vFloat)) || (math.IsInf(vFloat, 0)) {
-		return findResult[1], 0.0, "", ErrParse{"RE", v}
+		return "", 0.0, "", ErrParse{"RE", v}
 	}
-	return findResult[1], vFloat, "Scored", nil
+	if vFloat == 0 {
+		return "", 0.0, "Draw", nil
+	}
+	return winner, vFloat, "Scored", nil
+}
+
+// Words and characters used by servers writing results in English, Chinese, Japanese, or Korean
+var resultWords = []struct {
+	words  []string
+	winner string // "B", "W", or "" for the winner's opponent
+	end    string
+}{
+	{[]string{"和棋", "平局", "和局", "持碁", "ジゴ", "무승부"}, "", "Draw"},
+	{[]string{"无胜负", "無勝負", "무효", "void"}, "", "Void"},
+	{[]string{"中盘", "中盤", "中押", "불계", "resign"}, "", "Resign"},
+	{[]string{"超时", "超時", "時間切れ", "시간", "time"}, "", "Time"},
+	{[]string{"弃权", "棄權", "棄権", "不战", "不戰", "기권", "forfeit"}, "", "Forfeit"},
+	{[]string{"黑", "黒", "흑", "black", "b"}, "B", ""},
+	{[]string{"白", "백", "white", "w"}, "W", ""},
+}
+
+// Verbs saying whether the color mentioned first won, lost, or ended the game by losing
+// (English words only as whole words, so "lose" is not found in "close")
+var (
+	resultWinWords   = []string{"胜", "勝", "승", "win", "wins", "won", "winning"}
+	resultLossWords  = []string{"负", "負", "패", "lose", "loses", "lost", "losing"}
+	resultLoserWords = []string{"认输", "認輸", "投了", "resign", "resigns", "resigned", "forfeits", "forfeited", "timeout", "timed out", "on time"}
+)
+
+// indexResultWord finds a result word. Words in letters must start a word (so "void" is not
+// found in "avoid"), and must also end one if whole.
+func indexResultWord(s, w string, whole bool) int {
+	isLetter := func(c byte) bool { return ((c >= 'a') && (c <= 'z')) || (c == '\'') } // "won't" is not "won"
+	for i := 0; i < len(s); {
+		j := strings.Index(s[i:], w)
+		if j < 0 {
+			return -1
+		}
+		j += i
+		end := j + len(w)
+		if !isLetter(w[0]) || (((j == 0) || !isLetter(s[j-1])) && (!whole || (end == len(s)) || !isLetter(s[end]))) {
+			return j
+		}
+		i = j + 1
+	}
+	return -1
+}
+
+// parseResultWords parses results written out like "黑中盘胜", "白胜3又1/4子", "黒1目半勝ち",
+// "백 반집승", "Black wins by 2.5 points", "B wins", or "White resigned", which must say
+// whether the color mentioned first won or lost. Chinese counts in stones (子) are
+// converted to points.
+func parseResultWords(v string) (string, float64, string, error) {
+	lower := strings.ToLower(v)
+	winner, end := "", ""
+	winnerAt := len(lower)
+	for _, rw := range resultWords {
+		for _, w := range rw.words {
+			i := indexResultWord(lower, w, len(w) == 1) // Colors like "b" as whole words
+			if i < 0 {
+				continue
+			}
+			switch {
+			case rw.end == "Draw" || rw.end == "Void":
+				return "", 0.0, rw.end, nil
+			case rw.end != "":
+				end = rw.end
+			case i < winnerAt: // First color mentioned
+				winner, winnerAt = rw.winner, i
+			}
+		}
+	}
+	if winner == "" {
+		return "", 0.0, "", ErrParse{"RE", v}
+	}
+	has := func(words []string) bool {
+		for _, w := range words {
+			if indexResultWord(lower, w, true) >= 0 {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case has(resultLossWords):
+		winner = map[string]string{"B": "W", "W": "B"}[winner]
+	case has(resultWinWords):
+	case has(resultLoserWords):
+		winner = map[string]string{"B": "W", "W": "B"}[winner]
+	default:
+		return "", 0.0, "", ErrParse{"RE", v}
+	}
+	if end != "" {
+		return winner, 0.0, end, nil
+	}
+
+	// Score, possibly with a fraction or a trailing half
+	score := 0.0
+	if findFraction := reResultFraction.FindStringSubmatch(lower); findFraction != nil {
+		score, _ = strconv.ParseFloat(findFraction[1], 64)
+		num, _ := strconv.ParseFloat(findFraction[2], 64)
+		den, _ := strconv.ParseFloat(findFraction[3], 64)
+		if den != 0 {
+			score += num / den
+		}
+	} else if findNumber := reResultNumber.FindString(lower); findNumber != "" {
+		score, _ = strconv.ParseFloat(findNumber, 64)
+	}
+	if strings.Contains(lower, "半") || strings.Contains(lower, "반") {
+		score += 0.5
+	}
+	if strings.Contains(lower, "子") {
+		score *= 2
+	}
+	if (score == 0) || math.IsInf(score, 0) {
+		return winner, 0.0, "", nil
+	}
+	return winner, score, "Scored", nil
 }
 
 // ParseRank parses player rank ("B" or "W" else panic)
@@ -110,8 +243,8 @@ func ParseRank(player, v string) (string, error) {
 	if (player != "B") && (player != "W") {
 		panic("player was not black or white")
 	}
-	replacements := map[string]string{ // Specifically for foxwq
-		"级": "k", "段": "d", "a": "p",
+	replacements := map[string]string{ // Specifically for foxwq, plus traditional and Korean spellings
+		"级": "k", "段": "d", "a": "p", "級": "k", "급": "k", "단": "d",
 		"-": "", "零": "0", "一": "1", "二": "2", "三": "3", "四": "4", "五": "5", "六": "6", "七": "7", "八": "8", "九": "9",
 	}
 	for s1, s2 := range replacements {
@@ -129,6 +262,35 @@ func ParseRank(player, v string) (string, error) {
 
 }
 
+// ParseRules parses ruleset into "JPN", "CHN", "KOR", "AGA", "NZ", "ING", or "TT"
+// (the ruleset names used by package weiqi)
+func ParseRules(v string) (string, error) {
+	normalized := strings.Map(func(r rune) rune {
+		if (r == '-') || (r == '_') || (r == '\'') || unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, v)
+	normalized = strings.TrimSuffix(strings.TrimSuffix(normalized, "rules"), "rule")
+	switch normalized {
+	case "japanese", "japan", "jp", "jpn", "ja", "日本", "日本ルール":
+		return "JPN", nil
+	case "chinese", "china", "cn", "chn", "zh", "中国", "中國", "中国规则":
+		return "CHN", nil
+	case "korean", "korea", "kr", "kor", "ko", "한국", "韩国", "韓国":
+		return "KOR", nil
+	case "aga", "american", "bga", "french":
+		return "AGA", nil
+	case "nz", "newzealand":
+		return "NZ", nil
+	case "ing", "goe", "ingsst", "sst", "应氏", "應氏":
+		return "ING", nil
+	case "tromptaylor", "tt":
+		return "TT", nil
+	}
+	return "", ErrParse{"RU", v}
+}
+
 // ParseTime parses time limit in seconds
 func ParseTime(v string) (int, error) {
 	multiplier := 1
@@ -165,19 +327,93 @@ func ParseDate(v string) (int, error) {
 	return yearInt, nil
 }
 
+// ParseText unescapes an SGF text value, removing soft line breaks and normalizing newlines
+func ParseText(v string) string {
+	var b strings.Builder
+	escaped := false
+	for _, r := range strings.Replace(strings.Replace(v, "\r\n", "\n", -1), "\n\r", "\n", -1) {
+		if r == '\r' {
+			r = '\n'
+		}
+		if escaped {
+			escaped = false
+			if r != '\n' { // Escaped newline is a soft line break
+				b.WriteRune(r)
+			}
+			continue
+		}
+		if r == '\\' {
+			escaped = true
+			continue
+		}
+		if unicode.IsSpace(r) && (r != '\n') {
+			r = ' '
+		}
+		b.WriteRune(r)
+	}
+	return strings.TrimSpace(b.String())
+}
+
 // ParseMove parses a game move in SGF format  ("B" or "W" else panic)
 func ParseMove(player, v string) (string, error) {
 	if (player != "B") && (player != "W") {
 		panic("player was not black or white")
 	}
-	if len(v) == 0 {
+	v = strings.TrimSpace(v)
+	if len(v) == 0 { // Pass
 		return player, nil
 	}
-	vr := []rune(v)
-	if len(vr) == 2 {
-		if unicode.IsLetter(vr[0]) && unicode.IsLetter(vr[1]) {
-			return player + v, nil
-		}
+	if (len(v) == 2) && (strings.IndexByte(coordinateLetters, v[0]) >= 0) && (strings.IndexByte(coordinateLetters, v[1]) >= 0) {
+		return player + v, nil
 	}
 	return "", ErrParse{player, v}
 }
+
+// ParsePlayer parses the player to move ("B" or "W")
+func ParsePlayer(v string) (string, error) {
+	switch strings.ToUpper(strings.TrimSpace(v)) {
+	case "B", "1":
+		return "B", nil
+	case "W", "2":
+		return "W", nil
+	}
+	return "", ErrParse{"PL", v}
+}
+
+// ParsePoints parses a setup point or compressed rectangle like "aa:cc" into setup
+// stones for color "B", "W", or "E" (empty, else panic)
+func ParsePoints(color, v string) ([]string, error) {
+	if (color != "B") && (color != "W") && (color != "E") {
+		panic("color was not black, white, or empty")
+	}
+	corners := strings.Split(v, ":")
+	if (len(corners) > 2) || (len(corners[0]) != 2) || (len(corners[len(corners)-1]) != 2) {
+		return nil, ErrParse{"A" + color, v}
+	}
+	col1, err1 := letterToCoordinate(corners[0][0])
+	row1, err2 := letterToCoordinate(corners[0][1])
+	col2, err3 := letterToCoordinate(corners[len(corners)-1][0])
+	row2, err4 := letterToCoordinate(corners[len(corners)-1][1])
+	if (err1 != nil) || (err2 != nil) || (err3 != nil) || (err4 != nil) || (col2 < col1) || (row2 < row1) {
+		return nil, ErrParse{"A" + color, v}
+	}
+	var points []string
+	for col := col1; col <= col2; col++ {
+		for row := row1; row <= row2; row++ {
+			points = append(points, color+coordinateLetters[col:col+1]+coordinateLetters[row:row+1])
+		}
+	}
+	return points, nil
+}
+
+// coordinateLetters are SGF coordinates in order
+const coordinateLetters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// letterToCoordinate converts an SGF coordinate letter to a zero-based coordinate
+func letterToCoordinate(letter byte) (int, error) {
+	i := strings.IndexByte(coordinateLetters, letter)
+	if i < 0 {
+		return 0, fmt.Errorf("invalid coordinate letter: %q", letter)
+	}
+	return i, nil
+}
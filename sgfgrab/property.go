@@ -0,0 +1,277 @@
+package sgfgrab
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DuplicatePolicy says what AddProperty does when a property is repeated in a game
+type DuplicatePolicy int
+
+const (
+	DuplicateError     DuplicatePolicy = iota // return ErrAlreadyExists
+	DuplicateKeepFirst                        // ignore repeats
+	DuplicateKeepLast                         // record repeats over earlier values
+	DuplicateAll                              // record every value (moves, setup, comments, lists)
+)
+
+// PropertyFunc records a property value on a game. Returned errors end the parse only
+// for critical properties (SZ, KM, HA, B, W, AB, AW, AE), and otherwise skip the value.
+type PropertyFunc func(g *GameData, identifier, value string) error
+
+// property is a registered handler
+type property struct {
+	bit       uint64 // in GameData.recorded
+	duplicate DuplicatePolicy
+	record    PropertyFunc
+}
+
+// properties maps SGF identifiers to handlers, starting with the built-in ones
+var properties map[string]*property
+
+// builtinIdentifiers are the properties with built-in handlers
+var builtinIdentifiers = make(map[string]bool)
+
+func init() {
+	properties = builtinProperties()
+	for identifier := range properties {
+		builtinIdentifiers[identifier] = true
+	}
+}
+
+// IsBuiltinProperty checks if a property has a built-in handler, which RegisterProperty
+// would replace
+func IsBuiltinProperty(identifier string) bool {
+	return builtinIdentifiers[identifier]
+}
+
+// RegisterProperty sets the handler for a property identifier, replacing any built-in
+// handler. It is meant to be called during initialization, since it is not safe to call
+// while games are being grabbed. At most 64 properties can be registered in total.
+func RegisterProperty(identifier string, duplicate DuplicatePolicy, record PropertyFunc) {
+	if p, ok := properties[identifier]; ok {
+		properties[identifier] = &property{p.bit, duplicate, record}
+		return
+	}
+	if len(properties) >= 64 {
+		panic("too many properties registered")
+	}
+	properties[identifier] = &property{1 << uint(len(properties)), duplicate, record}
+}
+
+// ExtraProperty creates a PropertyFunc which keeps a parsed value in GameData.Extra under
+// the property identifier (text from ParseText if parse is nil)
+func ExtraProperty(parse func(value string) (interface{}, error)) PropertyFunc {
+	return func(g *GameData, identifier, value string) error {
+		v, err := parseExtra(parse, value)
+		if err != nil {
+			return err
+		}
+		g.setExtra(identifier, v)
+		return nil
+	}
+}
+
+// ExtraList is like ExtraProperty, but keeps a list of every value (use with DuplicateAll)
+func ExtraList(parse func(value string) (interface{}, error)) PropertyFunc {
+	return func(g *GameData, identifier, value string) error {
+		v, err := parseExtra(parse, value)
+		if err != nil {
+			return err
+		}
+		list, _ := g.Extra[identifier].([]interface{})
+		g.setExtra(identifier, append(list, v))
+		return nil
+	}
+}
+
+// parseExtra parses a value for GameData.Extra
+func parseExtra(parse func(value string) (interface{}, error), value string) (interface{}, error) {
+	if parse == nil {
+		return ParseText(value), nil
+	}
+	return parse(value)
+}
+
+// setExtra sets a value in GameData.Extra
+func (g *GameData) setExtra(key string, v interface{}) {
+	if g.Extra == nil {
+		g.Extra = make(map[string]interface{})
+	}
+	g.Extra[key] = v
+}
+
+// isRecorded checks if a property has been recorded for the game
+func (g *GameData) isRecorded(identifier string) bool {
+	p, ok := properties[identifier]
+	return ok && (g.recorded&p.bit != 0)
+}
+
+// Recorded checks if a property was read into the game, to tell a field given in the
+// record from its default (like Komi 0 when there is no KM)
+func (g *GameData) Recorded(identifier string) bool {
+	return g.isRecorded(identifier)
+}
+
+// builtinProperties creates handlers for the GameData fields
+func builtinProperties() map[string]*property {
+	builtins := []struct {
+		identifiers []string
+		duplicate   DuplicatePolicy
+		record      PropertyFunc
+	}{
+		{[]string{"SZ"}, DuplicateError, func(g *GameData, identifier, value string) error {
+			v, err := ParseSize(value)
+			if err != nil {
+				return err
+			}
+			g.Size = v
+			return nil
+		}},
+		{[]string{"KM"}, DuplicateError, func(g *GameData, identifier, value string) error {
+			v, err := ParseKomi(value)
+			if err != nil {
+				return err
+			}
+			g.Komi = v
+			return nil
+		}},
+		{[]string{"HA"}, DuplicateError, func(g *GameData, identifier, value string) error {
+			v, err := ParseHandicap(value)
+			if err != nil {
+				return err
+			}
+			g.Handicap = v
+			return nil
+		}},
+		{[]string{"RE"}, DuplicateError, func(g *GameData, identifier, value string) error {
+			v1, v2, v3, err := ParseResult(value)
+			if err != nil {
+				return err
+			}
+			g.Winner = v1
+			g.Score = v2
+			g.End = v3
+			return nil
+		}},
+		{[]string{"BR", "WR"}, DuplicateError, func(g *GameData, identifier, value string) error {
+			player := identifier[:1]
+			v, err := ParseRankValue(player, value)
+			if err != nil {
+				return err
+			}
+			rank, rankValue := &g.BlackRank, &g.BlackRankValue
+			if player == "W" {
+				rank, rankValue = &g.WhiteRank, &g.WhiteRankValue
+			}
+			if !v.Unranked {
+				*rank, _ = ParseRank(player, value)
+			}
+			*rankValue = &v
+			return nil
+		}},
+		{[]string{"PB", "PW"}, DuplicateError, func(g *GameData, identifier, value string) error {
+			name := strings.Replace(strings.Replace(value, "\n", " ", -1), "\r", "", -1)
+			if identifier == "PB" {
+				g.BlackPlayer = name
+			} else {
+				g.WhitePlayer = name
+			}
+			return nil
+		}},
+		{[]string{"TM"}, DuplicateError, func(g *GameData, identifier, value string) error {
+			v, err := ParseTime(value)
+			if err != nil {
+				return err
+			}
+			g.Time = v
+			return nil
+		}},
+		{[]string{"DT"}, DuplicateError, func(g *GameData, identifier, value string) error {
+			if g.keepText {
+				g.DateText = ParseText(value)
+			}
+			v, err := ParseDateRange(value)
+			if err != nil {
+				return err
+			}
+			g.Year = v.Start.Year
+			g.Date = &v
+			return nil
+		}},
+		{[]string{"RU"}, DuplicateError, func(g *GameData, identifier, value string) error {
+			if g.keepText {
+				g.Rules = ParseText(value)
+			}
+			v, err := ParseRules(value)
+			if err != nil {
+				return err
+			}
+			g.Ruleset = v
+			return nil
+		}},
+		{[]string{"GN", "EV", "RO", "PC", "SO", "GC"}, DuplicateError, func(g *GameData, identifier, value string) error {
+			if !g.keepText {
+				return nil
+			}
+			*g.textField(identifier) = ParseText(value)
+			return nil
+		}},
+		{[]string{"C"}, DuplicateAll, func(g *GameData, identifier, value string) error {
+			if !g.keepText {
+				return nil
+			}
+			if g.nodeComment != "" {
+				g.nodeComment += "\n"
+			}
+			g.nodeComment += ParseText(value)
+			return nil
+		}},
+		{[]string{"PL"}, DuplicateAll, func(g *GameData, identifier, value string) error {
+			if len(g.Moves) > 0 {
+				return nil // Only the starting player is recorded
+			}
+			v, err := ParsePlayer(value)
+			if err != nil {
+				return err
+			}
+			g.Player = v
+			return nil
+		}},
+		{[]string{"B", "W"}, DuplicateAll, func(g *GameData, identifier, value string) error {
+			v, err := ParseMove(identifier, value)
+			if err != nil {
+				return err
+			}
+			if err := checkOnBoard(v, g.boardSize()); err != nil {
+				return err
+			}
+			g.Moves = append(g.Moves, v)
+			return nil
+		}},
+		{[]string{"AB", "AW", "AE"}, DuplicateAll, func(g *GameData, identifier, value string) error {
+			if len(g.Moves) > 0 {
+				return fmt.Errorf("%w: %s %s", ErrSetupAfterMoves, identifier, value)
+			}
+			v, err := ParsePoints(identifier[1:], value)
+			if err != nil {
+				return err
+			}
+			for _, m := range v {
+				if err := checkOnBoard(m, g.boardSize()); err != nil {
+					return err
+				}
+			}
+			g.Setup = append(g.Setup, v...)
+			return nil
+		}},
+	}
+
+	m := make(map[string]*property)
+	for _, b := range builtins {
+		for _, identifier := range b.identifiers {
+			m[identifier] = &property{1 << uint(len(m)), b.duplicate, b.record}
+		}
+	}
+	return m
+}
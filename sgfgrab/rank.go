@@ -0,0 +1,85 @@
+package sgfgrab
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Rank places a player rank on a numeric scale where 30k is -29, 1k is 0, 1d is 1,
+// and professional ranks continue from 7d in thirds of a stone (1p is 7.33, 9p is 10)
+type Rank struct {
+	Value       float64 //
+	Pro         bool    `json:",omitempty"` // professional rank, not adjusted by RankOffsets
+	Provisional bool    `json:",omitempty"` // uncertain rank like "3k?"
+	Unranked    bool    `json:",omitempty"` // no rank like "?" or "NR", Value means nothing
+}
+
+// RankOffsets are approximate stones added to amateur ranks from each source (by
+// lowercase source name) to bring them onto a common, KGS-like scale.
+// These are rough community estimates and can be replaced to suit a dataset.
+var RankOffsets = map[string]float64{
+	"kgs":    0,
+	"ogs":    0,
+	"igs":    -1,
+	"fox":    -1.5,
+	"foxwq":  -1.5,
+	"tygem":  -1,
+	"wbaduk": -1,
+}
+
+// ParseRankValue parses player rank onto the Rank scale ("B" or "W" else panic)
+func ParseRankValue(player, v string) (Rank, error) {
+	switch strings.ToLower(strings.Trim(v, " []()")) {
+	case "", "?", "??", "-", "--", "nr", "unranked", "none", "unknown":
+		return Rank{Unranked: true}, nil
+	}
+	rank, err := ParseRank(player, v)
+	if err != nil {
+		return Rank{}, err
+	}
+	n, _ := strconv.Atoi(rank[:len(rank)-1])
+	r := Rank{Provisional: strings.ContainsAny(v, "?*")}
+	switch rank[len(rank)-1] {
+	case 'k':
+		r.Value = float64(1 - n)
+	case 'd':
+		r.Value = float64(n)
+	case 'p':
+		r.Value = 7 + float64(n)/3
+		r.Pro = true
+	}
+	return r, nil
+}
+
+// Less orders ranks from weakest to strongest, with unranked players first
+func (r Rank) Less(r2 Rank) bool {
+	if r.Unranked || r2.Unranked {
+		return r.Unranked && !r2.Unranked
+	}
+	return r.Value < r2.Value
+}
+
+// Normalize adds the offset for the source, if one is known
+func (r Rank) Normalize(source string) Rank {
+	if r.Unranked || r.Pro {
+		return r
+	}
+	r.Value += RankOffsets[strings.ToLower(source)]
+	return r
+}
+
+func (r Rank) String() string {
+	round := func(x float64) string {
+		return strconv.FormatFloat(math.Round(x*10)/10, 'f', -1, 64)
+	}
+	switch {
+	case r.Unranked:
+		return "?"
+	case r.Pro:
+		return round((r.Value-7)*3) + "p"
+	case r.Value <= 0:
+		return round(1-r.Value) + "k"
+	}
+	return round(r.Value) + "d"
+}
@@ -2,6 +2,7 @@ package weiqi
 
 import (
 	"errors"
+	"fmt"
 	"math/rand"
 	"testing"
 )
@@ -142,6 +143,52 @@ func TestBasicGamePlayCheckSetup(t *testing.T) {
 
 }
 
+func TestSimpleKo(t *testing.T) {
+	// Ko shape (see diagram), white to play
+	//   . X O .
+	//   X . X O
+	//   . X O .
+	//   . . . .
+	setup := []Move{
+		NewMove(-1, 0, 2), NewMove(-1, 1, 3), NewMove(-1, 2, 2),
+		NewMove(1, 0, 1), NewMove(1, 1, 0), NewMove(1, 2, 1), NewMove(1, 1, 2),
+	}
+	for _, ruleset := range []string{"JPN", "KOR", "NZ", "TT"} {
+		g := NewGame(4, 4)
+		g.SetRules(ruleset)
+		for _, m := range setup {
+			g.Setup(m)
+		}
+		if err := g.Play(NewMove(-1, 1, 1)); err != nil {
+			t.Fatalf("%s: ko capture not allowed: %s", ruleset, err)
+		}
+
+		// Immediate retake is always illegal
+		if err := g.Play(NewMove(1, 1, 2)); err == nil {
+			t.Fatalf("%s: immediate ko retake allowed", ruleset)
+		} else if (ruleset == "JPN") && !errors.Is(err, ErrKo) {
+			t.Fatalf("%s: unexpected error on ko retake: %s", ruleset, err)
+		}
+
+		// Retake after two passes repeats an earlier position, only legal under simple ko
+		g.Play(NewMovePass(1))
+		g.Play(NewMovePass(-1))
+		err := g.Play(NewMove(1, 1, 2))
+		if simpleKo := (ruleset == "JPN") || (ruleset == "KOR"); simpleKo != (err == nil) {
+			t.Fatalf("%s: unexpected result for later ko retake: %v", ruleset, err)
+		}
+	}
+
+	// Suicide is forbidden under Japanese rules
+	g := NewGame(2, 2)
+	g.SetRules("JPN")
+	g.Setup(NewMove(1, 0, 1))
+	g.Setup(NewMove(1, 1, 0))
+	if err := g.Play(NewMove(-1, 0, 0)); !errors.Is(err, ErrSuicide) {
+		t.Fatalf("suicide not forbidden under Japanese rules: %v", err)
+	}
+}
+
 func TestFakeHashCollision(t *testing.T) {
 
 	// Figure out what the hash is going to be
@@ -187,6 +234,54 @@ func TestGameSetup(t *testing.T) {
 	}
 }
 
+func TestSetupPosition(t *testing.T) {
+	// Replace and remove stones during setup
+	g := NewGame(3, 3)
+	for _, ms := range []string{"Baa", "Wbb", "Bbb", "Wcc", "Ecc", "Eab"} {
+		m, err := NewMoveFromString(ms)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Setup(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := newBoard(3, 3)
+	expect.place(NewMove(1, 0, 0))
+	expect.place(NewMove(1, 1, 1))
+	if !g.board.Equals(expect) || (g.board.hash != expect.hash) {
+		t.Fatalf("setup position or hash incorrect:\n%s", g)
+	}
+	if _, err := NewMoveFromString("E"); err == nil {
+		t.Fatal("parsed empty pass")
+	}
+	if err := g.Play(NewMove(0, 2, 2)); !errors.Is(err, ErrWrongPlayer) {
+		t.Fatalf("played empty move: %v", err)
+	}
+
+	// Player to move from a general position
+	testTable := []struct {
+		setup  []string
+		player string
+		moves  []string
+		legal  bool
+	}{
+		{[]string{"Bcc", "Bdd"}, "", []string{"Wee"}, true},
+		{[]string{"Bcc", "Bdd"}, "", []string{"Bee"}, false},
+		{[]string{"Bcc", "Bdd"}, "B", []string{"Bee"}, true},
+		{[]string{"Bcc", "Wdd"}, "", []string{"Bee", "Wff"}, true},
+		{[]string{"Bcc", "Wdd"}, "", []string{"Wee", "Bff"}, true},
+		{[]string{"Bcc", "Wdd"}, "W", []string{"Bee"}, false},
+		{[]string{"Bba", "Bab", "Wbb", "Ebb"}, "W", []string{"Waa"}, false}, // Suicide
+	}
+	for i, test := range testTable {
+		err := CheckLegalPosition(19, 19, test.setup, test.player, test.moves, "AGA")
+		if (err == nil) != test.legal {
+			t.Errorf("unexpected result for position %d: %v", i, err)
+		}
+	}
+}
+
 func TestGameReset(t *testing.T) {
 	g := NewGame(19, 19)
 	startBoard := g.board.Copy()
@@ -360,3 +455,575 @@ func TestMovePrint(t *testing.T) {
 		t.Fatalf("invalid move \"Bf?\" printed incorrectly as %q", m)
 	}
 }
+
+func TestFixedHandicap(t *testing.T) {
+	testTable := []struct {
+		rows, cols, handicap int
+		expected             []string // in order, nil for an error
+	}{
+		{19, 19, 9, []string{"Bdp", "Bpd", "Bdd", "Bpp", "Bdj", "Bpj", "Bjp", "Bjd", "Bjj"}},
+		{19, 19, 2, []string{"Bdp", "Bpd"}},
+		{19, 19, 6, []string{"Bdp", "Bpd", "Bdd", "Bpp", "Bdj", "Bpj"}},
+		{19, 19, 7, []string{"Bdp", "Bpd", "Bdd", "Bpp", "Bdj", "Bpj", "Bjj"}},
+		{13, 13, 5, []string{"Bdj", "Bjd", "Bdd", "Bjj", "Bgg"}},
+		{9, 9, 3, []string{"Bcg", "Bgc", "Bcc"}},
+		{9, 9, 8, []string{"Bcg", "Bgc", "Bcc", "Bgg", "Bce", "Bge", "Beg", "Bec"}},
+		{8, 8, 4, []string{"Bcf", "Bfc", "Bcc", "Bff"}},
+		{13, 19, 5, []string{"Bdj", "Bpd", "Bdd", "Bpj", "Bjg"}},
+		{7, 7, 4, []string{"Bce", "Bec", "Bcc", "Bee"}},
+		{7, 7, 5, nil},
+		{8, 8, 5, nil},
+		{9, 10, 5, nil},
+		{19, 19, 1, nil},
+		{19, 19, 10, nil},
+		{5, 5, 2, nil},
+	}
+	for _, test := range testTable {
+		stones, err := FixedHandicap(test.rows, test.cols, test.handicap)
+		if test.expected == nil {
+			if !errors.Is(err, ErrHandicap) {
+				t.Errorf("%dx%d handicap %d: expected error, got %v", test.rows, test.cols, test.handicap, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%dx%d handicap %d: %s", test.rows, test.cols, test.handicap, err)
+			continue
+		}
+		if fmt.Sprint(stones) != fmt.Sprint(test.expected) {
+			t.Errorf("%dx%d handicap %d: placed %v, expected %v", test.rows, test.cols, test.handicap, stones, test.expected)
+		}
+		if err := CheckFixedHandicap(test.rows, test.cols, test.handicap, test.expected); err != nil {
+			t.Errorf("%dx%d handicap %d: fixed handicap rejected: %s", test.rows, test.cols, test.handicap, err)
+		}
+	}
+
+	// Game servers put the third stone in the lower right
+	stones, err := FixedHandicapOrder(19, 19, 8, HandicapTraditional)
+	if expected := "[Bpd Bdp Bpp Bdd Bdj Bpj Bjd Bjp]"; (err != nil) || (fmt.Sprint(stones) != expected) {
+		t.Errorf("traditional handicap 8: placed %v (%v), expected %s", stones, err, expected)
+	}
+
+	// Order does not matter, but the count and points do
+	if err := CheckFixedHandicap(19, 19, 3, []string{"Bdd", "Bpd", "Bdp"}); err != nil {
+		t.Errorf("reordered handicap rejected: %s", err)
+	}
+	if err := CheckFixedHandicap(19, 19, 3, []string{"Bpd", "Bdp", "Bpp"}); err != nil {
+		t.Errorf("lower right third stone rejected: %s", err)
+	}
+	for _, setup := range [][]string{
+		{"Bdd", "Bpd", "Bdp", "Bpp"},
+		{"Bdd", "Bpd", "Bdq"},
+		{"Bdd", "Bpd", "Bpp"},
+		{"Bdd", "Bpd", "Bpd"},
+		{"Wdd", "Bpd", "Bdp"},
+	} {
+		if err := CheckFixedHandicap(19, 19, 3, setup); err == nil {
+			t.Errorf("handicap 3 accepted for %v", setup)
+		}
+	}
+}
+
+func TestPlaceHandicap(t *testing.T) {
+	g := NewGame(9, 9)
+	stones, _ := FixedHandicap(9, 9, 5)
+	if err := g.PlaceHandicap(stones); err != nil {
+		t.Fatal(err)
+	}
+	if g.turn != -1 {
+		t.Fatal("white does not move after handicap")
+	}
+	if g.board.look(vertex{4, 4}) != 1 {
+		t.Fatal("handicap stone not placed")
+	}
+	if err := g.PlaceHandicap(stones); !errors.Is(err, ErrHandicap) {
+		t.Fatalf("handicap placed twice: %v", err)
+	}
+
+	// Free placement
+	for _, test := range []struct {
+		stones []Move
+		err    error
+	}{
+		{[]Move{NewMove(1, 0, 0), NewMove(1, 0, 1), NewMove(1, 8, 8)}, nil},
+		{[]Move{NewMove(1, 0, 0)}, ErrHandicap},
+		{[]Move{NewMove(1, 0, 0), NewMove(1, 0, 0)}, ErrHandicap},
+		{[]Move{NewMove(1, 0, 0), NewMove(-1, 1, 1)}, ErrHandicap},
+		{[]Move{NewMove(1, 0, 0), NewMovePass(1)}, ErrHandicap},
+		{[]Move{NewMove(1, 0, 0), NewMove(1, 9, 0)}, ErrOutsideBoard},
+	} {
+		g := NewGame(9, 9)
+		if err := g.PlaceHandicap(test.stones); !errors.Is(err, test.err) {
+			t.Errorf("placing %v: got %v, expected %v", test.stones, err, test.err)
+		}
+	}
+}
+
+// perftRulesets are the rulesets covered by TestPerft
+var perftRulesets = []string{"NZ", "AGA", "TT", "JPN", "KOR", "CHN", "ING", ""}
+
+// perftCounts tallies the outcomes of the last move in every line of play
+type perftCounts struct {
+	nodes    int // legal moves (including passes)
+	captures int // legal moves which capture
+	suicides int // moves rejected as suicide
+	kos      int // moves rejected by simple ko
+	superkos int // moves rejected by positional or situational superko
+}
+
+func TestPerft(t *testing.T) {
+
+	// Every line of play is checked move by move against the reference implementation,
+	// and the reference totals are checked against the expected counts
+	testTable := []struct {
+		name       string
+		rows, cols int
+		setup      []string
+		moves      []string // played before counting
+		depth      int
+		expected   map[string]perftCounts
+	}{
+		{
+			name: "empty 2x2", rows: 2, cols: 2, depth: 8,
+			expected: map[string]perftCounts{
+				"NZ":  {9209, 1816, 0, 0, 384},
+				"AGA": {6177, 1480, 440, 0, 56},
+				"TT":  {6505, 1464, 0, 0, 456},
+				"JPN": {6457, 1536, 440, 0, 0},
+				"KOR": {6457, 1536, 440, 0, 0},
+				"CHN": {6049, 1464, 440, 0, 112},
+				"ING": {9209, 1816, 0, 0, 384},
+				"":    {10745, 2032, 0, 0, 0},
+			},
+		},
+		{
+			name: "empty 1x4", rows: 1, cols: 4, depth: 7,
+			expected: map[string]perftCounts{
+				"NZ":  {5221, 816, 0, 0, 642},
+				"AGA": {1789, 406, 462, 0, 124},
+				"TT":  {2505, 482, 0, 0, 686},
+				"JPN": {1889, 474, 470, 58, 0},
+				"KOR": {1889, 474, 470, 58, 0},
+				"CHN": {1779, 406, 462, 0, 134},
+				"ING": {5221, 816, 0, 0, 642},
+				"":    {7067, 1244, 0, 0, 0},
+			},
+		},
+		{
+			name: "empty 3x3", rows: 3, cols: 3, depth: 4,
+			expected: map[string]perftCounts{
+				"NZ":  {5517, 112, 0, 0, 0},
+				"AGA": {5453, 112, 64, 0, 0},
+				"TT":  {5453, 112, 0, 0, 64},
+				"JPN": {5453, 112, 64, 0, 0},
+				"KOR": {5453, 112, 64, 0, 0},
+				"CHN": {5453, 112, 64, 0, 0},
+				"ING": {5517, 112, 0, 0, 0},
+				"":    {5517, 112, 0, 0, 0},
+			},
+		},
+		{
+			name: "setup 2x3", rows: 2, cols: 3, depth: 6,
+			setup: []string{"Bab", "Wbb"},
+			expected: map[string]perftCounts{
+				"NZ":  {3307, 576, 0, 0, 56},
+				"AGA": {1429, 405, 151, 0, 5},
+				"TT":  {2237, 474, 0, 0, 176},
+				"JPN": {1432, 405, 151, 6, 0},
+				"KOR": {1432, 405, 151, 6, 0},
+				"CHN": {1429, 405, 151, 0, 5},
+				"ING": {3307, 576, 0, 0, 56},
+				"":    {3514, 611, 0, 0, 0},
+			},
+		},
+		{
+			// . X O .
+			// X O . O
+			// . X O .
+			// . . . .
+			name: "ko", rows: 4, cols: 4, depth: 4,
+			setup: []string{"Wca", "Wdb", "Wcc", "Bba", "Bab", "Bbc", "Bcb"},
+			moves: []string{"Wbb"},
+			expected: map[string]perftCounts{
+				"NZ":  {5355, 824, 0, 0, 75},
+				"AGA": {3716, 617, 172, 0, 55},
+				"TT":  {3814, 624, 0, 0, 198},
+				"JPN": {3724, 617, 173, 56, 0},
+				"KOR": {3724, 617, 173, 56, 0},
+				"CHN": {3716, 617, 172, 0, 55},
+				"ING": {5355, 824, 0, 0, 75},
+				"":    {6415, 1004, 0, 0, 0},
+			},
+		},
+		{
+			// X X O . .
+			// O O O . .
+			// . . X X .
+			// X O . O X
+			// . X O . .
+			name: "captures and suicide", rows: 5, cols: 5, depth: 3,
+			setup: []string{"Baa", "Bba", "Wca", "Wab", "Wbb", "Wcb", "Bcc", "Bdc", "Bad", "Wbd", "Wdd", "Bed", "Bbe", "Wce"},
+			expected: map[string]perftCounts{
+				"NZ":  {2230, 74, 0, 0, 14},
+				"AGA": {2151, 74, 66, 0, 14},
+				"TT":  {2189, 74, 0, 0, 42},
+				"JPN": {2151, 74, 66, 14, 0},
+				"KOR": {2151, 74, 66, 14, 0},
+				"CHN": {2151, 74, 66, 0, 14},
+				"ING": {2230, 74, 0, 0, 14},
+				"":    {2244, 88, 0, 0, 0},
+			},
+		},
+	}
+
+	for _, test := range testTable {
+		for _, ruleset := range perftRulesets {
+			g := NewGame(test.rows, test.cols)
+			g.SetRules(ruleset)
+			r := newRefGame(test.rows, test.cols, ruleset)
+			for i, list := range [][]string{test.setup, test.moves} {
+				for _, ms := range list {
+					m, err := NewMoveFromString(ms)
+					if err != nil {
+						t.Fatalf("test contained bad move string: %s", ms)
+					}
+					if i == 0 {
+						g.Setup(m)
+						r, _, err = r.play(m, true)
+					} else {
+						g.Play(m)
+						r, _, err = r.play(m, false)
+					}
+					if err != nil {
+						t.Fatalf("%s: reference rejected %s: %s", test.name, ms, err)
+					}
+				}
+			}
+
+			var counts perftCounts
+			perft(t, g, r, test.depth, &counts)
+			if counts != test.expected[ruleset] {
+				t.Errorf("%s (%q): counted %+v, expected %+v", test.name, ruleset, counts, test.expected[ruleset])
+			}
+		}
+	}
+}
+
+// perft tries every move (and a pass) for the player to move in both the game and the
+// reference to the given depth, checking that they agree, and counts the last moves
+func perft(t *testing.T, g Game, r refGame, depth int, counts *perftCounts) {
+	moves := []Move{NewMovePass(g.turn)}
+	for i := 0; i < r.rows; i++ {
+		for j := 0; j < r.cols; j++ {
+			moves = append(moves, NewMove(g.turn, i, j))
+		}
+	}
+
+	for _, m := range moves {
+		g2 := copyGame(g)
+		err := g2.Play(m)
+		r2, captured, refErr := r.play(m, false)
+		if !errors.Is(err, refErr) {
+			t.Fatalf("%v after %v: got %v, reference got %v", m, g.prevMoves, err, refErr)
+		}
+		if err != nil {
+			if depth == 1 {
+				switch {
+				case errors.Is(err, ErrSuicide):
+					counts.suicides++
+				case errors.Is(err, ErrKo):
+					counts.kos++
+				case errors.Is(err, ErrPositionalSuperko), errors.Is(err, ErrSituationalSuperko):
+					counts.superkos++
+				}
+			}
+			continue
+		}
+		if !r2.matches(g2) {
+			t.Fatalf("%v after %v: got\n%s\nreference got\n%v", m, g.prevMoves, g2, r2.grid)
+		}
+
+		if depth > 1 {
+			perft(t, g2, r2, depth-1, counts)
+			continue
+		}
+		counts.nodes++
+		if captured > 0 {
+			counts.captures++
+		}
+	}
+}
+
+// copyGame makes a deep copy of a game so that both can be played independently
+func copyGame(g Game) Game {
+	g2 := g
+	g2.board = g.board.Copy()
+	g2.nextBoard = g.nextBoard.Copy()
+	g2.prevMoves = append([]Move(nil), g.prevMoves...)
+	g2.prevHashes = append([]int(nil), g.prevHashes...)
+	g2.workingGroup = group{}
+	return g2
+}
+
+// refGame is a slow reference implementation of the rules for TestPerft. It copies the
+// whole game for every move, searches the whole board for captures, and keeps full
+// positions for ko instead of hashes.
+type refGame struct {
+	rows, cols int
+	grid       [][]int8
+	turn       int8
+	history    []refPosition // after every move, pass, and setup move
+	rules      refRuleset
+}
+
+// refRuleset is how a ruleset treats suicide and repeated positions in the reference
+type refRuleset struct {
+	suicideForbidden bool
+	ko               string // "simple", "positional", "situational", or "" for none
+}
+
+// refRulesets are written out from the rules themselves, not taken from Game.SetRules, so
+// that TestPerft also checks the flags each ruleset sets
+var refRulesets = map[string]refRuleset{
+	"NZ":  {false, "situational"},
+	"AGA": {true, "situational"},
+	"TT":  {false, "positional"},
+	"JPN": {true, "simple"},
+	"KOR": {true, "simple"},
+	"CHN": {true, "positional"},
+	"ING": {false, "situational"},
+	"":    {false, ""},
+}
+
+// refPosition is a position in the reference history with the color which created it
+type refPosition struct {
+	grid  string
+	color int8
+}
+
+func newRefGame(rows, cols int, ruleset string) refGame {
+	r := refGame{rows: rows, cols: cols, turn: 1, rules: refRulesets[ruleset]}
+	r.grid = make([][]int8, rows)
+	for i := range r.grid {
+		r.grid[i] = make([]int8, cols)
+	}
+	return r
+}
+
+// copy makes a deep copy of the game
+func (r refGame) copy() refGame {
+	r2 := r
+	r2.grid = make([][]int8, r.rows)
+	for i := range r.grid {
+		r2.grid[i] = append([]int8(nil), r.grid[i]...)
+	}
+	r2.history = append([]refPosition(nil), r.history...)
+	return r2
+}
+
+// group finds the stones connected to a point and counts their liberties
+func (r refGame) group(row, col int) ([][2]int, int) {
+	color := r.grid[row][col]
+	stones := [][2]int{{row, col}}
+	seen := map[[2]int]bool{{row, col}: true}
+	liberties := map[[2]int]bool{}
+	for k := 0; k < len(stones); k++ {
+		for _, d := range [][2]int{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+			p := [2]int{stones[k][0] + d[0], stones[k][1] + d[1]}
+			if (p[0] < 0) || (p[0] >= r.rows) || (p[1] < 0) || (p[1] >= r.cols) {
+				continue
+			}
+			if r.grid[p[0]][p[1]] == 0 {
+				liberties[p] = true
+			} else if (r.grid[p[0]][p[1]] == color) && !seen[p] {
+				seen[p] = true
+				stones = append(stones, p)
+			}
+		}
+	}
+	return stones, len(liberties)
+}
+
+// play returns the game after a move (or setup move) and the number of stones captured
+func (r refGame) play(m Move, setup bool) (refGame, int, error) {
+	if !setup && (m.Color != r.turn) {
+		return refGame{}, 0, ErrWrongPlayer
+	}
+	next := r.copy()
+	captured := 0
+	if m.pass {
+		next.turn = -m.Color
+	} else {
+		row, col := m.vertex[0], m.vertex[1]
+		if (row < 0) || (row >= r.rows) || (col < 0) || (col >= r.cols) {
+			return refGame{}, 0, ErrOutsideBoard
+		}
+		if !setup && (r.grid[row][col] != 0) {
+			return refGame{}, 0, ErrVertexNotEmpty
+		}
+		next.grid[row][col] = m.Color
+		if m.Color != 0 {
+			for i := 0; i < r.rows; i++ {
+				for j := 0; j < r.cols; j++ {
+					if next.grid[i][j] != -m.Color {
+						continue
+					}
+					if stones, liberties := next.group(i, j); liberties == 0 {
+						next.removeStones(stones)
+						captured += len(stones)
+					}
+				}
+			}
+			if stones, liberties := next.group(row, col); liberties == 0 {
+				if !setup && r.rules.suicideForbidden {
+					return refGame{}, 0, ErrSuicide
+				}
+				next.removeStones(stones)
+			}
+			next.turn = -m.Color
+		}
+	}
+
+	position := fmt.Sprint(next.grid)
+	if !setup && !m.pass {
+		for _, p := range r.history {
+			if p.grid != position {
+				continue
+			}
+			if r.rules.ko == "positional" {
+				return refGame{}, 0, ErrPositionalSuperko
+			}
+			if (r.rules.ko == "situational") && (p.color == m.Color) {
+				return refGame{}, 0, ErrSituationalSuperko
+			}
+		}
+		if n := len(r.history); (r.rules.ko == "simple") && (n >= 2) && (r.history[n-2].grid == position) {
+			return refGame{}, 0, ErrKo
+		}
+	}
+	next.history = append(next.history, refPosition{position, m.Color})
+	return next, captured, nil
+}
+
+// removeStones empties the given points
+func (r refGame) removeStones(stones [][2]int) {
+	for _, p := range stones {
+		r.grid[p[0]][p[1]] = 0
+	}
+}
+
+// matches checks if a game has the same position and turn as the reference
+func (r refGame) matches(g Game) bool {
+	if g.turn != r.turn {
+		return false
+	}
+	for i := 0; i < r.rows; i++ {
+		for j := 0; j < r.cols; j++ {
+			if g.board.look(vertex{i, j}) != r.grid[i][j] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func FuzzNewMoveFromString(f *testing.F) {
+	for _, s := range []string{"Bpd", "WAZ", "Eaa", "B", "E", "Zab", "W~5", ""} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		m, err := NewMoveFromString(s)
+		if err != nil {
+			return
+		}
+		if m.pass {
+			if (len(s) != 1) || (m.Color == 0) {
+				t.Errorf("%q parsed as pass", s)
+			}
+			return
+		}
+		if m.String() != s {
+			t.Errorf("%q printed as %q", s, m)
+		}
+	})
+}
+
+// fuzzRulesets are the rulesets tried by FuzzPlay
+var fuzzRulesets = []string{"NZ", "AGA", "TT", "JPN", "KOR", "CHN", "ING", ""}
+
+func FuzzPlay(f *testing.F) {
+	f.Add(uint8(8), uint8(8), uint8(0), []byte{}, []byte{0, 10, 0, 20, 0, 30, 15, 0, 0, 40})
+	f.Add(uint8(3), uint8(3), uint8(3), []byte{1, 1, 2, 3}, []byte{0, 5, 0, 7, 0, 1, 0, 3, 0, 4, 0, 1})
+	f.Add(uint8(4), uint8(2), uint8(5), []byte{0, 0, 1, 1, 2, 0}, []byte{0, 2, 4, 2, 0, 3, 0, 6, 15, 0, 15, 0})
+	f.Add(uint8(18), uint8(18), uint8(6), []byte{0, 60, 0, 72, 0, 250, 0, 252}, []byte{0, 180, 0, 181, 0, 199, 0, 200, 0, 161, 0, 162})
+	f.Fuzz(func(t *testing.T, rows, cols, ruleset uint8, setup, moves []byte) {
+		g := NewGame(int(rows)%19+1, int(cols)%19+1)
+		if err := g.SetRules(fuzzRulesets[int(ruleset)%len(fuzzRulesets)]); err != nil {
+			t.Fatal(err)
+		}
+		if len(moves) > 600 { // Superko replays make long games slow
+			moves = moves[:600]
+		}
+
+		// Setup stones, removals, and passes with colors 0 (black), 1 (white), or 2 (empty)
+		for i := 0; i+1 < len(setup); i += 2 {
+			m := fuzzMove(g, []int8{1, -1, 0}[setup[i]%3], setup[i], setup[i+1])
+			if (m.Color == 0) && m.pass {
+				continue
+			}
+			g.Setup(m)
+			checkBoard(t, g)
+		}
+
+		// Moves by the player to move, or by the wrong player if the first byte has the 4 bit
+		// set (with the low four bits all set it is a pass)
+		for i := 0; i+1 < len(moves); i += 2 {
+			color := g.turn
+			if moves[i]&4 != 0 {
+				color = -color
+			}
+			m := fuzzMove(g, color, moves[i], moves[i+1])
+			before := g.board.Copy()
+			errCheck := g.Check(m)
+			if !g.board.Equals(before) || (g.board.hash != before.hash) {
+				t.Fatalf("check of %v changed the board", m)
+			}
+			errPlay := g.Play(m)
+			if (errCheck == nil) != (errPlay == nil) {
+				t.Fatalf("check of %v gave %v, play gave %v", m, errCheck, errPlay)
+			}
+			if (errPlay != nil) && (!g.board.Equals(before) || (g.board.hash != before.hash)) {
+				t.Fatalf("illegal move %v changed the board", m)
+			}
+			checkBoard(t, g)
+		}
+	})
+}
+
+// fuzzMove makes a move from two bytes, passing if the low bits of the first are all set
+func fuzzMove(g Game, color int8, b1, b2 byte) Move {
+	if b1&15 == 15 {
+		return NewMovePass(color)
+	}
+	i := int(b2) % (g.board.rows * g.board.cols)
+	return NewMove(color, i/g.board.cols, i%g.board.cols)
+}
+
+// checkBoard checks that every group has a liberty and that the hash matches the stones
+func checkBoard(t *testing.T, g Game) {
+	var p group
+	hash := 0
+	for i, c := range g.board.flatArray {
+		if c == 0 {
+			continue
+		}
+		hash ^= g.board.hashTable[i*2+int(c+1)/2]
+		p.expandAll(vertex{i / g.board.cols, i % g.board.cols}, g.board)
+		if !p.alive {
+			t.Fatalf("group without liberties at %v:\n%s", vertex{i / g.board.cols, i % g.board.cols}, g)
+		}
+	}
+	if hash != g.board.hash {
+		t.Fatalf("incremental hash %d does not match %d:\n%s", g.board.hash, hash, g)
+	}
+}
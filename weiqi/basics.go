@@ -22,6 +22,7 @@ func NewMovePass(color int8) Move {
 }
 
 // NewMoveFromString parses an SGF-style string like "Bcd" (pass is "W", not "Wtt").
+// Color "E" (like "Ecd") removes a stone, which is only allowed as a setup move.
 // The maximum coordinate in this format is Z (52), use NewMove for larger sizes.
 func NewMoveFromString(moveString string) (Move, error) {
 
@@ -42,11 +43,16 @@ func NewMoveFromString(moveString string) (Move, error) {
 		color = 1
 	case 'W':
 		color = -1
+	case 'E':
+		color = 0
 	default:
 		return Move{}, fmt.Errorf("invalid color in move: %q", moveString)
 	}
 
 	// Parse vertex
+	if pass && (color == 0) {
+		return Move{}, fmt.Errorf("invalid empty pass: %q", moveString)
+	}
 	if pass {
 		return Move{Color: color, pass: true}, nil
 	}
@@ -65,6 +71,8 @@ func (m Move) String() string {
 		playerLetter = "B"
 	case -1:
 		playerLetter = "W"
+	case 0:
+		playerLetter = "E"
 	}
 	rowLetter, err1 := coordinateToLetter(m.vertex[0])
 	colLetter, err2 := coordinateToLetter(m.vertex[1])
@@ -58,12 +58,17 @@ func (b *board) look(v vertex) int8 {
 	return b.flatArray[v[0]*b.cols+v[1]]
 }
 
-// place places a move and updates the board hash
+// place places a move (or removes a stone for color 0) and updates the board hash
 func (b *board) place(m Move) {
 	if !m.pass {
 		i := m.vertex[0]*b.cols + m.vertex[1]
+		if b.flatArray[i] != 0 { // Only for setup
+			b.hash = b.hash ^ b.hashTable[i*2+int(b.flatArray[i]+1)/2]
+		}
 		b.flatArray[i] = m.Color
-		b.hash = b.hash ^ b.hashTable[i*2+int(b.flatArray[i]+1)/2]
+		if m.Color != 0 {
+			b.hash = b.hash ^ b.hashTable[i*2+int(b.flatArray[i]+1)/2]
+		}
 	}
 }
 
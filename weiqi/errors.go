@@ -23,6 +23,12 @@ var ErrSituationalSuperko error = errors.New("violates situational superko")
 // ErrPositionalSuperko means that the same position has been created before
 var ErrPositionalSuperko error = errors.New("violates positional superko")
 
+// ErrKo means that the move immediately retakes a ko
+var ErrKo error = errors.New("violates simple ko")
+
+// ErrHandicap means that handicap stones cannot be placed or do not match a fixed handicap
+var ErrHandicap error = errors.New("invalid handicap")
+
 // GameError wraps an error with additional information about the attempted move
 type GameError struct {
 	err       error
@@ -3,12 +3,19 @@ Package weiqi implements Go game logic.
 
 Rulesets available:
 
-    New Zealand (default)    "NZ"   (situational superko, suicide allowed)
-    American Go Association  "AGA"  (situational superko, suicide prohibited)
-    Tromp-Taylor             "TT"   (positional superko, suicide allowed)
-    unrestricted             ""     (no ko rule, suicide allowed)
+	New Zealand (default)    "NZ"   (situational superko, suicide allowed)
+	American Go Association  "AGA"  (situational superko, suicide prohibited)
+	Tromp-Taylor             "TT"   (positional superko, suicide allowed)
+	Japanese                 "JPN"  (simple ko, suicide prohibited)
+	Korean                   "KOR"  (simple ko, suicide prohibited)
+	Chinese                  "CHN"  (positional superko, suicide prohibited)
+	Ing                      "ING"  (situational superko, suicide allowed)
+	unrestricted             ""     (no ko rule, suicide allowed)
 
-Game scoring is not supported yet.*/
+Simple ko only forbids retaking a ko immediately, so long cycles like triple ko are legal.
+
+Game scoring is not supported yet.
+*/
 package weiqi
 
 import (
@@ -30,6 +37,7 @@ type Game struct {
 	SuicideForbidden   bool
 	SituationalSuperko bool
 	PositionalSuperko  bool
+	SimpleKo           bool
 
 	// these eliminate new allocations on each turn
 	workingGroup group
@@ -48,11 +56,12 @@ func NewGame(rows, cols int) Game {
 	return g
 }
 
-// SetRules configures the ruleset used ("NZ", "AGA", "TT", or "")
+// SetRules configures the ruleset used ("NZ", "AGA", "TT", "JPN", "KOR", "CHN", "ING", or "")
 func (g *Game) SetRules(ruleset string) error {
 	g.SuicideForbidden = false
 	g.SituationalSuperko = false
 	g.PositionalSuperko = false
+	g.SimpleKo = false
 	switch ruleset {
 	case "NZ":
 		g.SituationalSuperko = true
@@ -61,6 +70,14 @@ func (g *Game) SetRules(ruleset string) error {
 		g.SituationalSuperko = true
 	case "TT":
 		g.PositionalSuperko = true
+	case "JPN", "KOR":
+		g.SuicideForbidden = true
+		g.SimpleKo = true
+	case "CHN":
+		g.SuicideForbidden = true
+		g.PositionalSuperko = true
+	case "ING":
+		g.SituationalSuperko = true
 	case "":
 	default:
 		return fmt.Errorf("did not recognize ruleset: %s", ruleset)
@@ -101,6 +118,16 @@ func (g *Game) playWithMode(m Move, playMode string) error {
 		return GameError{ErrOutsideBoard, m}
 	}
 
+	// Removing a stone (only reachable in setup) never captures
+	if m.Color == 0 {
+		if playMode != "check" {
+			g.board.place(m)
+			g.prevMoves = append(g.prevMoves, m)
+			g.prevHashes = append(g.prevHashes, g.board.hash)
+		}
+		return nil
+	}
+
 	// Vertex not empty
 	emptyColor := g.board.flatArray[m.vertex[0]*g.board.cols+m.vertex[1]]
 	if emptyColor != 0 {
@@ -146,17 +173,7 @@ func (g *Game) playWithMode(m Move, playMode string) error {
 	if (g.PositionalSuperko || g.SituationalSuperko) && (playMode != "setup") {
 		for i := range g.prevMoves {
 			if g.nextBoard.hash == g.prevHashes[i] {
-				confirmedRepeat := true
-				if !g.TrustHashes {
-					replayGame := NewGame(g.board.rows, g.board.cols) // Replay game to check boards
-					for _, m := range g.prevMoves[:i+1] {
-						replayGame.Setup(m)
-					}
-					if !g.nextBoard.Equals(replayGame.board) {
-						confirmedRepeat = false
-					}
-				}
-				if confirmedRepeat {
+				if g.repeatsPrevious(i) {
 					if g.PositionalSuperko {
 						return GameError{ErrPositionalSuperko, m}
 					}
@@ -168,6 +185,13 @@ func (g *Game) playWithMode(m Move, playMode string) error {
 		}
 	}
 
+	// Check simple ko (the position before the opponent's last move cannot be repeated)
+	if g.SimpleKo && (playMode != "setup") {
+		if i := len(g.prevHashes) - 2; (i >= 0) && (g.nextBoard.hash == g.prevHashes[i]) && g.repeatsPrevious(i) {
+			return GameError{ErrKo, m}
+		}
+	}
+
 	// Update game state (this is also potentially updated for passes above)
 	if playMode != "check" {
 		g.turn = -m.Color
@@ -178,6 +202,19 @@ func (g *Game) playWithMode(m Move, playMode string) error {
 	return nil
 }
 
+// repeatsPrevious checks if the next board matches the board after previous move i
+// (already known to have the same hash), replaying the game unless hashes are trusted
+func (g *Game) repeatsPrevious(i int) bool {
+	if g.TrustHashes {
+		return true
+	}
+	replayGame := NewGame(g.board.rows, g.board.cols) // Replay game to check boards
+	for _, m := range g.prevMoves[:i+1] {
+		replayGame.Setup(m)
+	}
+	return g.nextBoard.Equals(replayGame.board)
+}
+
 // Play plays a move if it is legal
 func (g *Game) Play(m Move) error {
 	return g.playWithMode(m, "play")
@@ -190,11 +227,20 @@ func (g *Game) Check(m Move) error {
 
 // Setup allows arbitrary moves to be played for setup purposes.
 // Everything behaves like a normal move except for legality checks.
+// Stones may replace other stones, and color 0 removes a stone without changing the turn.
 // The only possible error is ErrOutsideBoard for invalid vertices.
 func (g *Game) Setup(m Move) error {
 	return g.playWithMode(m, "setup")
 }
 
+// SetTurn sets the player to move next (1 for black, -1 for white else panic)
+func (g *Game) SetTurn(color int8) {
+	if (color != 1) && (color != -1) {
+		panic("tried to set turn to invalid color")
+	}
+	g.turn = color
+}
+
 func (g Game) String() string {
 	return g.board.String()
 }
@@ -231,3 +277,59 @@ func CheckLegal(rows, cols int, Setup, Moves []string, ruleset string) error {
 	}
 	return nil
 }
+
+// CheckLegalPosition checks if a game from a setup position is legal and returns nil error if yes.
+// The setup may include black, white, and empty ("E") points. Player ("B", "W", or "") moves
+// first; if not given, white moves after an all-black (handicap) setup, otherwise the first
+// move decides.
+func CheckLegalPosition(rows, cols int, Setup []string, Player string, Moves []string, ruleset string) error {
+	if (rows < 0) || (cols < 0) {
+		return fmt.Errorf("negative game size: %d %d", rows, cols)
+	}
+	g := NewGame(rows, cols)
+	err := g.SetRules(ruleset)
+	if err != nil {
+		return err
+	}
+	handicap := true
+	for _, ms := range Setup {
+		m, err := NewMoveFromString(ms)
+		if err != nil {
+			return err
+		}
+		err = g.Setup(m)
+		if err != nil {
+			return err
+		}
+		handicap = handicap && (m.Color == 1)
+	}
+	switch {
+	case Player == "B":
+		g.SetTurn(1)
+	case Player == "W":
+		g.SetTurn(-1)
+	case Player != "":
+		return fmt.Errorf("invalid player: %q", Player)
+	case handicap && (len(Setup) > 0):
+		g.SetTurn(-1)
+	case len(Moves) > 0:
+		m, err := NewMoveFromString(Moves[0])
+		if err != nil {
+			return err
+		}
+		if m.Color != 0 {
+			g.SetTurn(m.Color)
+		}
+	}
+	for _, ms := range Moves {
+		m, err := NewMoveFromString(ms)
+		if err != nil {
+			return err
+		}
+		err = g.Play(m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package weiqi
+
+import (
+	"fmt"
+)
+
+// HandicapOrder is the order in which fixed handicap stones are placed, which matters
+// for a handicap of 3
+type HandicapOrder int
+
+const (
+	// HandicapGTP is lower left, upper right, upper left, lower right, then left and right
+	// sides, bottom and top, with the third stone in the upper left
+	HandicapGTP HandicapOrder = iota
+	// HandicapTraditional is upper right, lower left, lower right, upper left, then left and
+	// right sides, top and bottom, as used by game servers, with the third stone in the lower
+	// right
+	HandicapTraditional
+)
+
+// FixedHandicap places a fixed handicap on the star points in GTP order (lower left, upper
+// right, upper left, lower right, then left and right sides, bottom and top, with the
+// center added for odd handicaps). Both dimensions must be at least 7. Rectangular boards
+// are allowed, and stones sit on the third line below 13 and the fourth line otherwise.
+// Handicaps above 4 need both dimensions odd and larger than 7, like in GTP.
+func FixedHandicap(rows, cols, handicap int) ([]Move, error) {
+	return FixedHandicapOrder(rows, cols, handicap, HandicapGTP)
+}
+
+// FixedHandicapOrder places a fixed handicap like FixedHandicap, in the given order
+func FixedHandicapOrder(rows, cols, handicap int, order HandicapOrder) ([]Move, error) {
+	if (rows < 7) || (cols < 7) {
+		return nil, fmt.Errorf("%w: no fixed handicap on %dx%d board", ErrHandicap, rows, cols)
+	}
+	maxHandicap := 4
+	if (rows%2 == 1) && (cols%2 == 1) && (rows > 7) && (cols > 7) {
+		maxHandicap = 9
+	}
+	if (handicap < 2) || (handicap > maxHandicap) {
+		return nil, fmt.Errorf("%w: no fixed handicap of %d on %dx%d board", ErrHandicap, handicap, rows, cols)
+	}
+
+	// Star points along each dimension
+	lines := func(n int) (lo, mid, hi int) {
+		edge := 3
+		if n < 13 {
+			edge = 2
+		}
+		return edge, n / 2, n - 1 - edge
+	}
+	top, middle, bottom := lines(rows)
+	left, center, right := lines(cols)
+
+	points := [][2]int{{bottom, left}, {top, right}, {top, left}, {bottom, right}}
+	sides := [][2]int{{middle, left}, {middle, right}, {bottom, center}, {top, center}}
+	if order == HandicapTraditional {
+		points = [][2]int{{top, right}, {bottom, left}, {bottom, right}, {top, left}}
+		sides = [][2]int{{middle, left}, {middle, right}, {top, center}, {bottom, center}}
+	}
+	if handicap > 4 {
+		points = append(points, sides[:(handicap-4)/2*2]...)
+	}
+	if (handicap > 4) && (handicap%2 == 1) {
+		points = append(points, [2]int{middle, center})
+	}
+	stones := make([]Move, 0, handicap)
+	for _, p := range points[:handicap] {
+		stones = append(stones, NewMove(1, p[0], p[1]))
+	}
+	return stones, nil
+}
+
+// PlaceHandicap sets up freely placed black handicap stones before any moves and gives
+// white the turn. Stones must be distinct, on the board, and leave at least one point empty.
+func (g *Game) PlaceHandicap(stones []Move) error {
+	if len(g.prevMoves) > 0 {
+		return fmt.Errorf("%w: game already started", ErrHandicap)
+	}
+	if (len(stones) < 2) || (len(stones) >= g.board.rows*g.board.cols) {
+		return fmt.Errorf("%w: no handicap of %d on %dx%d board", ErrHandicap, len(stones), g.board.rows, g.board.cols)
+	}
+	placed := make(map[vertex]bool)
+	for _, m := range stones {
+		if (m.Color != 1) || m.pass {
+			return fmt.Errorf("%w: %q is not a black stone", ErrHandicap, m)
+		}
+		if !g.board.exists(m.vertex) {
+			return GameError{ErrOutsideBoard, m}
+		}
+		if placed[m.vertex] {
+			return fmt.Errorf("%w: %q placed twice", ErrHandicap, m)
+		}
+		placed[m.vertex] = true
+	}
+	for _, m := range stones {
+		g.Setup(m)
+	}
+	g.SetTurn(-1)
+	return nil
+}
+
+// CheckFixedHandicap checks that setup moves (like "Bdp") are exactly the fixed handicap
+// stones for the given handicap, in any order, and returns nil error if yes. Either
+// conventional third stone is accepted: upper left like GTP, or lower right like game
+// servers.
+func CheckFixedHandicap(rows, cols, handicap int, Setup []string) error {
+	err := checkFixedHandicap(rows, cols, handicap, Setup, HandicapGTP)
+	if (err != nil) && (checkFixedHandicap(rows, cols, handicap, Setup, HandicapTraditional) == nil) {
+		return nil
+	}
+	return err
+}
+
+func checkFixedHandicap(rows, cols, handicap int, Setup []string, order HandicapOrder) error {
+	if len(Setup) != handicap {
+		return fmt.Errorf("%w: %d setup stones for handicap %d", ErrHandicap, len(Setup), handicap)
+	}
+	fixed, err := FixedHandicapOrder(rows, cols, handicap, order)
+	if err != nil {
+		return err
+	}
+	expected := make(map[Move]bool)
+	for _, m := range fixed {
+		expected[m] = true
+	}
+	for _, ms := range Setup {
+		m, err := NewMoveFromString(ms)
+		if err != nil {
+			return err
+		}
+		if !expected[m] {
+			return fmt.Errorf("%w: %q is not a fixed handicap point", ErrHandicap, m)
+		}
+		delete(expected, m)
+	}
+	return nil
+}